@@ -0,0 +1,345 @@
+// Package acclienttest provides an in-memory backend for testing code that
+// depends on acclient without a Cassandra cluster, gRPC services or kafka.
+//
+//	backend := acclienttest.New()
+//	backend.AddAccount(&pb.Account{Id: conv.S("acc1"), State: conv.S("activated")})
+//	backend.AddAgent(&pb.Agent{AccountId: conv.S("acc1"), Id: conv.S("ag1"), State: conv.S("active"), Scopes: []string{"owner"}})
+//	client := backend.Client()
+//	err := client.CheckPerm(ctx, "ticket", "read", "acc1", "ag1", "agent", false, false)
+package acclienttest
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/subiz/acclient/v2"
+	"github.com/subiz/header"
+	pb "github.com/subiz/header/account"
+	pm "github.com/subiz/header/payment"
+	"google.golang.org/protobuf/proto"
+)
+
+// Message is a kafka message recorded by the backend
+type Message struct {
+	Topic string
+	Keys  []string
+	Value proto.Message
+}
+
+type kvEntry struct {
+	value   string
+	version int64
+	expires time.Time // zero means never
+}
+
+type signedKey struct {
+	accid, issuer, typ, keytype string
+	objects                     []string
+}
+
+// Backend is an in-memory replacement for the databases, services and kafka
+// brokers an acclient.Client talks to. Seed it with the resources the code
+// under test reads, then create clients with Client. It is safe for concurrent
+// use.
+//
+// Every seeding method also fires the matching pubsub event, so clients that
+// already cached the resource drop it on their next poll (about a second).
+type Backend struct {
+	lock *sync.Mutex
+
+	accounts     map[string]*pb.Account
+	subs         map[string]*pm.Subscription
+	agents       map[string]map[string]*pb.Agent
+	groups       map[string]map[string]*header.AgentGroup
+	bots         map[string]map[string]*header.Bot
+	aiagents     map[string]map[string]*header.AIAgent
+	defs         map[string]map[string]*header.AttributeDefinition
+	langs        map[string]map[string]*header.LangMessage // accid_locale -> key
+	shopSettings map[string]*header.ShopSetting
+	notiSettings map[string]*header.NotiSetting // accid_agid
+	pipelines    map[string]map[string]*header.Pipeline
+	blacklistIPs map[string]map[string]*header.BlacklistIP
+	bannedUsers  map[string]map[string]*header.BannedUser
+	integrations map[string]*header.Integration // accid/inteid
+	signedKeys   map[string]*signedKey
+	compacts     map[string]int
+	uncompacts   map[int]string
+	links        map[string]*header.Link
+	ids          map[string]int64 // accid/scope
+	kv           map[string]*kvEntry
+	kvVersion    int64                                   // last version given to a kv entry
+	jobs         map[string]*acclient.JobInfo            // accid/jobid
+	jobLogs      map[string][]*acclient.JobLog           // accid/jobid
+	files        map[string][]byte                       // url
+	queues       map[string]map[string]*acclient.JobInfo // category -> accid/jobid
+
+	creditErrs    map[string]error
+	spendAttempts []*header.CreditSpendEntry
+	messages      []*Message
+
+	events    []*header.Event
+	cursors   map[string]int // connection id -> index of the next event
+	pubsubErr error
+}
+
+// New creates an empty backend
+func New() *Backend {
+	return &Backend{
+		lock:         &sync.Mutex{},
+		accounts:     map[string]*pb.Account{},
+		subs:         map[string]*pm.Subscription{},
+		agents:       map[string]map[string]*pb.Agent{},
+		groups:       map[string]map[string]*header.AgentGroup{},
+		bots:         map[string]map[string]*header.Bot{},
+		aiagents:     map[string]map[string]*header.AIAgent{},
+		defs:         map[string]map[string]*header.AttributeDefinition{},
+		langs:        map[string]map[string]*header.LangMessage{},
+		shopSettings: map[string]*header.ShopSetting{},
+		notiSettings: map[string]*header.NotiSetting{},
+		pipelines:    map[string]map[string]*header.Pipeline{},
+		blacklistIPs: map[string]map[string]*header.BlacklistIP{},
+		bannedUsers:  map[string]map[string]*header.BannedUser{},
+		integrations: map[string]*header.Integration{},
+		signedKeys:   map[string]*signedKey{},
+		compacts:     map[string]int{},
+		uncompacts:   map[int]string{},
+		links:        map[string]*header.Link{},
+		ids:          map[string]int64{},
+		kv:           map[string]*kvEntry{},
+		jobs:         map[string]*acclient.JobInfo{},
+		jobLogs:      map[string][]*acclient.JobLog{},
+		files:        map[string][]byte{},
+		queues:       map[string]map[string]*acclient.JobInfo{},
+		creditErrs:   map[string]error{},
+		cursors:      map[string]int{},
+	}
+}
+
+// Client creates an acclient.Client wired to this backend. Extra options are
+// applied after the backend ones.
+func (me *Backend) Client(opts ...acclient.Option) *acclient.Client {
+	return acclient.New(append([]acclient.Option{
+		acclient.WithStore(me),
+		acclient.WithPublisher(me),
+		acclient.WithFileStore(me),
+		acclient.WithAccountMgr(&accountMgr{backend: me}),
+		acclient.WithPaymentMgr(&paymentMgr{backend: me}),
+		acclient.WithCreditMgr(&creditMgr{backend: me}),
+		acclient.WithFabikon(&fabikon{}),
+		acclient.WithNumberRegistry(&numberRegistry{backend: me}),
+		acclient.WithPubsub(&pubsub{backend: me}),
+		acclient.WithConvo(&convo{backend: me}),
+	}, opts...)...)
+}
+
+// AddAccount adds or replaces an account
+func (me *Backend) AddAccount(acc *pb.Account) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	me.accounts[acc.GetId()] = proto.Clone(acc).(*pb.Account)
+	me.fire(acc.GetId(), "account")
+}
+
+// SetSubscription adds or replaces the subscription of sub.AccountId
+func (me *Backend) SetSubscription(sub *pm.Subscription) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	me.subs[sub.GetAccountId()] = proto.Clone(sub).(*pm.Subscription)
+	me.fire(sub.GetAccountId(), "subscription")
+}
+
+// AddAgent adds or replaces an agent of agent.AccountId
+func (me *Backend) AddAgent(agent *pb.Agent) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	accid := agent.GetAccountId()
+	if me.agents[accid] == nil {
+		me.agents[accid] = map[string]*pb.Agent{}
+	}
+	me.agents[accid][agent.GetId()] = proto.Clone(agent).(*pb.Agent)
+	me.fire(accid, "agent")
+}
+
+// AddGroup adds or replaces an agent group of group.AccountId
+func (me *Backend) AddGroup(group *header.AgentGroup) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	accid := group.GetAccountId()
+	if me.groups[accid] == nil {
+		me.groups[accid] = map[string]*header.AgentGroup{}
+	}
+	me.groups[accid][group.GetId()] = proto.Clone(group).(*header.AgentGroup)
+	me.fire(accid, "agent_group")
+}
+
+// AddBot adds or replaces a bot of bot.AccountId
+func (me *Backend) AddBot(bot *header.Bot) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	accid := bot.GetAccountId()
+	if me.bots[accid] == nil {
+		me.bots[accid] = map[string]*header.Bot{}
+	}
+	me.bots[accid][bot.GetId()] = proto.Clone(bot).(*header.Bot)
+	me.fire(accid, "bot")
+}
+
+// AddAIAgent adds or replaces an AI agent of agent.AccountId
+func (me *Backend) AddAIAgent(agent *header.AIAgent) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	accid := agent.GetAccountId()
+	if me.aiagents[accid] == nil {
+		me.aiagents[accid] = map[string]*header.AIAgent{}
+	}
+	me.aiagents[accid][agent.GetId()] = proto.Clone(agent).(*header.AIAgent)
+	me.fire(accid, "ai_agent")
+}
+
+// AddAttrDef adds or replaces an attribute definition. Clients always merge
+// the default definitions (header.ListDefaultDefs) on top of these.
+func (me *Backend) AddAttrDef(accid string, def *header.AttributeDefinition) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	if me.defs[accid] == nil {
+		me.defs[accid] = map[string]*header.AttributeDefinition{}
+	}
+	me.defs[accid][def.GetKey()] = proto.Clone(def).(*header.AttributeDefinition)
+	me.fire(accid, "attribute_definition")
+}
+
+// AddLangMessage adds or replaces a message of locale msg.Locale. Remember
+// that GetLocale falls back to the messages of account "subiz".
+func (me *Backend) AddLangMessage(accid string, msg *header.LangMessage) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	k := accid + "_" + msg.GetLocale()
+	if me.langs[k] == nil {
+		me.langs[k] = map[string]*header.LangMessage{}
+	}
+	me.langs[k][msg.GetKey()] = proto.Clone(msg).(*header.LangMessage)
+	me.fire(k, "lang")
+}
+
+// SetShopSetting replaces the shop setting of setting.AccountId
+func (me *Backend) SetShopSetting(setting *header.ShopSetting) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	me.shopSettings[setting.GetAccountId()] = proto.Clone(setting).(*header.ShopSetting)
+	me.fire(setting.GetAccountId(), "shop_setting")
+}
+
+// AddLink adds or replaces the link behind a shortened url
+func (me *Backend) AddLink(shorten string, link *header.Link) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	me.links[shorten] = proto.Clone(link).(*header.Link)
+}
+
+// PutKV puts a key-value pair without expiry, the same way acclient.SetKV
+// namespaces it by scope
+func (me *Backend) PutKV(scope, key, value string) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	me.kv[scope+"@"+key] = me.newKVEntry(value, 0)
+}
+
+// AddJob adds or replaces a job
+func (me *Backend) AddJob(job *header.Job) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	me.jobs[job.GetAccountId()+"/"+job.GetId()] = &acclient.JobInfo{Job: proto.Clone(job).(*header.Job)}
+}
+
+// SetCreditError makes every TrySpend call of the account that reaches the
+// credit service fail with err, nil makes them succeed again
+func (me *Backend) SetCreditError(accid string, err error) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	me.creditErrs[accid] = err
+}
+
+// SetPubsubError makes every pubsub poll fail with err, the events fired
+// meanwhile are lost. nil makes polls succeed again.
+func (me *Backend) SetPubsubError(err error) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	me.pubsubErr = err
+}
+
+// SpendAttempts returns the entries TrySpend sent to the credit service
+func (me *Backend) SpendAttempts() []*header.CreditSpendEntry {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	return append([]*header.CreditSpendEntry{}, me.spendAttempts...)
+}
+
+// Messages returns all published kafka messages in order
+func (me *Backend) Messages() []*Message {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	return append([]*Message{}, me.messages...)
+}
+
+// Spends returns the credit spends published by Spend
+func (me *Backend) Spends() []*header.CreditSpendEntry {
+	out := []*header.CreditSpendEntry{}
+	for _, msg := range me.Messages() {
+		if entry, ok := msg.Value.(*header.CreditSpendEntry); ok {
+			out = append(out, entry)
+		}
+	}
+	return out
+}
+
+// Counters returns the data points published by IncCounter
+func (me *Backend) Counters() []*header.CounterDataPoint {
+	out := []*header.CounterDataPoint{}
+	for _, msg := range me.Messages() {
+		if point, ok := msg.Value.(*header.CounterDataPoint); ok {
+			out = append(out, point)
+		}
+	}
+	return out
+}
+
+// Indexes returns the documents published by Index and IndexByLocale
+func (me *Backend) Indexes() []*header.DocIndexRequest {
+	out := []*header.DocIndexRequest{}
+	for _, msg := range me.Messages() {
+		if req, ok := msg.Value.(*header.DocIndexRequest); ok {
+			out = append(out, req)
+		}
+	}
+	return out
+}
+
+// Publish implements acclient.Publisher
+func (me *Backend) Publish(topic string, msg proto.Message, keys ...string) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	me.messages = append(me.messages, &Message{Topic: topic, Keys: keys, Value: proto.Clone(msg)})
+}
+
+// fire queues a pubsub event for topic typ.accid, caller must hold the lock
+func (me *Backend) fire(accid, typ string) {
+	me.events = append(me.events, &header.Event{AccountId: accid, Type: typ, Created: time.Now().UnixMilli()})
+}
+
+func (me *Backend) nextID(accid, scope string) int64 {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	me.ids[accid+"/"+scope]++
+	return me.ids[accid+"/"+scope]
+}
+
+func (me *Backend) lastID(accid, scope string) int64 {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	return me.ids[accid+"/"+scope]
+}
+
+func itoa(i int64) string {
+	return strconv.FormatInt(i, 10)
+}
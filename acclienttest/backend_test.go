@@ -0,0 +1,425 @@
+package acclienttest
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/subiz/acclient/v2"
+	"github.com/subiz/header"
+	pb "github.com/subiz/header/account"
+	pm "github.com/subiz/header/payment"
+	"github.com/subiz/log"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func s(str string) *string { return &str }
+
+func newTestBackend() *Backend {
+	backend := New()
+	backend.AddAccount(&pb.Account{Id: s("acc1"), State: s("activated")})
+	backend.SetSubscription(&pm.Subscription{AccountId: s("acc1")})
+	backend.AddAgent(&pb.Agent{AccountId: s("acc1"), Id: s("ag1"), State: s("active"), Scopes: []string{"ticket:read:all"}})
+	backend.AddAgent(&pb.Agent{AccountId: s("acc1"), Id: s("ag2"), State: s("active")})
+	return backend
+}
+
+func TestCheckPerm(t *testing.T) {
+	ctx := context.Background()
+	client := newTestBackend().Client()
+	if err := client.CheckPerm(ctx, "ticket", "read", "acc1", "ag1", "agent", false, false); err != nil {
+		t.Errorf("ag1 should read tickets, got %v", err)
+	}
+
+	err := client.CheckPerm(ctx, "ticket", "read", "acc1", "ag2", "agent", false, false)
+	if !log.IsErr(err, log.E_access_deny.String()) {
+		t.Errorf("ag2 should not read tickets, got %v", err)
+	}
+
+	acc, err := client.GetAccount(ctx, "acc2")
+	if err != nil || acc != nil {
+		t.Errorf("want missing account, got %v %v", acc, err)
+	}
+}
+
+func TestTrySpend(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestBackend()
+	client := backend.Client()
+	if err := client.TrySpend(ctx, "acc1", "llm", 1000); err != nil {
+		t.Fatal(err)
+	}
+
+	backend.SetCreditError("acc1", log.ENotEnoughCredit("acc1", "balance", "balance", "llm"))
+	if err := client.TrySpend(ctx, "acc1", "llm", 1000); err == nil {
+		t.Error("want error, got nil")
+	}
+
+	if n := len(backend.SpendAttempts()); n != 2 {
+		t.Errorf("want 2 attempts, got %d", n)
+	}
+}
+
+func TestKVAndJob(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestBackend()
+	backend.PutKV("user", "k1", "v1")
+	client := backend.Client()
+
+	if val, has, err := client.GetKV(ctx, "user", "k1"); err != nil || !has || val != "v1" {
+		t.Errorf("want v1, got %q %v %v", val, has, err)
+	}
+	if err := client.DelKV(ctx, "user", "k1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, has, _ := client.GetKV(ctx, "user", "k1"); has {
+		t.Error("k1 should be deleted")
+	}
+
+	jobid, err := client.StartJob(ctx, "acc1", "import", "", "contact", 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.EndJob(ctx, "acc1", jobid, "done", []byte("ok")); err != nil {
+		t.Fatal(err)
+	}
+	job, err := client.GetJob(ctx, "acc1", jobid)
+	if err != nil || job.GetStatus() != "done" || string(job.GetOutput()) != "ok" || job.GetEnded() == 0 {
+		t.Errorf("unexpected job %v, err %v", job, err)
+	}
+}
+
+func TestKVConditional(t *testing.T) {
+	ctx := context.Background()
+	client := newTestBackend().Client()
+
+	if ok, err := client.SetKVIfNotExists(ctx, "user", "n", "0", 60); err != nil || !ok {
+		t.Fatalf("want n set, got %v %v", ok, err)
+	}
+	if ok, _ := client.SetKVIfNotExists(ctx, "user", "n", "9", 60); ok {
+		t.Error("n exists, it should not be set")
+	}
+	_, ver0, _, _ := client.GetKVWithVersion(ctx, "user", "n")
+	if ok, _ := client.CompareAndSwapKV(ctx, "user", "n", "1", "2", 60); ok {
+		t.Error("n is 0, it should not be swapped")
+	}
+	if ok, err := client.CompareAndSwapKV(ctx, "user", "n", "0", "1", 60); err != nil || !ok {
+		t.Fatalf("want n swapped, got %v %v", ok, err)
+	}
+	if val, ver1, _, _ := client.GetKVWithVersion(ctx, "user", "n"); val != "1" || ver1 <= ver0 {
+		t.Errorf("want 1 with a new version, got %q %d <= %d", val, ver1, ver0)
+	}
+}
+
+func TestKVTTL(t *testing.T) {
+	ctx := context.Background()
+	client := newTestBackend().Client()
+
+	if err := client.SetKVTTL(ctx, "user", "n", "1", 60); err != nil {
+		t.Fatal(err)
+	}
+	if ttl, found, err := client.GetKVTTL(ctx, "user", "n"); err != nil || !found || ttl <= 0 || ttl > 60 {
+		t.Errorf("want ttl within 60s, got %d %v %v", ttl, found, err)
+	}
+	if ok, err := client.TouchKV(ctx, "user", "n", acclient.KVNoExpiry); err != nil || !ok {
+		t.Fatalf("want n touched, got %v %v", ok, err)
+	}
+	if val, has, _ := client.GetKV(ctx, "user", "n"); !has || val != "1" {
+		t.Errorf("touch should keep the value, got %q %v", val, has)
+	}
+	if ttl, found, _ := client.GetKVTTL(ctx, "user", "n"); !found || ttl != acclient.KVNoExpiry {
+		t.Errorf("want no expiry, got %d %v", ttl, found)
+	}
+	if ok, _ := client.TouchKV(ctx, "user", "missing", 60); ok {
+		t.Error("missing key should not be touched")
+	}
+}
+
+// failingStore fails the KV operations of the keys ending with "!"
+type failingStore struct{ *Backend }
+
+func (me failingStore) GetKV(ctx context.Context, k string) (string, bool, error) {
+	if strings.HasSuffix(k, "!") {
+		return "", false, log.ERetry(nil, log.M{"key": k})
+	}
+	return me.Backend.GetKV(ctx, k)
+}
+
+func (me failingStore) SetKV(ctx context.Context, k, v string, ttlsec int) error {
+	if strings.HasSuffix(k, "!") {
+		return log.ERetry(nil, log.M{"key": k})
+	}
+	return me.Backend.SetKV(ctx, k, v, ttlsec)
+}
+
+func TestKVMulti(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestBackend()
+	client := backend.Client(acclient.WithStore(failingStore{backend}))
+
+	if err := client.SetKVMulti(ctx, "user", map[string]string{"k2": "v2", "k3": "v3"}, 60); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.DelKVMulti(ctx, "user", []string{"k3"}); err != nil {
+		t.Fatal(err)
+	}
+	if vals, err := client.GetKVMulti(ctx, "user", []string{"k1", "k2", "k3"}); err != nil || len(vals) != 1 || vals["k2"] != "v2" {
+		t.Errorf("want only k2, got %v %v", vals, err)
+	}
+
+	err := client.SetKVMulti(ctx, "user", map[string]string{"k4": "v4", "k5!": "v5"}, 60)
+	if errs, ok := err.(acclient.KVErrors); !ok || len(errs) != 1 || errs["k5!"] == nil {
+		t.Errorf("want k5! failed, got %v", err)
+	}
+	vals, err := client.GetKVMulti(ctx, "user", []string{"k2", "k4", "k6!"})
+	if errs, ok := err.(acclient.KVErrors); !ok || len(errs) != 1 || errs["k6!"] == nil {
+		t.Errorf("want k6! failed, got %v", err)
+	}
+	if len(vals) != 2 || vals["k2"] != "v2" || vals["k4"] != "v4" {
+		t.Errorf("the other keys should be returned, got %v", vals)
+	}
+}
+
+func TestPublish(t *testing.T) {
+	backend := newTestBackend()
+	client := backend.Client()
+	client.Spend("acc1", "llm", "test", 1000, &header.CreditEntryData{})
+	client.IncCounter("acc1", "20260101", []string{"a=b"}, nil)
+	client.Index("user", "acc1", "us1", "name", "Thanh", 0)
+
+	if spends := backend.Spends(); len(spends) != 1 || spends[0].GetItem() != "llm" {
+		t.Errorf("unexpected spends %v", spends)
+	}
+	if counters := backend.Counters(); len(counters) != 1 || counters[0].GetAccountId() != "acc1" {
+		t.Errorf("unexpected counters %v", counters)
+	}
+	if indexes := backend.Indexes(); len(indexes) != 1 || indexes[0].GetDocumentId() != "us1" {
+		t.Errorf("unexpected indexes %v", indexes)
+	}
+}
+
+func TestLifecycle(t *testing.T) {
+	client := newTestBackend().Client()
+	if err := client.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Ready(); err != nil {
+		t.Errorf("want ready, got %v", err)
+	}
+	if _, err := client.GetAccount(context.Background(), "acc1"); err != nil {
+		t.Fatal(err)
+	}
+
+	client.Close()
+	if err := client.Ready(); err == nil {
+		t.Error("a closed client must not be ready")
+	}
+	if _, _, err := client.GetKV(context.Background(), "user", "k1"); err == nil {
+		t.Error("calls made after Close must fail")
+	}
+	if _, err := client.GetAccount(context.Background(), "acc1"); err == nil {
+		t.Error("calls made after Close must fail, even cached ones")
+	}
+}
+
+func TestOnChange(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestBackend()
+	client := backend.Client()
+	backend.AddGroup(&header.AgentGroup{AccountId: "acc1", Id: "gr1"})
+	if groups, err := client.ListGroups(ctx, "acc1"); err != nil || len(groups) != 1 {
+		t.Fatalf("want 1 group, got %v %v", groups, err)
+	}
+
+	changed := make(chan string, 1)
+	cancel := client.OnChange("agent_group", func(accid string) { changed <- accid })
+	defer cancel()
+	backend.AddGroup(&header.AgentGroup{AccountId: "acc1", Id: "gr2"})
+	select {
+	case accid := <-changed:
+		if groups, err := client.ListGroups(ctx, accid); err != nil || len(groups) != 2 {
+			t.Errorf("want 2 groups after the change, got %v %v", groups, err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Error("OnChange is not called")
+	}
+}
+
+func TestOnChangeLang(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestBackend()
+	client := backend.Client()
+	if _, err := client.GetLocale(ctx, "acc1", "vi-VN"); err != nil {
+		t.Fatal(err)
+	}
+
+	changed := make(chan string, 1)
+	defer client.OnChange("lang", func(accid string) { changed <- accid })()
+	backend.AddLangMessage("acc1", &header.LangMessage{Locale: "vi-VN", Key: "hello"})
+	select {
+	case accid := <-changed:
+		if accid != "acc1" {
+			t.Errorf("want acc1, got %q", accid)
+		}
+	case <-time.After(10 * time.Second):
+		t.Error("OnChange is not called")
+	}
+}
+
+func TestPubsubFlushAfterOutage(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestBackend()
+	client := backend.Client()
+	if groups, err := client.ListGroups(ctx, "acc1"); err != nil || len(groups) != 0 {
+		t.Fatalf("want no group, got %v %v", groups, err)
+	}
+	changed := make(chan string, 10)
+	defer client.OnChange("agent_group", func(accid string) { changed <- accid })()
+
+	backend.SetPubsubError(log.EInternalConnect(nil, log.M{"addr": "pubsub"}))
+	time.Sleep(2 * time.Second)
+	backend.AddGroup(&header.AgentGroup{AccountId: "acc1", Id: "gr1"}) // this event is lost
+	time.Sleep(time.Second)
+	backend.SetPubsubError(nil)
+
+	select {
+	case <-changed:
+		if groups, err := client.ListGroups(ctx, "acc1"); err != nil || len(groups) != 1 {
+			t.Errorf("want 1 group after the outage, got %v %v", groups, err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Error("watched resources are not flushed after the outage")
+	}
+}
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	client := newTestBackend().Client(acclient.WithTracerProvider(tp))
+	if _, err := client.GetAccount(context.Background(), "acc1"); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	api, load := spans["acclient.GetAccount"], spans["acclient.load"]
+	if api == nil || load == nil {
+		t.Fatalf("want api and load spans, got %v", spans)
+	}
+	if load.Parent().SpanID() != api.SpanContext().SpanID() {
+		t.Error("the load span should be a child of the api span")
+	}
+	if attrs := api.Attributes(); len(attrs) != 1 || attrs[0].Value.AsString() != "acc1" {
+		t.Errorf("want account_id attribute, got %v", attrs)
+	}
+}
+
+func TestMissingAccountRecovers(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestBackend()
+	client := backend.Client()
+	if acc, err := client.GetAccount(ctx, "acc2"); err != nil || acc != nil {
+		t.Fatalf("want missing account, got %v %v", acc, err)
+	}
+
+	backend.AddAccount(&pb.Account{Id: s("acc2"), State: s("activated")})
+	for i := 0; i < 100; i++ {
+		if acc, _ := client.GetAccount(ctx, "acc2"); acc != nil {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Error("a created account should be found after its account event")
+}
+
+func TestLease(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestBackend()
+	client1, client2 := backend.Client(), backend.Client()
+
+	lease1, err := client1.AcquireLease(ctx, "cron", "report", time.Second)
+	if err != nil || lease1 == nil {
+		t.Fatalf("want lease, got %v %v", lease1, err)
+	}
+	if lease, err := client2.AcquireLease(ctx, "cron", "report", time.Second); err != nil || lease != nil {
+		t.Fatalf("lease is held, got %v %v", lease, err)
+	}
+	if err := lease1.Renew(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-lease1.Lost():
+	case <-time.After(3 * time.Second):
+		t.Fatal("lease should be lost without renew")
+	}
+	if err := lease1.Renew(ctx); err != acclient.ErrLeaseLost {
+		t.Errorf("want ErrLeaseLost, got %v", err)
+	}
+
+	lease2, err := client2.AcquireLease(ctx, "cron", "report", time.Minute)
+	if err != nil || lease2 == nil || lease2.Token <= lease1.Token {
+		t.Fatalf("want lease with a greater token, got %v %v", lease2, err)
+	}
+	if err := lease2.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if lease, _ := client1.AcquireLease(ctx, "cron", "report", time.Second); lease == nil {
+		t.Error("released lease should be acquired right away")
+	}
+}
+
+// versionlessStore fails the version reads of the KV table
+type versionlessStore struct{ *Backend }
+
+func (me versionlessStore) GetKVVersion(ctx context.Context, k string) (string, int64, bool, error) {
+	return "", 0, false, log.ERetry(nil, log.M{"key": k})
+}
+
+func TestLeaseAcquireFailure(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestBackend()
+	failing := backend.Client(acclient.WithStore(versionlessStore{backend}))
+	if lease, err := failing.AcquireLease(ctx, "cron", "report", time.Minute); err == nil || lease != nil {
+		t.Fatalf("want an error, got %v %v", lease, err)
+	}
+	if lease, err := backend.Client().AcquireLease(ctx, "cron", "report", time.Minute); err != nil || lease == nil {
+		t.Errorf("a failed acquire should not keep the lease, got %v %v", lease, err)
+	}
+}
+
+func TestKVScope(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestBackend()
+	kv := backend.Client().KVScope("user")
+
+	type profile struct {
+		Name string   `json:"name"`
+		Tags []string `json:"tags"`
+	}
+	in := profile{Name: "thanh", Tags: make([]string, 500)}
+	if err := acclient.SetJSON(ctx, kv, "p1", in, 60); err != nil {
+		t.Fatal(err)
+	}
+	if raw, _, _ := kv.Get(ctx, "p1"); !strings.HasPrefix(raw, "~gz:") {
+		t.Errorf("large values should be compressed, got %.20q", raw)
+	}
+	if out, found, err := acclient.GetJSON[profile](ctx, kv, "p1"); err != nil || !found || out.Name != "thanh" || len(out.Tags) != 500 {
+		t.Errorf("want %v, got %v %v %v", in.Name, out.Name, found, err)
+	}
+
+	if err := kv.SetProto(ctx, "acc1", &pb.Account{Id: s("acc1")}, 60); err != nil {
+		t.Fatal(err)
+	}
+	acc := &pb.Account{}
+	if found, err := kv.GetProto(ctx, "acc1", acc); err != nil || !found || acc.GetId() != "acc1" {
+		t.Errorf("want acc1, got %v %v %v", acc, found, err)
+	}
+
+	if err := kv.Set(ctx, "big", strings.Repeat("x", 2<<20), 60); !log.IsErr(err, log.E_payload_too_large.String()) {
+		t.Errorf("want payload too large, got %v", err)
+	}
+}
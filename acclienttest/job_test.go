@@ -0,0 +1,362 @@
+package acclienttest
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/subiz/acclient/v2"
+	"github.com/subiz/header"
+)
+
+func TestRunJob(t *testing.T) {
+	ctx := context.Background()
+	client := newTestBackend().Client()
+
+	jobid, err := client.RunJob(ctx, "acc1", "import", "contact", time.Minute, func(ctx context.Context, job *acclient.JobHandle) ([]byte, error) {
+		if err := job.Progress(50, "half way"); err != nil {
+			return nil, err
+		}
+		status, _ := client.PingJob(ctx, "acc1", job.Id)
+		if status != "50% half way" {
+			t.Errorf("want progress status, got %q", status)
+		}
+		return []byte("ok"), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, _ := client.GetJob(ctx, "acc1", jobid)
+	if job.GetStatus() != acclient.JobStatusDone || string(job.GetOutput()) != "ok" || job.GetEnded() == 0 {
+		t.Errorf("unexpected job %v", job)
+	}
+
+	jobid, err = client.RunJob(ctx, "acc1", "import", "contact", time.Minute, func(ctx context.Context, job *acclient.JobHandle) ([]byte, error) {
+		panic("boom")
+	})
+	if err == nil {
+		t.Fatal("want panic error")
+	}
+	job, _ = client.GetJob(ctx, "acc1", jobid)
+	if job.GetStatus() != acclient.JobStatusFailed || job.GetEnded() == 0 {
+		t.Errorf("unexpected job %v", job)
+	}
+}
+
+func TestRunJobForceEnded(t *testing.T) {
+	ctx := context.Background()
+	client := newTestBackend().Client()
+
+	jobid, err := client.RunJob(ctx, "acc1", "import", "contact", 3*time.Second, func(ctx context.Context, job *acclient.JobHandle) ([]byte, error) {
+		if err := client.ForceEndJob(ctx, "acc1", job.Id); err != nil {
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, context.Cause(ctx)
+		case <-time.After(5 * time.Second):
+			return nil, errors.New("work is not cancelled")
+		}
+	})
+	if !errors.Is(err, acclient.ErrJobEnded) {
+		t.Fatalf("want ErrJobEnded, got %v", err)
+	}
+	job, _ := client.GetJob(ctx, "acc1", jobid)
+	if job.GetForceEnded() == 0 || job.GetStatus() == acclient.JobStatusFailed {
+		t.Errorf("force ended job should be left untouched, got %v", job)
+	}
+}
+
+func TestListJobs(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestBackend()
+	now := time.Now().UnixMilli()
+	backend.AddJob(&header.Job{AccountId: "acc1", Id: "j1", Category: "import", Created: now - 3000, TimeoutSec: 60})
+	backend.AddJob(&header.Job{AccountId: "acc1", Id: "j2", Category: "export", Created: now - 2000, TimeoutSec: 60, Ended: now, Status: "failed"})
+	backend.AddJob(&header.Job{AccountId: "acc1", Id: "j3", Category: "import", Created: now - 2000, TimeoutSec: 1})
+	backend.AddJob(&header.Job{AccountId: "acc1", Id: "j4", Category: "import", Created: now - 1000, TimeoutSec: 60, Ended: now, ForceEnded: now})
+	backend.AddJob(&header.Job{AccountId: "acc2", Id: "j5", Category: "import", Created: now - 1000, TimeoutSec: 60})
+	client := backend.Client()
+
+	list := func(filter *acclient.JobFilter) string {
+		jobs, anchor, err := client.ListJobs(ctx, "acc1", filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := []string{}
+		for _, job := range jobs {
+			ids = append(ids, job.GetId())
+		}
+		return strings.Join(ids, ",") + "|" + anchor
+	}
+
+	if got := list(nil); got != "j4,j3,j2,j1|" {
+		t.Errorf("list all, got %s", got)
+	}
+	if got := list(&acclient.JobFilter{Category: "import", State: acclient.JobStateRunning}); got != "j1|" {
+		t.Errorf("running imports, got %s", got)
+	}
+	if got := list(&acclient.JobFilter{State: acclient.JobStateTimedOut}); got != "j3|" {
+		t.Errorf("timed out, got %s", got)
+	}
+	if got := list(&acclient.JobFilter{Status: "failed"}); got != "j2|" {
+		t.Errorf("failed, got %s", got)
+	}
+	if got := list(&acclient.JobFilter{CreatedFrom: now - 2000, CreatedTo: now - 1000}); got != "j3,j2|" {
+		t.Errorf("created range, got %s", got)
+	}
+
+	jobs, anchor, err := client.ListJobs(ctx, "acc1", &acclient.JobFilter{Limit: 2})
+	if err != nil || len(jobs) != 2 || anchor == "" {
+		t.Fatalf("first page %v %q %v", jobs, anchor, err)
+	}
+	if got := list(&acclient.JobFilter{Limit: 2, Anchor: anchor}); got != "j2,j1|" {
+		t.Errorf("second page, got %s", got)
+	}
+}
+
+func TestJobProgressLogsAndLargeOutput(t *testing.T) {
+	ctx := context.Background()
+	client := newTestBackend().Client(acclient.WithJobOutputLimit(8))
+
+	output := []byte("a large export")
+	jobid, err := client.RunJob(ctx, "acc1", "export", "contact", time.Minute, func(ctx context.Context, job *acclient.JobHandle) ([]byte, error) {
+		if err := job.SetProgress(3, 10); err != nil {
+			return nil, err
+		}
+		job.Log("info", "started")
+		job.Log("warn", "skipped a row")
+		return output, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := client.GetJobInfo(ctx, "acc1", jobid)
+	if err != nil || info.ProgressDone != 3 || info.ProgressTotal != 10 {
+		t.Fatalf("unexpected progress %v, err %v", info, err)
+	}
+	if info.OutputUrl == "" || len(info.Output) != 0 {
+		t.Errorf("output should be stored as a file, got %q %q", info.OutputUrl, info.Output)
+	}
+	job, err := client.GetJob(ctx, "acc1", jobid)
+	if err != nil || string(job.GetOutput()) != string(output) {
+		t.Errorf("want output downloaded, got %q, err %v", job.GetOutput(), err)
+	}
+
+	logs, err := client.ListJobLogs(ctx, "acc1", jobid)
+	if err != nil || len(logs) != 2 || logs[0].Message != "started" || logs[1].Level != "warn" {
+		t.Errorf("unexpected logs %v, err %v", logs, err)
+	}
+}
+
+func TestWaitJob(t *testing.T) {
+	ctx := context.Background()
+	client := newTestBackend().Client()
+
+	jobid, err := client.StartJob(ctx, "acc1", "import", "", "contact", 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		client.EndJob(ctx, "acc1", jobid, "done", []byte("ok"))
+	}()
+	waitctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	job, err := client.WaitJob(waitctx, "acc1", jobid)
+	if err != nil || job.GetStatus() != "done" || string(job.GetOutput()) != "ok" {
+		t.Errorf("unexpected job %v, err %v", job, err)
+	}
+
+	// time outs fire no event
+	jobid, _ = client.StartJob(ctx, "acc1", "import", "", "contact", 1)
+	ended := make(chan *header.Job, 1)
+	if _, err := client.OnJobEnded(ctx, "acc1", jobid, func(job *header.Job) { ended <- job }); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case job := <-ended:
+		if job.GetForceEnded() == 0 {
+			t.Errorf("want timed out job, got %v", job)
+		}
+	case <-time.After(10 * time.Second):
+		t.Error("OnJobEnded is not called on time out")
+	}
+}
+
+// expiringStore drops the jobs named "expired" like Cassandra drops the
+// index entries of expired job rows
+type expiringStore struct{ *Backend }
+
+func (me expiringStore) ListJobs(ctx context.Context, accid string, from, to int64, beforeid string, limit int) ([]*header.Job, *header.Job, error) {
+	jobs, last, err := me.Backend.ListJobs(ctx, accid, from, to, beforeid, limit)
+	live := []*header.Job{}
+	for _, job := range jobs {
+		if job.GetName() != "expired" {
+			live = append(live, job)
+		}
+	}
+	return live, last, err
+}
+
+func TestListJobsSkipsExpired(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestBackend()
+	now := time.Now().UnixMilli()
+	for i := 0; i < 250; i++ {
+		name := "live"
+		if i < 245 { // the newest jobs, more than a store batch
+			name = "expired"
+		}
+		backend.AddJob(&header.Job{AccountId: "acc1", Id: "j" + strconv.Itoa(1000+i), Name: name, Created: now - int64(i), TimeoutSec: 60})
+	}
+	client := backend.Client(acclient.WithStore(expiringStore{backend}))
+
+	jobs, anchor, err := client.ListJobs(ctx, "acc1", &acclient.JobFilter{Limit: 3})
+	if err != nil || len(jobs) != 3 || anchor == "" {
+		t.Fatalf("want 3 jobs and an anchor, got %d %q %v", len(jobs), anchor, err)
+	}
+	jobs, anchor, err = client.ListJobs(ctx, "acc1", &acclient.JobFilter{Limit: 3, Anchor: anchor})
+	if err != nil || len(jobs) != 2 || anchor != "" {
+		t.Errorf("want the 2 last jobs, got %d %q %v", len(jobs), anchor, err)
+	}
+}
+
+func TestJobQueue(t *testing.T) {
+	ctx := context.Background()
+	client := newTestBackend().Client(acclient.WithJobMaxAttempts(2))
+
+	id1, err := client.EnqueueJob(ctx, "acc1", "export", []byte("p1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	id2, _ := client.EnqueueJob(ctx, "acc1", "export", []byte("p2"))
+
+	job, err := client.ClaimJob(ctx, "export", "w1", 1)
+	if err != nil || job.GetId() != id1 || string(job.Payload) != "p1" || job.Attempts != 1 {
+		t.Fatalf("w1 should claim the oldest job, got %v, err %v", job, err)
+	}
+	if job, _ = client.ClaimJob(ctx, "export", "w2", 1); job.GetId() != id2 {
+		t.Fatalf("w2 should claim the second job, got %v", job)
+	}
+	if job, _ = client.ClaimJob(ctx, "export", "w3", 1); job != nil {
+		t.Fatalf("every job is leased, got %v", job)
+	}
+
+	// w1 dies, w2 keeps renewing
+	time.Sleep(600 * time.Millisecond)
+	if _, err := client.RenewJobLease(ctx, "acc1", id2, "w2"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(600 * time.Millisecond)
+	job, _ = client.ClaimJob(ctx, "export", "w3", 1)
+	if job.GetId() != id1 || job.Attempts != 2 {
+		t.Fatalf("w3 should claim the expired lease, got %v", job)
+	}
+	if _, err := client.RenewJobLease(ctx, "acc1", id1, "w1"); !errors.Is(err, acclient.ErrJobLeaseLost) {
+		t.Errorf("want ErrJobLeaseLost, got %v", err)
+	}
+	if err := client.EndClaimedJob(ctx, "acc1", id1, "w1", "done", nil); !errors.Is(err, acclient.ErrJobLeaseLost) {
+		t.Errorf("want ErrJobLeaseLost, got %v", err)
+	}
+	if err := client.ReleaseJob(ctx, "acc1", id1, "w1"); !errors.Is(err, acclient.ErrJobLeaseLost) {
+		t.Errorf("want ErrJobLeaseLost, got %v", err)
+	}
+
+	// w3 shuts down, the release does not count as an attempt
+	if err := client.ReleaseJob(ctx, "acc1", id1, "w3"); err != nil {
+		t.Fatal(err)
+	}
+	if job, _ = client.ClaimJob(ctx, "export", "w4", 1); job.GetId() != id1 || job.Attempts != 2 {
+		t.Fatalf("w4 should claim the released job, got %v", job)
+	}
+
+	// w4 dies, the job has no attempt left
+	time.Sleep(1100 * time.Millisecond)
+	client.RenewJobLease(ctx, "acc1", id2, "w2")
+	if job, _ = client.ClaimJob(ctx, "export", "w5", 1); job != nil {
+		t.Fatalf("no job should be claimable, got %v", job)
+	}
+	if job, _ := client.GetJob(ctx, "acc1", id1); job.GetStatus() != acclient.JobStatusDead {
+		t.Errorf("want dead job, got %v", job)
+	}
+
+	if err := client.EndClaimedJob(ctx, "acc1", id2, "w2", "done", nil); err != nil {
+		t.Fatal(err)
+	}
+	if job, _ = client.ClaimJob(ctx, "export", "w5", 1); job != nil {
+		t.Errorf("queue should be empty, got %v", job)
+	}
+}
+
+// jobReadStore counts the job reads and fails those of the job broken
+type jobReadStore struct {
+	*Backend
+	reads  *atomic.Int64
+	broken string
+}
+
+func (me jobReadStore) GetJob(ctx context.Context, accid, jobid string) (*acclient.JobInfo, error) {
+	me.reads.Add(1)
+	if jobid == me.broken {
+		return nil, errors.New("broken row")
+	}
+	return me.Backend.GetJob(ctx, accid, jobid)
+}
+
+func TestJobQueueManyLeased(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestBackend()
+	store := jobReadStore{Backend: backend, reads: &atomic.Int64{}}
+	client := backend.Client(acclient.WithStore(store))
+	n := 105 // more than a queue page
+	for i := 0; i < n; i++ {
+		if _, err := client.EnqueueJob(ctx, "acc1", "export", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < n; i++ {
+		if job, err := client.ClaimJob(ctx, "export", "w"+strconv.Itoa(i), 60); err != nil || job == nil {
+			t.Fatalf("claim %d: want a job, got %v %v", i, job, err)
+		}
+	}
+	store.reads.Store(0)
+	if job, _ := client.ClaimJob(ctx, "export", "w", 60); job != nil {
+		t.Errorf("every job is leased, got %v", job)
+	}
+	if n := store.reads.Load(); n != 0 {
+		t.Errorf("leased jobs should be skipped from the queue, got %d job reads", n)
+	}
+}
+
+func TestJobQueueSkipsBrokenJob(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestBackend()
+	client := backend.Client()
+	id1, _ := client.EnqueueJob(ctx, "acc1", "export", nil)
+	time.Sleep(2 * time.Millisecond)
+	id2, _ := client.EnqueueJob(ctx, "acc1", "export", nil)
+
+	store := jobReadStore{Backend: backend, reads: &atomic.Int64{}, broken: id1}
+	client = backend.Client(acclient.WithStore(store), acclient.WithRetryPolicy(acclient.RetryPolicy{MaxAttempts: 1}))
+	if job, err := client.ClaimJob(ctx, "export", "w1", 60); err != nil || job.GetId() != id2 {
+		t.Fatalf("want the job after the broken one, got %v %v", job, err)
+	}
+
+	// a job ended by someone else is lost to its worker
+	if err := client.EndJob(ctx, "acc1", id2, "canceled", nil); err != nil {
+		t.Fatal(err)
+	}
+	if status, err := client.RenewJobLease(ctx, "acc1", id2, "w1"); err != nil || status != "ended" {
+		t.Errorf("want ended, got %q %v", status, err)
+	}
+	if err := client.EndClaimedJob(ctx, "acc1", id2, "w1", "done", nil); !errors.Is(err, acclient.ErrJobLeaseLost) {
+		t.Errorf("want a lost lease, got %v", err)
+	}
+}
@@ -0,0 +1,229 @@
+package acclienttest
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/subiz/header"
+	pb "github.com/subiz/header/account"
+	pm "github.com/subiz/header/payment"
+	"github.com/subiz/log"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+)
+
+// The fake services below embed the generated client interfaces, calling a
+// method acclient does not use panics with a nil pointer dereference.
+
+type accountMgr struct {
+	header.AccountMgrClient
+	backend *Backend
+}
+
+func (me *accountMgr) GetAccount(ctx context.Context, in *header.Id, opts ...grpc.CallOption) (*pb.Account, error) {
+	me.backend.lock.Lock()
+	defer me.backend.lock.Unlock()
+	acc := me.backend.accounts[in.GetId()]
+	if acc == nil {
+		return nil, log.EMissing(in.GetId(), "account")
+	}
+	return proto.Clone(acc).(*pb.Account), nil
+}
+
+func (me *accountMgr) ListAgentProfileAccounts(ctx context.Context, in *header.Id, opts ...grpc.CallOption) (*header.Response, error) {
+	me.backend.lock.Lock()
+	defer me.backend.lock.Unlock()
+	res := &header.Response{}
+	for accid, agents := range me.backend.agents {
+		if agents[in.GetId()] == nil || me.backend.accounts[accid] == nil {
+			continue
+		}
+		res.Accounts = append(res.Accounts, proto.Clone(me.backend.accounts[accid]).(*pb.Account))
+	}
+	return res, nil
+}
+
+func (me *accountMgr) ListAgents(ctx context.Context, in *header.Id, opts ...grpc.CallOption) (*header.Response, error) {
+	me.backend.lock.Lock()
+	defer me.backend.lock.Unlock()
+	return &header.Response{Agents: cloneAll(me.backend.agents[in.GetAccountId()])}, nil
+}
+
+func (me *accountMgr) ListAgentOnlines(ctx context.Context, in *header.ListAgentOnlineRequest, opts ...grpc.CallOption) (*pb.Presences, error) {
+	return &pb.Presences{AccountId: &in.AccountId}, nil
+}
+
+func (me *accountMgr) ListActiveAccountIds(ctx context.Context, in *header.Id, opts ...grpc.CallOption) (*header.Response, error) {
+	me.backend.lock.Lock()
+	defer me.backend.lock.Unlock()
+	res := &header.Response{}
+	for accid, acc := range me.backend.accounts {
+		if acc.GetState() == pb.Account_activated.String() {
+			res.Ids = append(res.Ids, accid)
+		}
+	}
+	return res, nil
+}
+
+func (me *accountMgr) NewID(ctx context.Context, in *header.Id, opts ...grpc.CallOption) (*header.Id, error) {
+	return &header.Id{AccountId: in.GetAccountId(), Id: itoa(me.backend.nextID(in.GetAccountId(), in.GetId()))}, nil
+}
+
+type paymentMgr struct {
+	header.PaymentMgrClient
+	backend *Backend
+}
+
+func (me *paymentMgr) GetSubscription(ctx context.Context, in *header.Id, opts ...grpc.CallOption) (*pm.Subscription, error) {
+	me.backend.lock.Lock()
+	defer me.backend.lock.Unlock()
+	sub := me.backend.subs[in.GetId()]
+	if sub == nil {
+		return nil, log.EMissing(in.GetId(), "subscription")
+	}
+	return proto.Clone(sub).(*pm.Subscription), nil
+}
+
+type creditMgr struct {
+	header.CreditMgrClient
+	backend *Backend
+}
+
+func (me *creditMgr) TrySpendCredit(ctx context.Context, in *header.CreditSpendEntry, opts ...grpc.CallOption) (*header.TrySpendCreditResponse, error) {
+	me.backend.lock.Lock()
+	defer me.backend.lock.Unlock()
+	me.backend.spendAttempts = append(me.backend.spendAttempts, proto.Clone(in).(*header.CreditSpendEntry))
+	if err := me.backend.creditErrs[in.GetAccountId()]; err != nil {
+		return nil, err
+	}
+	return &header.TrySpendCreditResponse{}, nil
+}
+
+// GetTotalCreditSpend sums the spends published by the clients, filters and
+// currency are ignored
+func (me *creditMgr) GetTotalCreditSpend(ctx context.Context, in *header.CreditSpendReportRequest, opts ...grpc.CallOption) (*header.Response, error) {
+	var total int64
+	for _, entry := range me.backend.Spends() {
+		if entry.GetAccountId() == in.GetAccountId() {
+			total += entry.GetFpvUnitPriceVnd() * int64(entry.GetQuantity())
+		}
+	}
+	return &header.Response{CreditUsage: &header.CreditUsage{FpvTotalSpent: total}}, nil
+}
+
+type fabikon struct {
+	header.FabikonServiceClient
+}
+
+func (me *fabikon) ListFbFanpageSettings2(ctx context.Context, in *header.ListPageSettingRequest, opts ...grpc.CallOption) (*header.Response, error) {
+	return &header.Response{}, nil
+}
+
+type numberRegistry struct {
+	header.NumberRegistryClient
+	backend *Backend
+}
+
+func (me *numberRegistry) Compact(ctx context.Context, in *header.String, opts ...grpc.CallOption) (*header.Number, error) {
+	me.backend.lock.Lock()
+	defer me.backend.lock.Unlock()
+	num := me.backend.compacts[in.GetStr()]
+	if num == 0 {
+		num = len(me.backend.compacts) + 1
+		me.backend.compacts[in.GetStr()] = num
+		me.backend.uncompacts[num] = in.GetStr()
+	}
+	return &header.Number{Number: int64(num)}, nil
+}
+
+func (me *numberRegistry) Uncompact(ctx context.Context, in *header.Number, opts ...grpc.CallOption) (*header.String, error) {
+	me.backend.lock.Lock()
+	defer me.backend.lock.Unlock()
+	return &header.String{Str: me.backend.uncompacts[int(in.GetNumber())]}, nil
+}
+
+func (me *numberRegistry) LookupLink(ctx context.Context, in *header.String, opts ...grpc.CallOption) (*header.Link, error) {
+	me.backend.lock.Lock()
+	defer me.backend.lock.Unlock()
+	link := me.backend.links[in.GetStr()]
+	if link == nil {
+		return nil, log.EMissing(in.GetStr(), "link")
+	}
+	return proto.Clone(link).(*header.Link), nil
+}
+
+func (me *numberRegistry) NewID2(ctx context.Context, in *header.Id, opts ...grpc.CallOption) (*header.Id, error) {
+	return &header.Id{AccountId: in.GetAccountId(), Id: itoa(me.backend.nextID(in.GetAccountId(), in.GetId()))}, nil
+}
+
+func (me *numberRegistry) GetLastID(ctx context.Context, in *header.Id, opts ...grpc.CallOption) (*header.Id, error) {
+	return &header.Id{AccountId: in.GetAccountId(), Id: itoa(me.backend.lastID(in.GetAccountId(), in.GetId()))}, nil
+}
+
+type pubsub struct {
+	header.PubsubClient
+	backend *Backend
+}
+
+func (me *pubsub) Fire(ctx context.Context, in *header.PsMessage, opts ...grpc.CallOption) (*header.Empty, error) {
+	me.backend.lock.Lock()
+	defer me.backend.lock.Unlock()
+	for _, topic := range in.GetTopics() {
+		typ, accid, _ := strings.Cut(topic, ".")
+		event := proto.Clone(in.GetEvent()).(*header.Event)
+		if event == nil {
+			event = &header.Event{Created: time.Now().UnixMilli()}
+		}
+		event.Type, event.AccountId = typ, accid
+		me.backend.events = append(me.backend.events, event)
+	}
+	return &header.Empty{}, nil
+}
+
+// Poll returns the events fired since the last poll of the connection which
+// match the requested topics, it never blocks
+func (me *pubsub) Poll(ctx context.Context, in *header.RealtimeSubscription, opts ...grpc.CallOption) (*header.PollResult, error) {
+	me.backend.lock.Lock()
+	defer me.backend.lock.Unlock()
+	if err := me.backend.pubsubErr; err != nil {
+		me.backend.cursors[in.GetConnectionId()] = len(me.backend.events)
+		return nil, err
+	}
+	topics := map[string]bool{}
+	for _, topic := range in.GetEvents() {
+		topics[topic] = true
+	}
+
+	res := &header.PollResult{}
+	for _, event := range me.backend.events[me.backend.cursors[in.GetConnectionId()]:] {
+		if topics[event.GetType()+"."+event.GetAccountId()] {
+			res.Events = append(res.Events, proto.Clone(event).(*header.Event))
+		}
+	}
+	me.backend.cursors[in.GetConnectionId()] = len(me.backend.events)
+	return res, nil
+}
+
+type convo struct {
+	header.ConversationMgrClient
+	backend *Backend
+}
+
+func (me *convo) UpsertIntegration(ctx context.Context, in *header.Integration, opts ...grpc.CallOption) (*header.Integration, error) {
+	me.backend.lock.Lock()
+	defer me.backend.lock.Unlock()
+	me.backend.integrations[in.GetAccountId()+"/"+in.GetId()] = proto.Clone(in).(*header.Integration)
+	return in, nil
+}
+
+func (me *convo) ActivateIntegration(ctx context.Context, in *header.Id, opts ...grpc.CallOption) (*header.Integration, error) {
+	me.backend.lock.Lock()
+	defer me.backend.lock.Unlock()
+	inte := me.backend.integrations[in.GetAccountId()+"/"+in.GetId()]
+	if inte == nil {
+		return nil, log.EMissing(in.GetId(), "integration")
+	}
+	inte.State = "activated"
+	return proto.Clone(inte).(*header.Integration), nil
+}
@@ -0,0 +1,542 @@
+package acclienttest
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/subiz/acclient/v2"
+	"github.com/subiz/header"
+	"github.com/subiz/log"
+	"google.golang.org/protobuf/proto"
+)
+
+var _ acclient.Store = &Backend{}
+var _ acclient.FileStore = &Backend{}
+
+func (me *Backend) GetShopSetting(ctx context.Context, accid string) (*header.ShopSetting, error) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	if setting := me.shopSettings[accid]; setting != nil {
+		return proto.Clone(setting).(*header.ShopSetting), nil
+	}
+	return &header.ShopSetting{AccountId: accid}, nil
+}
+
+func (me *Backend) ListLangMessages(ctx context.Context, accid, locale string) ([]*header.LangMessage, error) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	return cloneAll(me.langs[accid+"_"+locale]), nil
+}
+
+func (me *Backend) ListAttrDefs(ctx context.Context, accid string) ([]*header.AttributeDefinition, error) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	return cloneAll(me.defs[accid]), nil
+}
+
+func (me *Backend) GetNotiSetting(ctx context.Context, accid, agid string) (*header.NotiSetting, error) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	if setting := me.notiSettings[accid+"_"+agid]; setting != nil {
+		return proto.Clone(setting).(*header.NotiSetting), nil
+	}
+	return nil, nil
+}
+
+func (me *Backend) ListBots(ctx context.Context, accid string) ([]*header.Bot, error) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	return cloneAll(me.bots[accid]), nil
+}
+
+func (me *Backend) ListAIAgents(ctx context.Context, accid string) ([]*header.AIAgent, error) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	return cloneAll(me.aiagents[accid]), nil
+}
+
+func (me *Backend) ListAgentGroups(ctx context.Context, accid string) ([]*header.AgentGroup, error) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	return cloneAll(me.groups[accid]), nil
+}
+
+func (me *Backend) ListPipelines(ctx context.Context, accid string) ([]*header.Pipeline, error) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	return cloneAll(me.pipelines[accid]), nil
+}
+
+func (me *Backend) ListBlacklistIPs(ctx context.Context, accid string) ([]*header.BlacklistIP, error) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	return cloneAll(me.blacklistIPs[accid]), nil
+}
+
+func (me *Backend) DeleteBlacklistIP(ctx context.Context, accid, ip string) error {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	delete(me.blacklistIPs[accid], ip)
+	return nil
+}
+
+func (me *Backend) ListBannedUsers(ctx context.Context, accid string) ([]*header.BannedUser, error) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	return cloneAll(me.bannedUsers[accid]), nil
+}
+
+func (me *Backend) GetIntegration(ctx context.Context, accid, inteid string) (*header.Integration, error) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	if inte := me.integrations[accid+"/"+inteid]; inte != nil {
+		return proto.Clone(inte).(*header.Integration), nil
+	}
+	return nil, nil
+}
+
+func (me *Backend) InsertSignedKey(ctx context.Context, accid, issuer, typ, keytype, key string, objects []string, created int64) error {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	me.signedKeys[key] = &signedKey{accid: accid, issuer: issuer, typ: typ, keytype: keytype, objects: objects}
+	return nil
+}
+
+func (me *Backend) LookupSignedKey(ctx context.Context, key string) (string, string, string, string, []string, error) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	sk := me.signedKeys[key]
+	if sk == nil {
+		return "", "", "", "", nil, nil
+	}
+	return sk.accid, sk.issuer, sk.typ, sk.keytype, sk.objects, nil
+}
+
+func (me *Backend) LookupCompactString(ctx context.Context, str string) (int, error) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	return me.compacts[str], nil
+}
+
+func (me *Backend) LookupCompactNumber(ctx context.Context, num int) (string, error) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	return me.uncompacts[num], nil
+}
+
+func (me *Backend) GetJob(ctx context.Context, accid, jobid string) (*acclient.JobInfo, error) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	if job := me.jobs[accid+"/"+jobid]; job != nil {
+		return cloneJob(job), nil
+	}
+	return nil, nil
+}
+
+func (me *Backend) InsertJob(ctx context.Context, job *header.Job) error {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	me.upsertJob(job.GetAccountId(), job.GetId(), func(j *acclient.JobInfo) {
+		j.Name = job.GetName()
+		j.Description = job.GetDescription()
+		j.Category = job.GetCategory()
+		j.TimeoutSec = job.GetTimeoutSec()
+		j.Created = job.GetCreated()
+	})
+	return nil
+}
+
+func (me *Backend) UpdateJobStatus(ctx context.Context, accid, jobid, status string, updated int64) error {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	me.upsertJob(accid, jobid, func(j *acclient.JobInfo) {
+		j.Status = status
+		j.StatusUpdated = updated
+	})
+	return nil
+}
+
+func (me *Backend) ForceEndJob(ctx context.Context, accid, jobid string, ended int64) error {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	me.upsertJob(accid, jobid, func(j *acclient.JobInfo) {
+		j.ForceEnded = ended
+		j.Ended = ended
+	})
+	return nil
+}
+
+func (me *Backend) EndJob(ctx context.Context, accid, jobid, status string, ended int64, output []byte, outputurl string) error {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	me.upsertJob(accid, jobid, func(j *acclient.JobInfo) {
+		j.Status = status
+		j.Ended = ended
+		j.Output = output
+		j.OutputUrl = outputurl
+		j.LastPingMs = ended
+	})
+	return nil
+}
+
+func (me *Backend) PingJob(ctx context.Context, accid, jobid string, ping int64) error {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	me.upsertJob(accid, jobid, func(j *acclient.JobInfo) { j.LastPingMs = ping })
+	return nil
+}
+
+func (me *Backend) UpdateJobProgress(ctx context.Context, accid, jobid string, done, total, updated int64) error {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	me.upsertJob(accid, jobid, func(j *acclient.JobInfo) {
+		j.ProgressDone = done
+		j.ProgressTotal = total
+		j.StatusUpdated = updated
+	})
+	return nil
+}
+
+func (me *Backend) AppendJobLog(ctx context.Context, accid, jobid string, entry *acclient.JobLog) error {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	e := *entry
+	me.jobLogs[accid+"/"+jobid] = append(me.jobLogs[accid+"/"+jobid], &e)
+	return nil
+}
+
+func (me *Backend) ListJobLogs(ctx context.Context, accid, jobid string, limit int) ([]*acclient.JobLog, error) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	entries := []*acclient.JobLog{}
+	for _, entry := range me.jobLogs[accid+"/"+jobid] {
+		e := *entry
+		entries = append(entries, &e)
+	}
+	// Cassandra orders the entries by created
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Created < entries[j].Created })
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries, nil
+}
+
+func (me *Backend) EnqueueJob(ctx context.Context, job *acclient.JobInfo) error {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	if me.jobs[job.GetAccountId()+"/"+job.GetId()] == nil {
+		me.upsertJob(job.GetAccountId(), job.GetId(), func(j *acclient.JobInfo) {
+			*j = *cloneJob(job)
+			j.Queued, j.Worker, j.LastPingMs, j.Attempts = true, "", 0, 0
+		})
+	}
+	if me.queues[job.GetCategory()] == nil {
+		me.queues[job.GetCategory()] = map[string]*acclient.JobInfo{}
+	}
+	me.queues[job.GetCategory()][job.GetAccountId()+"/"+job.GetId()] = &acclient.JobInfo{Job: &header.Job{AccountId: job.GetAccountId(), Id: job.GetId(), Category: job.GetCategory(), Created: job.GetCreated()}}
+	return nil
+}
+
+func (me *Backend) ListQueuedJobs(ctx context.Context, category string, day int64, after *header.Job, limit int) ([]*acclient.JobInfo, error) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	entries := []*acclient.JobInfo{}
+	for _, entry := range me.queues[category] {
+		if entry.GetCreated()/86400000 == day && (after == nil || queueEntryLess(after, entry.Job)) {
+			entries = append(entries, cloneJob(entry))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return queueEntryLess(entries[i].Job, entries[j].Job) })
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries, nil
+}
+
+func (me *Backend) SetQueuedJobLease(ctx context.Context, entry *header.Job, worker string, ping, leasesec int64) error {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	queue := me.queues[entry.GetCategory()]
+	if queue == nil {
+		queue = map[string]*acclient.JobInfo{}
+		me.queues[entry.GetCategory()] = queue
+	}
+	// an UPDATE creates the entry if missing, like Cassandra
+	queue[entry.GetAccountId()+"/"+entry.GetId()] = &acclient.JobInfo{
+		Job:      &header.Job{AccountId: entry.GetAccountId(), Id: entry.GetId(), Category: entry.GetCategory(), Created: entry.GetCreated(), LastPingMs: ping},
+		Worker:   worker,
+		LeaseSec: leasesec,
+	}
+	return nil
+}
+
+// queueEntryLess orders queue entries like their Cassandra clustering key
+func queueEntryLess(a, b *header.Job) bool {
+	if a.GetCreated() != b.GetCreated() {
+		return a.GetCreated() < b.GetCreated()
+	}
+	if a.GetAccountId() != b.GetAccountId() {
+		return a.GetAccountId() < b.GetAccountId()
+	}
+	return a.GetId() < b.GetId()
+}
+
+func (me *Backend) DequeueJob(ctx context.Context, entry *header.Job) error {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	delete(me.queues[entry.GetCategory()], entry.GetAccountId()+"/"+entry.GetId())
+	return nil
+}
+
+func (me *Backend) SetJobWorker(ctx context.Context, accid, jobid, oldworker string, oldping int64, worker string, ping, leasesec int64, attempts int) (bool, error) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	job := me.jobs[accid+"/"+jobid]
+	if job == nil || job.Worker != oldworker || job.GetLastPingMs() != oldping {
+		return false, nil
+	}
+	job.Worker, job.LastPingMs, job.LeaseSec, job.Attempts = worker, ping, leasesec, attempts
+	return true, nil
+}
+
+func (me *Backend) RenewJobLease(ctx context.Context, accid, jobid, worker string, ping int64) (bool, error) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	job := me.jobs[accid+"/"+jobid]
+	if job == nil || job.Worker != worker {
+		return false, nil
+	}
+	job.LastPingMs = ping
+	return true, nil
+}
+
+func (me *Backend) ReleaseJobLease(ctx context.Context, accid, jobid, worker string, attempts int) (bool, error) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	job := me.jobs[accid+"/"+jobid]
+	if job == nil || job.Worker != worker {
+		return false, nil
+	}
+	job.Worker, job.LastPingMs, job.LeaseSec, job.Attempts = "", 0, 0, attempts
+	return true, nil
+}
+
+func (me *Backend) EndLeasedJob(ctx context.Context, accid, jobid, worker, status string, ended int64, output []byte, outputurl string) (bool, error) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	job := me.jobs[accid+"/"+jobid]
+	if job == nil || job.Worker != worker {
+		return false, nil
+	}
+	job.Status, job.Ended, job.Output, job.OutputUrl, job.LastPingMs, job.Worker = status, ended, output, outputurl, ended, ""
+	return true, nil
+}
+
+func (me *Backend) ForceEndQueuedJob(ctx context.Context, accid, jobid, worker string, ended int64) (bool, error) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	job := me.jobs[accid+"/"+jobid]
+	if job == nil || job.Worker != worker {
+		return false, nil
+	}
+	job.ForceEnded, job.Ended, job.Worker = ended, ended, ""
+	return true, nil
+}
+
+func (me *Backend) UpdateQueuedJobStatus(ctx context.Context, accid, jobid, worker, status string, updated int64) (bool, error) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	job := me.jobs[accid+"/"+jobid]
+	if job == nil || job.Worker != worker {
+		return false, nil
+	}
+	job.Status, job.StatusUpdated = status, updated
+	return true, nil
+}
+
+func (me *Backend) UpdateQueuedJobProgress(ctx context.Context, accid, jobid, worker string, done, total, updated int64) (bool, error) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	job := me.jobs[accid+"/"+jobid]
+	if job == nil || job.Worker != worker {
+		return false, nil
+	}
+	job.ProgressDone, job.ProgressTotal, job.StatusUpdated = done, total, updated
+	return true, nil
+}
+
+func (me *Backend) ListJobs(ctx context.Context, accid string, from, to int64, beforeid string, limit int) ([]*header.Job, *header.Job, error) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	jobs := []*header.Job{}
+	for _, job := range me.jobs {
+		created := job.GetCreated()
+		if job.GetAccountId() != accid || created < from || created > to || (beforeid != "" && created == to && job.GetId() >= beforeid) {
+			continue
+		}
+		jobs = append(jobs, proto.Clone(job.Job).(*header.Job))
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		if jobs[i].GetCreated() != jobs[j].GetCreated() {
+			return jobs[i].GetCreated() > jobs[j].GetCreated()
+		}
+		return jobs[i].GetId() > jobs[j].GetId()
+	})
+	var last *header.Job
+	if len(jobs) >= limit {
+		jobs = jobs[:limit]
+		last = &header.Job{AccountId: accid, Id: jobs[limit-1].GetId(), Created: jobs[limit-1].GetCreated()}
+	}
+	return jobs, last, nil
+}
+
+func cloneJob(job *acclient.JobInfo) *acclient.JobInfo {
+	clone := *job
+	clone.Job = proto.Clone(job.Job).(*header.Job)
+	return &clone
+}
+
+// upsertJob mimics a Cassandra INSERT, which creates the row if missing,
+// caller must hold the lock
+func (me *Backend) upsertJob(accid, jobid string, f func(*acclient.JobInfo)) {
+	job := me.jobs[accid+"/"+jobid]
+	if job == nil {
+		job = &acclient.JobInfo{Job: &header.Job{AccountId: accid, Id: jobid}}
+		me.jobs[accid+"/"+jobid] = job
+	}
+	f(job)
+}
+
+func (me *Backend) Upload(ctx context.Context, accid, name string, data []byte, ttlsec int64) (*header.File, error) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	url := "mem://files/" + accid + "/" + itoa(int64(len(me.files))) + "/" + name
+	me.files[url] = append([]byte{}, data...)
+	return &header.File{AccountId: accid, Name: name, Url: url, Size: int64(len(data))}, nil
+}
+
+func (me *Backend) Download(ctx context.Context, url string) ([]byte, error) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	data, ok := me.files[url]
+	if !ok {
+		return nil, log.EMissing(url, "file")
+	}
+	return append([]byte{}, data...), nil
+}
+
+func (me *Backend) GetKV(ctx context.Context, k string) (string, bool, error) {
+	v, _, found, err := me.GetKVVersion(ctx, k)
+	return v, found, err
+}
+
+func (me *Backend) GetKVVersion(ctx context.Context, k string) (string, int64, bool, error) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	entry := me.liveKV(k)
+	if entry == nil {
+		return "", 0, false, nil
+	}
+	return entry.value, entry.version, true, nil
+}
+
+func (me *Backend) SetKV(ctx context.Context, k, v string, ttlsec int) error {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	me.kv[k] = me.newKVEntry(v, ttlsec)
+	return nil
+}
+
+func (me *Backend) InsertKVIfNotExists(ctx context.Context, k, v string, ttlsec int) (bool, error) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	if me.liveKV(k) != nil {
+		return false, nil
+	}
+	me.kv[k] = me.newKVEntry(v, ttlsec)
+	return true, nil
+}
+
+func (me *Backend) CompareAndSwapKV(ctx context.Context, k, oldv, newv string, ttlsec int) (bool, error) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	if entry := me.liveKV(k); entry == nil || entry.value != oldv {
+		return false, nil
+	}
+	me.kv[k] = me.newKVEntry(newv, ttlsec)
+	return true, nil
+}
+
+func (me *Backend) GetKVTTL(ctx context.Context, k string) (int, bool, error) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	entry := me.liveKV(k)
+	if entry == nil {
+		return 0, false, nil
+	}
+	if entry.expires.IsZero() {
+		return 0, true, nil
+	}
+	return int((time.Until(entry.expires) + time.Second - 1) / time.Second), true, nil
+}
+
+func (me *Backend) TouchKV(ctx context.Context, k, v string, version int64, ttlsec int) error {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	if entry := me.liveKV(k); entry == nil || entry.version > version {
+		return nil
+	}
+	entry := &kvEntry{value: v, version: version + 1}
+	if ttlsec > 0 {
+		entry.expires = time.Now().Add(time.Duration(ttlsec) * time.Second)
+	}
+	me.kv[k] = entry
+	me.kvVersion = max(me.kvVersion, entry.version)
+	return nil
+}
+
+func (me *Backend) DeleteKVIf(ctx context.Context, k, v string) (bool, error) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	if entry := me.liveKV(k); entry == nil || entry.value != v {
+		return false, nil
+	}
+	delete(me.kv, k)
+	return true, nil
+}
+
+// liveKV returns the unexpired entry of k, the lock must be held
+func (me *Backend) liveKV(k string) *kvEntry {
+	entry := me.kv[k]
+	if entry == nil || (!entry.expires.IsZero() && time.Now().After(entry.expires)) {
+		return nil
+	}
+	return entry
+}
+
+// newKVEntry returns an entry with a version greater than any before, the
+// lock must be held
+func (me *Backend) newKVEntry(v string, ttlsec int) *kvEntry {
+	me.kvVersion = max(me.kvVersion+1, time.Now().UnixMicro())
+	entry := &kvEntry{value: v, version: me.kvVersion}
+	if ttlsec > 0 {
+		entry.expires = time.Now().Add(time.Duration(ttlsec) * time.Second)
+	}
+	return entry
+}
+
+func (me *Backend) DelKV(ctx context.Context, k string) error {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	delete(me.kv, k)
+	return nil
+}
+
+func cloneAll[T proto.Message](m map[string]T) []T {
+	out := make([]T, 0, len(m))
+	for _, v := range m {
+		out = append(out, proto.Clone(v).(T))
+	}
+	return out
+}
@@ -0,0 +1,262 @@
+package acclient
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"google.golang.org/protobuf/proto"
+)
+
+// Cache keeps the resources a Client reads. Keys are "<resource>.<id>",
+// where resource is the pubsub topic type which invalidates the entry
+// (account, agent, presence, ...) and id is usually the account id.
+//
+// Values are opaque to the cache and must be returned as is by Get, an
+// implementation that leaves the process (e.g. Redis) keeps its own codec.
+type Cache interface {
+	Get(key string) (value any, found bool)
+	// Set stores value for ttl, ttl is always positive
+	Set(key string, value any, ttl time.Duration)
+	Delete(key string)
+	Flush()
+}
+
+// DefaultCacheTTL is how long a resource is cached unless configured by
+// WithCacheTTL. Updates are usually picked up sooner through pubsub.
+const DefaultCacheTTL = 60 * time.Minute
+
+type memoryEntry struct {
+	value   any
+	expires time.Time
+}
+
+// memoryCache is an in-process LRU cache with a ttl per entry
+type memoryCache struct {
+	lock  *sync.Mutex
+	cache *lru.Cache[string, memoryEntry]
+}
+
+// NewMemoryCache creates an in-process cache holding at most size entries,
+// the least recently used entries are evicted first
+func NewMemoryCache(size int) Cache {
+	cache, _ := lru.New[string, memoryEntry](max(size, 1))
+	return &memoryCache{lock: &sync.Mutex{}, cache: cache}
+}
+
+func (me *memoryCache) Get(key string) (any, bool) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	entry, found := me.cache.Get(key)
+	if !found {
+		return nil, false
+	}
+	if time.Now().After(entry.expires) {
+		me.cache.Remove(key)
+		return nil, false
+	}
+	return entry.value, true
+}
+
+func (me *memoryCache) Set(key string, value any, ttl time.Duration) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	me.cache.Add(key, memoryEntry{value: value, expires: time.Now().Add(ttl)})
+}
+
+func (me *memoryCache) Delete(key string) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	me.cache.Remove(key)
+}
+
+func (me *memoryCache) Flush() {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	me.cache.Purge()
+}
+
+type noCache struct{}
+
+// NoCache returns a Cache which stores nothing, every call reaches the
+// backends
+func NoCache() Cache { return noCache{} }
+
+func (noCache) Get(key string) (any, bool)                   { return nil, false }
+func (noCache) Set(key string, value any, ttl time.Duration) {}
+func (noCache) Delete(key string)                            {}
+func (noCache) Flush()                                       {}
+
+// DefaultMaxStale is how long an expired or invalidated resource is still
+// served while it is reloaded, unless configured by WithMaxStale
+const DefaultMaxStale = 10 * time.Minute
+
+// cacheEntry is what the client keeps in the Cache. The value is fresh until
+// fresh, then stale until the entry expires.
+type cacheEntry struct {
+	value any
+	fresh time.Time
+}
+
+type cacheState int
+
+const (
+	cacheMiss cacheState = iota
+	cacheStale
+	cacheFresh
+)
+
+// cacheTTL returns how long values of resource are cached, 0 means not
+// cached
+func (me *Client) cacheTTL(resource string) time.Duration {
+	if ttl, has := me.cacheTTLs[resource]; has {
+		return max(ttl, 0)
+	}
+	return DefaultCacheTTL
+}
+
+// maxStale returns how long stale values of resource are kept
+func (me *Client) maxStale(resource string) time.Duration {
+	if maxstale, has := me.maxStales[resource]; has {
+		return max(maxstale, 0)
+	}
+	return DefaultMaxStale
+}
+
+// cacheSet caches a copy of value, the caller keeps ownership of value
+func (me *Client) cacheSet(resource, id string, value any) {
+	me.cacheSetTTL(resource, id, value, me.cacheTTL(resource))
+}
+
+func (me *Client) cacheSetTTL(resource, id string, value any, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	entry := cacheEntry{value: cloneValue(value), fresh: time.Now().Add(ttl)}
+	if value == nil {
+		// missing resources are not served stale
+		me.cache.Set(resource+"."+id, entry, ttl)
+		return
+	}
+	me.cache.Set(resource+"."+id, entry, ttl+me.maxStale(resource))
+}
+
+// cacheInvalidate marks the cached value of a resource as stale, it is
+// dropped if the resource keeps no stale values or was cached missing
+func (me *Client) cacheInvalidate(resource, id string) {
+	key := resource + "." + id
+	maxstale := me.maxStale(resource)
+	value, found := me.cache.Get(key)
+	entry, ok := value.(cacheEntry)
+	if !found || !ok || entry.value == nil || maxstale <= 0 {
+		me.cache.Delete(key)
+		return
+	}
+	me.cache.Set(key, cacheEntry{value: entry.value, fresh: time.Now()}, maxstale)
+}
+
+// cacheGet returns a copy of the fresh cached value of a resource, or the
+// cached value itself if ctx is marked by NoCopy. A cached missing resource
+// is returned as the zero T, found. A value of an unexpected type is dropped.
+func cacheGet[T any](ctx context.Context, me *Client, resource, id string) (T, bool) {
+	value, state := cacheLookup[T](ctx, me, resource, id)
+	if state != cacheFresh {
+		var zero T
+		return zero, false
+	}
+	return value, true
+}
+
+// cacheLookup is cacheGet which also returns stale values
+func cacheLookup[T any](ctx context.Context, me *Client, resource, id string) (T, cacheState) {
+	var zero T
+	key := resource + "." + id
+	value, found := me.cache.Get(key)
+	entry, ok := value.(cacheEntry)
+	if found && !ok {
+		me.cache.Delete(key)
+	}
+	if !found || !ok {
+		me.metrics.Add("acclient_cache_requests_total", 1, "resource", resource, "result", "miss")
+		return zero, cacheMiss
+	}
+	typed, ok := entry.value.(T)
+	if entry.value != nil && !ok {
+		me.cache.Delete(key)
+		me.metrics.Add("acclient_cache_requests_total", 1, "resource", resource, "result", "miss")
+		return zero, cacheMiss
+	}
+
+	state, result := cacheFresh, "hit"
+	if !time.Now().Before(entry.fresh) {
+		state, result = cacheStale, "stale"
+	}
+	me.metrics.Add("acclient_cache_requests_total", 1, "resource", resource, "result", result)
+	if entry.value == nil {
+		return zero, state
+	}
+	return copyOf(ctx, typed), state
+}
+
+type noCopyKey struct{}
+
+// NoCopy marks ctx so that the cached getters (GetAccount, ListAgentM,
+// GetLocale, ...) return the values shared with the cache instead of
+// copies. It saves the copy on hot paths, the caller must not mutate the
+// returned values.
+func NoCopy(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noCopyKey{}, true)
+}
+
+// copyOf returns a deep copy of v unless ctx is marked by NoCopy
+func copyOf[T any](ctx context.Context, v T) T {
+	if nocopy, _ := ctx.Value(noCopyKey{}).(bool); nocopy {
+		return v
+	}
+	return cloneValue(v)
+}
+
+// cloneValue deep copies the values kept in the cache: protos, slices and
+// maps of protos, maps of plain values
+func cloneValue[T any](v T) T {
+	out, _ := cloneReflect(reflect.ValueOf(&v).Elem()).Interface().(T)
+	return out
+}
+
+func cloneReflect(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.New(v.Type()).Elem()
+		out.Set(cloneReflect(v.Elem()))
+		return out
+	case reflect.Pointer:
+		if m, ok := v.Interface().(proto.Message); ok && !v.IsNil() {
+			return reflect.ValueOf(proto.Clone(m))
+		}
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			out.Index(i).Set(cloneReflect(v.Index(i)))
+		}
+		return out
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.MakeMapWithSize(v.Type(), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			out.SetMapIndex(iter.Key(), cloneReflect(iter.Value()))
+		}
+		return out
+	}
+	return v
+}
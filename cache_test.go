@@ -0,0 +1,179 @@
+package acclient
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/subiz/goutils/conv"
+	pb "github.com/subiz/header/account"
+	"github.com/subiz/log"
+)
+
+func TestMemoryCache(t *testing.T) {
+	cache := NewMemoryCache(2)
+	cache.Set("a", 1, time.Hour)
+	cache.Set("b", 2, 10*time.Millisecond)
+	cache.Get("a")
+	cache.Set("c", 3, time.Hour)
+	if _, found := cache.Get("b"); found {
+		t.Error("b is the least recently used, it should be evicted")
+	}
+
+	cache.Set("b", 2, 10*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	if _, found := cache.Get("b"); found {
+		t.Error("b should be expired")
+	}
+	if v, found := cache.Get("c"); !found || v != 3 {
+		t.Errorf("want 3, got %v %v", v, found)
+	}
+}
+
+func TestCacheGet(t *testing.T) {
+	ctx := context.Background()
+	c := New(WithCacheTTL("presence", 0))
+	c.cacheSet("account", "acc1", &pb.Account{})
+	c.cacheSet("account", "acc2", nil)
+	c.cache.Set("account.acc3", "not an account", time.Hour)
+	c.cacheSet("presence", "acc1", []*pb.Presence{})
+
+	if acc, found := cacheGet[*pb.Account](ctx, c, "account", "acc1"); !found || acc == nil {
+		t.Errorf("want acc1, got %v %v", acc, found)
+	}
+	if acc, found := cacheGet[*pb.Account](ctx, c, "account", "acc2"); !found || acc != nil {
+		t.Errorf("want cached missing acc2, got %v %v", acc, found)
+	}
+	if _, found := cacheGet[*pb.Account](ctx, c, "account", "acc3"); found {
+		t.Error("a value of the wrong type must be a miss")
+	}
+	if _, found := cacheGet[[]*pb.Presence](ctx, c, "presence", "acc1"); found {
+		t.Error("presence caching is disabled")
+	}
+}
+
+func TestCacheCopies(t *testing.T) {
+	ctx := context.Background()
+	c := New()
+	agents := map[string]*pb.Agent{"ag1": {Fullname: conv.S("Van")}}
+	c.cacheSet("agent", "acc1", agents)
+	agents["ag1"].Fullname = conv.S("changed by the loader")
+
+	got, _ := cacheGet[map[string]*pb.Agent](ctx, c, "agent", "acc1")
+	if got["ag1"].GetFullname() != "Van" {
+		t.Fatalf("the cache must keep its own copy, got %q", got["ag1"].GetFullname())
+	}
+	got["ag1"].Fullname = conv.S("changed by a caller")
+	delete(got, "ag1")
+
+	shared, _ := cacheGet[map[string]*pb.Agent](NoCopy(ctx), c, "agent", "acc1")
+	if shared["ag1"].GetFullname() != "Van" {
+		t.Errorf("callers must get a copy, got %v", shared)
+	}
+	again, _ := cacheGet[map[string]*pb.Agent](NoCopy(ctx), c, "agent", "acc1")
+	if again["ag1"] != shared["ag1"] {
+		t.Error("NoCopy must return the cached value")
+	}
+}
+
+func TestLoadCoalesces(t *testing.T) {
+	ctx := context.Background()
+	c := New()
+	var calls int32
+	release := make(chan struct{})
+	fn := func(ctx context.Context, accid string) (*pb.Account, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		acc := &pb.Account{Id: conv.S(accid)}
+		c.cacheSet("account", accid, acc)
+		return acc, nil
+	}
+
+	wg := &sync.WaitGroup{}
+	accs := make([]*pb.Account, 10)
+	for i := range accs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			accs[i], _ = load(ctx, c, "account", "acc1", fn)
+		}(i)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("want 1 load, got %d", calls)
+	}
+	for _, acc := range accs {
+		if acc.GetId() != "acc1" {
+			t.Fatalf("want acc1, got %v", acc)
+		}
+	}
+	if accs[0] == accs[1] {
+		t.Error("each caller must get its own copy")
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	block := make(chan struct{})
+	defer close(block)
+	slow := func(ctx context.Context, accid string) (*pb.Account, error) {
+		<-block
+		return nil, nil
+	}
+	if _, err := load(canceled, c, "account", "acc2", slow); err == nil {
+		t.Error("a canceled caller should stop waiting")
+	}
+}
+
+func TestLoadStale(t *testing.T) {
+	ctx := context.Background()
+	c := New(WithMaxStale("account", DefaultMaxStale))
+	c.cacheSet("account", "acc1", &pb.Account{Id: conv.S("v1")})
+	c.cacheInvalidate("account", "acc1")
+
+	failed := make(chan struct{}, 10)
+	failing := func(ctx context.Context, accid string) (*pb.Account, error) {
+		failed <- struct{}{}
+		return nil, log.EServer(nil, log.M{"account_id": accid})
+	}
+	if acc, err := load(ctx, c, "account", "acc1", failing); err != nil || acc.GetId() != "v1" {
+		t.Fatalf("want stale v1, got %v %v", acc, err)
+	}
+	<-failed
+	time.Sleep(10 * time.Millisecond)
+	if acc, err := load(ctx, c, "account", "acc1", failing); err != nil || acc.GetId() != "v1" {
+		t.Fatalf("stale v1 should survive a failed reload, got %v %v", acc, err)
+	}
+	<-failed
+	time.Sleep(10 * time.Millisecond)
+
+	reloaded := make(chan struct{})
+	fn := func(ctx context.Context, accid string) (*pb.Account, error) {
+		defer close(reloaded)
+		acc := &pb.Account{Id: conv.S("v2")}
+		c.cacheSet("account", accid, acc)
+		return acc, nil
+	}
+	load(ctx, c, "account", "acc1", fn)
+	<-reloaded
+	time.Sleep(10 * time.Millisecond)
+	if acc, found := cacheGet[*pb.Account](ctx, c, "account", "acc1"); !found || acc.GetId() != "v2" {
+		t.Errorf("want fresh v2, got %v %v", acc, found)
+	}
+
+	c = New()
+	c.cacheSet("account", "acc1", &pb.Account{Id: conv.S("v1")})
+	c.cacheInvalidate("account", "acc1")
+	if _, err := load(ctx, c, "account", "acc1", failing); err == nil {
+		t.Error("stale values are disabled, the reload error should be returned")
+	}
+	for _, resource := range []string{"subscription", "banned_user"} {
+		if maxstale := c.maxStale(resource); maxstale != 0 {
+			t.Errorf("%s should never be stale, got %s", resource, maxstale)
+		}
+	}
+}
@@ -0,0 +1,582 @@
+package acclient
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/subiz/header"
+	compb "github.com/subiz/header/common"
+	"github.com/subiz/log"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+)
+
+// Client reads and writes account resources of a single subiz cluster.
+// It owns its Cassandra store, gRPC clients, kafka brokers and cache, so
+// one process can hold several clients pointing to different clusters.
+//
+// A Client connects lazily on its first call, or eagerly with Init. Use New to
+// create one, the package level functions (GetAccount, ListAgentM, GetKV, ...)
+// use the default client returned by Default.
+//
+// Methods that reach the network take a ctx, its deadline and cancellation
+// apply to Cassandra queries, gRPC calls, HTTP requests and the internal
+// retry loops. The package level functions use context.Background().
+type Client struct {
+	dbHosts      []string
+	accountAddr  string
+	fabikonAddr  string
+	numregAddr   string
+	convoAddr    string
+	kafkaBrokers string
+
+	connectTimeout time.Duration
+	initTimeout    time.Duration
+	retry          RetryPolicy
+	jobOutputLimit int
+	jobMaxAttempts int
+	kvTTL          int // seconds
+
+	initLock  *sync.Mutex // serializes Init
+	readyLock *sync.Mutex
+	ready     bool
+	closed    bool
+	initErr   error // last initialization failure
+
+	// accounts the account manager reported missing, until they expire or
+	// their account topic fires
+	missingAccs *lru.Cache[string, time.Time] // id -> expires
+
+	// ctx is cancelled by Close to stop the background loops
+	ctx     context.Context
+	cancel  context.CancelFunc
+	loops   *sync.WaitGroup
+	closers []func()
+
+	store          Store
+	publisher      Publisher
+	metrics        Metrics
+	tracer         trace.Tracer
+	tracerProvider trace.TracerProvider // nil when tracing is off
+	files          FileStore
+	accmgr         header.AccountMgrClient
+	paymgr         header.PaymentMgrClient
+	fabikon        header.FabikonServiceClient
+	creditmgr      header.CreditMgrClient
+	registryClient header.NumberRegistryClient
+	numpubsub      header.PubsubClient
+
+	convoLock   *sync.Mutex
+	convoclient header.ConversationMgrClient
+
+	cache           Cache
+	cacheTTLs       map[string]time.Duration // resource -> ttl
+	snapshotPath    string
+	maxStales       map[string]time.Duration // resource -> max staleness
+	loads           *loadGroup
+	compactCache2   *lru.Cache[string, int]
+	uncompactCache2 *lru.Cache[int, string]
+
+	subscribeTopicLock *sync.Mutex
+	subscribeTopics    map[string]time.Time // topic -> last subscribed
+	pollConnId         string
+	pollCursor         string
+
+	jobWaiterLock *sync.Mutex
+	jobWaiters    map[string]map[*jobWaiter]bool // accid/jobid
+
+	changeHookLock *sync.Mutex
+	changeHooks    map[string]map[*changeHook]bool // resource
+}
+
+// Option configures a Client created by New
+type Option func(*Client)
+
+// WithDBHosts sets the Cassandra seed hosts, default is db-0
+func WithDBHosts(hosts ...string) Option {
+	return func(me *Client) { me.dbHosts = hosts }
+}
+
+// WithAccountAddr sets the address of the account service, which also serves
+// payments and credits, default is account-0.account:10283
+func WithAccountAddr(addr string) Option {
+	return func(me *Client) { me.accountAddr = addr }
+}
+
+// WithFabikonAddr sets the address of the facebook connector, default is fabikon:21111
+func WithFabikonAddr(addr string) Option {
+	return func(me *Client) { me.fabikonAddr = addr }
+}
+
+// WithNumregAddr sets the address of the number registry service, which also
+// serves pubsub, default is numreg-0.numreg:8665
+func WithNumregAddr(addr string) Option {
+	return func(me *Client) { me.numregAddr = addr }
+}
+
+// WithConvoAddr sets the address of the conversation service, default is convo-0.convo:18021
+func WithConvoAddr(addr string) Option {
+	return func(me *Client) { me.convoAddr = addr }
+}
+
+// WithKafkaBrokers sets the kafka brokers used to publish credit spends,
+// counters and search indexes, default is kafkaatm:9094
+func WithKafkaBrokers(brokers string) Option {
+	return func(me *Client) { me.kafkaBrokers = brokers }
+}
+
+// WithConnectTimeout bounds a single attempt to connect to Cassandra or a
+// gRPC service, default is 10s
+func WithConnectTimeout(timeout time.Duration) Option {
+	return func(me *Client) { me.connectTimeout = timeout }
+}
+
+// WithInitTimeout bounds how long a call waits for the lazy initialization,
+// retries included, before failing, default is 1 minute. It does not apply to
+// Init, which is bounded by its ctx.
+func WithInitTimeout(timeout time.Duration) Option {
+	return func(me *Client) { me.initTimeout = timeout }
+}
+
+// WithRetryPolicy sets how failed backend calls are retried, default is
+// DefaultRetryPolicy
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(me *Client) { me.retry = policy }
+}
+
+// WithJobOutputLimit sets the size in bytes above which EndJob uploads the
+// output as a file instead of storing it in the job row, default is 64KiB
+func WithJobOutputLimit(limit int) Option {
+	return func(me *Client) { me.jobOutputLimit = limit }
+}
+
+// WithJobMaxAttempts sets how many leases of a queued job may expire
+// before ClaimJob ends it with JobStatusDead, default is 3
+func WithJobMaxAttempts(attempts int) Option {
+	return func(me *Client) { me.jobMaxAttempts = attempts }
+}
+
+// WithKVTTL sets the ttl in seconds SetKV gives keys, default is
+// DefaultKVTTL. Use KVNoExpiry for keys which must not expire.
+func WithKVTTL(ttlsec int) Option {
+	return func(me *Client) { me.kvTTL = ttlsec }
+}
+
+// WithCache replaces the in-process cache, default is NewMemoryCache(200_000).
+// Use NoCache to disable caching.
+func WithCache(cache Cache) Option {
+	return func(me *Client) { me.cache = cache }
+}
+
+// WithCacheTTL sets how long values of a resource (account, agent,
+// presence, attribute_definition, ...) are cached, default is
+// DefaultCacheTTL. A ttl of 0 disables caching of the resource.
+func WithCacheTTL(resource string, ttl time.Duration) Option {
+	return func(me *Client) { me.cacheTTLs[resource] = ttl }
+}
+
+// WithCacheSnapshot saves the account resources of the cache (see Warmup)
+// to path every few minutes and on Close, and restores them when the client
+// is created, e.g. "./.cache/acclient.snapshot". Restored values are stale:
+// they are served while the first read reloads them, within the max
+// staleness of their resource (see WithMaxStale), so resources never served
+// stale are not restored.
+func WithCacheSnapshot(path string) Option {
+	return func(me *Client) { me.snapshotPath = path }
+}
+
+// WithMaxStale sets how long an expired or invalidated value of a resource
+// is still served while it is reloaded in the background, or while the
+// backends are down. Default is DefaultMaxStale, 0 always waits for the
+// reload. The resources checked for permissions, spending and bans
+// (account, subscription, agent, agent_scope, banned_user, blacklist_ip and
+// website) default to 0.
+func WithMaxStale(resource string, maxstale time.Duration) Option {
+	return func(me *Client) { me.maxStales[resource] = maxstale }
+}
+
+// WithStore replaces the Cassandra store, WithDBHosts is ignored
+func WithStore(store Store) Option {
+	return func(me *Client) { me.store = store }
+}
+
+// WithMetrics sets where the client reports its metrics, default is
+// DefaultMetrics. Use NoMetrics to disable them.
+func WithMetrics(metrics Metrics) Option {
+	return func(me *Client) { me.metrics = metrics }
+}
+
+// WithPublisher replaces the kafka publisher, WithKafkaBrokers is ignored
+func WithPublisher(publisher Publisher) Option {
+	return func(me *Client) { me.publisher = publisher }
+}
+
+// WithFileStore replaces the file API used to keep large job outputs
+func WithFileStore(files FileStore) Option {
+	return func(me *Client) { me.files = files }
+}
+
+// WithAccountMgr replaces the account service client
+func WithAccountMgr(accmgr header.AccountMgrClient) Option {
+	return func(me *Client) { me.accmgr = accmgr }
+}
+
+// WithPaymentMgr replaces the payment service client
+func WithPaymentMgr(paymgr header.PaymentMgrClient) Option {
+	return func(me *Client) { me.paymgr = paymgr }
+}
+
+// WithCreditMgr replaces the credit service client
+func WithCreditMgr(creditmgr header.CreditMgrClient) Option {
+	return func(me *Client) { me.creditmgr = creditmgr }
+}
+
+// WithFabikon replaces the facebook connector client
+func WithFabikon(fabikon header.FabikonServiceClient) Option {
+	return func(me *Client) { me.fabikon = fabikon }
+}
+
+// WithNumberRegistry replaces the number registry client
+func WithNumberRegistry(registry header.NumberRegistryClient) Option {
+	return func(me *Client) { me.registryClient = registry }
+}
+
+// WithPubsub replaces the pubsub client used to invalidate the cache
+func WithPubsub(pubsub header.PubsubClient) Option {
+	return func(me *Client) { me.numpubsub = pubsub }
+}
+
+// WithConvo replaces the conversation service client
+func WithConvo(convo header.ConversationMgrClient) Option {
+	return func(me *Client) { me.convoclient = convo }
+}
+
+// New creates a Client. No connection is made until Init or the first call
+func New(opts ...Option) *Client {
+	compactCache2, _ := lru.New[string, int](100_000)
+	uncompactCache2, _ := lru.New[int, string](100_000)
+	missingAccs, _ := lru.New[string, time.Time](missingAccountSize)
+	ctx, cancel := context.WithCancel(context.Background())
+	me := &Client{
+		dbHosts:      []string{"db-0"},
+		accountAddr:  "account-0.account:10283",
+		fabikonAddr:  "fabikon:21111",
+		numregAddr:   "numreg-0.numreg:8665",
+		convoAddr:    "convo-0.convo:18021",
+		kafkaBrokers: "kafkaatm:9094",
+
+		connectTimeout: 10 * time.Second,
+		initTimeout:    time.Minute,
+		retry:          DefaultRetryPolicy(),
+		metrics:        DefaultMetrics,
+		tracer:         noopTracer,
+		jobOutputLimit: 64 << 10,
+		jobMaxAttempts: 3,
+		kvTTL:          DefaultKVTTL,
+		files:          &apiFileStore{},
+
+		initLock:  &sync.Mutex{},
+		readyLock: &sync.Mutex{},
+
+		missingAccs: missingAccs,
+
+		ctx:    ctx,
+		cancel: cancel,
+		loops:  &sync.WaitGroup{},
+
+		convoLock: &sync.Mutex{},
+
+		cache:           NewMemoryCache(200_000),
+		cacheTTLs:       map[string]time.Duration{"agent_scope": 30 * time.Second},
+		maxStales:       map[string]time.Duration{"account": 0, "subscription": 0, "agent": 0, "agent_scope": 0, "banned_user": 0, "blacklist_ip": 0, "website": 0},
+		loads:           newLoadGroup(),
+		compactCache2:   compactCache2,
+		uncompactCache2: uncompactCache2,
+
+		subscribeTopicLock: &sync.Mutex{},
+		subscribeTopics:    map[string]time.Time{},
+
+		jobWaiterLock: &sync.Mutex{},
+		jobWaiters:    map[string]map[*jobWaiter]bool{},
+
+		changeHookLock: &sync.Mutex{},
+		changeHooks:    map[string]map[*changeHook]bool{},
+	}
+	for _, opt := range opts {
+		opt(me)
+	}
+	if me.publisher == nil {
+		me.publisher = &kafkaPublisher{brokers: me.kafkaBrokers}
+	}
+	me.publisher = &metricsPublisher{next: me.publisher, metrics: me.metrics}
+	me.retry.onRetry = func(err error) { me.metrics.Add("acclient_retries_total", 1) }
+	if me.snapshotPath != "" {
+		me.restoreSnapshot()
+	}
+	return me
+}
+
+var defaultClient = New()
+
+// Default returns the client used by the package level functions
+func Default() *Client {
+	return defaultClient
+}
+
+// Init connects to every service that was not provided as an option and
+// starts the cache invalidation loop. Failed connections are retried with
+// the backoff of the retry policy until ctx is done, then the last error is
+// returned.
+// Calling Init on a ready client is a no-op.
+//
+// Init is optional, a client initializes itself on its first call, but
+// calling it at startup surfaces misconfiguration early.
+func (me *Client) Init(ctx context.Context) error {
+	me.initLock.Lock()
+	defer me.initLock.Unlock()
+	me.readyLock.Lock()
+	closed, ready := me.closed, me.ready
+	me.readyLock.Unlock()
+	if closed {
+		return errClosed()
+	}
+	if ready {
+		return nil
+	}
+
+	// Close aborts a pending initialization
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer context.AfterFunc(me.ctx, cancel)()
+
+	for attempt := 1; ; attempt++ {
+		err := me._init(ctx)
+		me.readyLock.Lock()
+		if me.closed {
+			me.readyLock.Unlock()
+			return errClosed()
+		}
+		me.ready, me.initErr = err == nil, err
+		me.readyLock.Unlock()
+		if err == nil {
+			me.startLoops()
+			return nil
+		}
+
+		if !sleepCtx(ctx, me.retry.Backoff(attempt)) {
+			return err
+		}
+	}
+}
+
+// Ready returns nil when the client is initialized and not closed, it never
+// blocks nor connects, so it can back a /healthz or readiness probe
+func (me *Client) Ready() error {
+	me.readyLock.Lock()
+	defer me.readyLock.Unlock()
+	if me.closed {
+		return errClosed()
+	}
+	if me.ready {
+		return nil
+	}
+	if me.initErr != nil {
+		return me.initErr
+	}
+	return log.NewError(nil, log.M{"reason": "acclient is not initialized"}, log.E_service_unavailable)
+}
+
+// Close stops the background loops and closes the connections the client
+// opened itself. Calls made after Close fail.
+func (me *Client) Close() {
+	me.readyLock.Lock()
+	if me.closed {
+		me.readyLock.Unlock()
+		return
+	}
+	me.closed = true
+	me.cancel()
+	me.readyLock.Unlock()
+
+	me.initLock.Lock() // wait for a pending Init to give up
+	closers := me.closers
+	me.closers = nil
+	me.initLock.Unlock()
+
+	me.loops.Wait()
+	for _, close := range closers {
+		close()
+	}
+}
+
+func errClosed() error {
+	return log.NewError(nil, log.M{"reason": "acclient is closed"}, log.E_service_unavailable)
+}
+
+// _init connects to the services that were not provided as options. It is
+// safe to call again after a failure, only the missing services are retried.
+func (me *Client) _init(ctx context.Context) error {
+	if me.store == nil {
+		session, err := connectDB(ctx, me.dbHosts, "account", me.connectTimeout)
+		if err != nil {
+			return err
+		}
+		me.store = &cqlStore{session: session}
+		me.closers = append(me.closers, session.Close)
+	}
+	if me.accmgr == nil || me.paymgr == nil || me.creditmgr == nil {
+		conn, err := me.dialGrpc(ctx, me.accountAddr, header.WithShardRedirect())
+		if err != nil {
+			return err
+		}
+		if me.accmgr == nil {
+			me.accmgr = header.NewAccountMgrClient(conn)
+		}
+		if me.paymgr == nil {
+			me.paymgr = header.NewPaymentMgrClient(conn)
+		}
+		if me.creditmgr == nil {
+			me.creditmgr = header.NewCreditMgrClient(conn)
+		}
+	}
+	if me.fabikon == nil {
+		conn, err := me.dialGrpc(ctx, me.fabikonAddr)
+		if err != nil {
+			return err
+		}
+		me.fabikon = header.NewFabikonServiceClient(conn)
+	}
+	if me.registryClient == nil || me.numpubsub == nil {
+		conn, err := me.dialGrpc(ctx, me.numregAddr)
+		if err != nil {
+			return err
+		}
+		if me.registryClient == nil {
+			me.registryClient = header.NewNumberRegistryClient(conn)
+		}
+		if me.numpubsub == nil {
+			me.numpubsub = header.NewPubsubClient(conn)
+		}
+	}
+	return nil
+}
+
+// dialGrpc connects to addr and waits, at most connectTimeout, until the
+// connection is ready
+func (me *Client) dialGrpc(ctx context.Context, addr string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	// header.DialGrpc loops forever on an invalid target, catch it first
+	probe, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, log.EInternalConnect(err, log.M{"addr": addr})
+	}
+	probe.Close()
+
+	opts = append(opts, grpc.WithChainUnaryInterceptor(me.grpcMetrics))
+	var conn *grpc.ClientConn
+	if me.tracerProvider != nil && me.tracerProvider != otel.GetTracerProvider() {
+		// header.DialGrpc traces with the global provider, which would trace
+		// every call twice
+		if conn, err = grpc.NewClient(addr, append(opts, dialOptions(me.tracerProvider)...)...); err != nil {
+			return nil, log.EInternalConnect(err, log.M{"addr": addr})
+		}
+	} else {
+		conn = header.DialGrpc(addr, opts...)
+	}
+	ctx, cancel := context.WithTimeout(ctx, me.connectTimeout)
+	defer cancel()
+	conn.Connect()
+	for state := conn.GetState(); state != connectivity.Ready; state = conn.GetState() {
+		if !conn.WaitForStateChange(ctx, state) {
+			conn.Close()
+			return nil, log.EInternalConnect(ctx.Err(), log.M{"addr": addr, "state": state.String()})
+		}
+	}
+	me.closers = append(me.closers, func() { conn.Close() })
+	return conn, nil
+}
+
+// dialOptions are the options of header.DialGrpc tracing with tp, less its
+// prometheus interceptor which the client metrics stand in for
+func dialOptions(tp trace.TracerProvider) []grpc.DialOption {
+	return []grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(50 * 1024 * 1024)),
+		header.WithErrorStack(),
+		grpc.WithDefaultServiceConfig(`{"loadBalancingPolicy":"round_robin"}`),
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{Time: 60 * time.Second, Timeout: 20 * time.Second}),
+		grpc.WithStatsHandler(otelgrpc.NewClientHandler(otelgrpc.WithTracerProvider(tp))),
+	}
+}
+
+func (me *Client) startLoops() {
+	me.loops.Add(2)
+	go func() {
+		defer me.loops.Done()
+		me.pollLoop()
+	}()
+	if me.snapshotPath != "" {
+		me.loops.Add(1)
+		go func() {
+			defer me.loops.Done()
+			me.snapshotLoop()
+		}()
+	}
+	go func() {
+		defer me.loops.Done()
+		loopfileapidomain(me.ctx)
+	}()
+}
+
+// toGrpcCtx is header.ToGrpcCtx keeping the deadline, cancellation and
+// outgoing metadata of ctx
+func toGrpcCtx(ctx context.Context, pctx *compb.Context) context.Context {
+	md, _ := metadata.FromOutgoingContext(header.ToGrpcCtx(pctx))
+	out, _ := metadata.FromOutgoingContext(ctx)
+	out = out.Copy()
+	for k, v := range md {
+		out[k] = v
+	}
+	return metadata.NewOutgoingContext(ctx, out)
+}
+
+// sleepCtx pauses for d, returns false if ctx is done meanwhile
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// for testing purpose
+func (me *Client) ClearCache() {
+	me.cache.Flush()
+	me.missingAccs.Purge()
+}
+
+// waitUntilReady lazily initializes the client, waiting at most initTimeout
+// or until ctx is done. It fails once the client is closed.
+func (me *Client) waitUntilReady(ctx context.Context) error {
+	me.readyLock.Lock()
+	closed, ready := me.closed, me.ready
+	me.readyLock.Unlock()
+	if closed {
+		return errClosed()
+	}
+	if ready {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, me.initTimeout)
+	defer cancel()
+	return me.Init(ctx)
+}
@@ -0,0 +1,98 @@
+package acclient
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/subiz/header"
+	compb "github.com/subiz/header/common"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestNewOptions(t *testing.T) {
+	c := New(
+		WithDBHosts("db-1", "db-2"),
+		WithAccountAddr("account-0.account.stg:10283"),
+		WithNumregAddr("numreg-0.numreg.stg:8665"),
+		WithKafkaBrokers("kafka-stg:9094"),
+	)
+	if !slices.Equal(c.dbHosts, []string{"db-1", "db-2"}) {
+		t.Errorf("dbHosts = %v", c.dbHosts)
+	}
+	if c.accountAddr != "account-0.account.stg:10283" || c.numregAddr != "numreg-0.numreg.stg:8665" {
+		t.Errorf("accountAddr = %q, numregAddr = %q", c.accountAddr, c.numregAddr)
+	}
+	if c.kafkaBrokers != "kafka-stg:9094" {
+		t.Errorf("kafkaBrokers = %q", c.kafkaBrokers)
+	}
+	if c.fabikonAddr != "fabikon:21111" || c.convoAddr != "convo-0.convo:18021" {
+		t.Errorf("unset options must keep defaults, got fabikon %q, convo %q", c.fabikonAddr, c.convoAddr)
+	}
+
+	if c.cache == Default().cache {
+		t.Error("clients must not share a cache")
+	}
+}
+
+func TestInitFailure(t *testing.T) {
+	c := New(WithDBHosts("127.0.0.1:1"), WithConnectTimeout(200*time.Millisecond))
+	if err := c.Ready(); err == nil {
+		t.Error("a new client must not be ready")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := c.Init(ctx); err == nil {
+		t.Fatal("want init error, got nil")
+	}
+	if err := c.Ready(); err == nil {
+		t.Error("client must not be ready after a failed init")
+	}
+
+	c.Close()
+	if err := c.Init(context.Background()); err == nil {
+		t.Error("a closed client must not initialize")
+	}
+	if _, _, err := c.GetKV(context.Background(), "user", "k1"); err == nil {
+		t.Error("want error calling a closed client")
+	}
+}
+
+func TestToGrpcCtx(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	ctx = metadata.AppendToOutgoingContext(ctx, "x-request-id", "req1")
+	gctx := toGrpcCtx(ctx, &compb.Context{AccountId: "acc1"})
+
+	if _, has := gctx.Deadline(); !has {
+		t.Error("deadline must be kept")
+	}
+	md, _ := metadata.FromOutgoingContext(gctx)
+	if len(md.Get("x-request-id")) != 1 {
+		t.Errorf("caller metadata must be kept, got %v", md)
+	}
+	if accid := header.FromGrpcCtx(gctx).GetAccountId(); accid != "acc1" {
+		t.Errorf("want acc1, got %q", accid)
+	}
+
+	cancel()
+	if gctx.Err() == nil {
+		t.Error("cancellation must propagate")
+	}
+}
+
+func TestWatchedTopics(t *testing.T) {
+	c := New(WithCacheTTL("presence", time.Hour))
+	c.subscribe("acc1", "agent")
+	c.subscribe("acc2", "agent")
+	c.subscribe("acc1", "presence")
+	c.subscribeTopics["agent.acc2"] = time.Now().Add(-DefaultCacheTTL - DefaultMaxStale - time.Minute)
+	c.subscribeTopics["presence.acc1"] = time.Now().Add(-DefaultCacheTTL - time.Minute)
+
+	topics := c.watchedTopics()
+	slices.Sort(topics)
+	if want := []string{"agent.acc1", "presence.acc1"}; !slices.Equal(topics, want) {
+		t.Errorf("want %v, got %v", want, topics)
+	}
+}
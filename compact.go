@@ -3,88 +3,70 @@ package acclient
 import (
 	"context"
 	"strings"
-	"sync"
 
-	lru "github.com/hashicorp/golang-lru/v2"
 	"github.com/subiz/header"
 )
 
-var (
-	compactCache2   *lru.Cache[string, int]
-	uncompactCache2 *lru.Cache[int, string]
-	compactLock     = &sync.Mutex{}
-)
-
-func makeSureCompact() {
-	if uncompactCache2 != nil {
-		return
-	}
-	compactLock.Lock()
-	defer compactLock.Unlock()
-	if uncompactCache2 != nil {
-		return
-	}
-
-	compactCache2, _ = lru.New[string, int](100_000)
-	uncompactCache2, _ = lru.New[int, string](100_000)
-}
-
-func CompactString2(str string) (int, error) {
-	makeSureCompact()
-
+func (me *Client) CompactString2(ctx context.Context, str string) (int, error) {
+	ctx, span := me.startSpan(ctx, "CompactString2", "")
+	defer span.End()
 	if str == "" {
 		return 0, nil
 	}
 
 	str = strings.ToValidUTF8(str, "")
-	waitUntilReady()
-	number, exist := compactCache2.Get(str)
+	if err := me.waitUntilReady(ctx); err != nil {
+		return 0, err
+	}
+	number, exist := me.compactCache2.Get(str)
 	if exist {
 		return number, nil
 	}
 
-	err := session.Query(`SELECT num FROM account.compact_str2 WHERE str=?`, str).Scan(&number)
-	if err == nil {
-		uncompactCache2.Add(number, str)
-		compactCache2.Add(str, number)
+	number, err := me.store.LookupCompactString(ctx, str)
+	if err == nil && number != 0 {
+		me.uncompactCache2.Add(number, str)
+		me.compactCache2.Add(str, number)
 		return number, nil
 	}
 
-	numOut, err := registryClient.Compact(context.Background(), &header.String{Str: str, Version: "2"})
+	numOut, err := me.registryClient.Compact(ctx, &header.String{Str: str, Version: "2"})
 	if err != nil {
 		return 0, err
 	}
 	number = int(numOut.GetNumber())
-	uncompactCache2.Add(number, str)
-	compactCache2.Add(str, number)
+	me.uncompactCache2.Add(number, str)
+	me.compactCache2.Add(str, number)
 	return number, nil
 }
 
-func UncompactString2(num int) (string, error) {
-	makeSureCompact()
-
+func (me *Client) UncompactString2(ctx context.Context, num int) (string, error) {
+	ctx, span := me.startSpan(ctx, "UncompactString2", "")
+	defer span.End()
 	if num == 0 {
 		return "", nil
 	}
-	waitUntilReady()
-	str, exist := uncompactCache2.Get(num)
+	if err := me.waitUntilReady(ctx); err != nil {
+		return "", err
+	}
+	str, exist := me.uncompactCache2.Get(num)
 	if exist {
 		return str, nil
 	}
 
-	err := session.Query(`SELECT str FROM account.uncompact_num2 WHERE num=?`, num).Scan(&str)
-	if err == nil {
-		uncompactCache2.Add(num, str)
-		compactCache2.Add(str, num)
+	str, err := me.store.LookupCompactNumber(ctx, num)
+	if err == nil && str != "" {
+		me.uncompactCache2.Add(num, str)
+		me.compactCache2.Add(str, num)
 		return str, nil
 	}
 
-	strOut, err := registryClient.Uncompact(context.Background(), &header.Number{Number: int64(num), Version: "2"})
+	strOut, err := me.registryClient.Uncompact(ctx, &header.Number{Number: int64(num), Version: "2"})
 	if err != nil {
 		return "", err
 	}
 	str = strOut.GetStr()
-	uncompactCache2.Add(num, str)
-	compactCache2.Add(str, num)
+	me.uncompactCache2.Add(num, str)
+	me.compactCache2.Add(str, num)
 	return str, nil
 }
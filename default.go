@@ -0,0 +1,390 @@
+package acclient
+
+import (
+	"context"
+	"time"
+
+	"github.com/subiz/header"
+	pb "github.com/subiz/header/account"
+	compb "github.com/subiz/header/common"
+	pm "github.com/subiz/header/payment"
+)
+
+// Package level functions below are thin wrappers over the default client,
+// see Default
+
+func Init(ctx context.Context) error {
+	return defaultClient.Init(ctx)
+}
+
+func Ready() error {
+	return defaultClient.Ready()
+}
+
+func Close() {
+	defaultClient.Close()
+}
+
+func Warmup(ctx context.Context, accids []string) error {
+	return defaultClient.Warmup(ctx, accids)
+}
+
+func ListLocaleMessageDB(accid, locale string) (*header.Lang, error) {
+	return defaultClient.ListLocaleMessageDB(context.Background(), accid, locale)
+}
+
+func GetLocale(accid, locale string) (*header.Lang, error) {
+	return defaultClient.GetLocale(context.Background(), accid, locale)
+}
+
+func GetAccount(accid string) (*pb.Account, error) {
+	return defaultClient.GetAccount(context.Background(), accid)
+}
+
+func GetNotificationSetting(accid, agid string) (*header.NotiSetting, error) {
+	return defaultClient.GetNotificationSetting(context.Background(), accid, agid)
+}
+
+func GetSubscription(accid string) (*pm.Subscription, error) {
+	return defaultClient.GetSubscription(context.Background(), accid)
+}
+
+func ListAgentProfileAccounts(agid string) ([]*pb.Account, error) {
+	return defaultClient.ListAgentProfileAccounts(context.Background(), agid)
+}
+
+func ListFanpageSyncLifecycleStages(accid string) (map[string]bool, error) {
+	return defaultClient.ListFanpageSyncLifecycleStages(context.Background(), accid)
+}
+
+func GetAgent(accid, agid string) (*pb.Agent, error) {
+	return defaultClient.GetAgent(context.Background(), accid, agid)
+}
+
+func ListAgentsInGroup(accid, groupid string) ([]*pb.Agent, error) {
+	return defaultClient.ListAgentsInGroup(context.Background(), accid, groupid)
+}
+
+func ListAgentM(accid string) (map[string]*pb.Agent, error) {
+	return defaultClient.ListAgentM(context.Background(), accid)
+}
+
+func ListGroups(accid string) ([]*header.AgentGroup, error) {
+	return defaultClient.ListGroups(context.Background(), accid)
+}
+
+func GetGroup(accid, grid string) (*header.AgentGroup, error) {
+	return defaultClient.GetGroup(context.Background(), accid, grid)
+}
+
+func ListOnlineAgents(accid string) ([]*pb.Presence, error) {
+	return defaultClient.ListOnlineAgents(context.Background(), accid)
+}
+
+func ListActiveAccountIds() ([]string, error) {
+	return defaultClient.ListActiveAccountIds(context.Background())
+}
+
+func GetAIAgent(accid, agid string) (*header.AIAgent, error) {
+	return defaultClient.GetAIAgent(context.Background(), accid, agid)
+}
+
+func GetBot(accid, botid string) (*header.Bot, error) {
+	return defaultClient.GetBot(context.Background(), accid, botid)
+}
+
+func ListBots(accid string) ([]*header.Bot, error) {
+	return defaultClient.ListBots(context.Background(), accid)
+}
+
+func ListAIAgents(accid string) (map[string]*header.AIAgent, error) {
+	return defaultClient.ListAIAgents(context.Background(), accid)
+}
+
+func ListPipelines(accid string) ([]*header.Pipeline, error) {
+	return defaultClient.ListPipelines(context.Background(), accid)
+}
+
+func SignKey(accid, issuer, typ, keytype string, objects []string) (string, error) {
+	return defaultClient.SignKey(context.Background(), accid, issuer, typ, keytype, objects)
+}
+
+func LookupSignedKey(key string) (string, string, string, string, []string, error) {
+	return defaultClient.LookupSignedKey(context.Background(), key)
+}
+
+func ListDefs(accid string) (map[string]*header.AttributeDefinition, error) {
+	return defaultClient.ListDefs(context.Background(), accid)
+}
+
+func SetShopSetting(accid string, setting *header.ShopSetting) {
+	defaultClient.SetShopSetting(accid, setting)
+}
+
+func GetShopSetting(accid string) (*header.ShopSetting, error) {
+	return defaultClient.GetShopSetting(context.Background(), accid)
+}
+
+func ConvertToFPV(accid string, price float32, order_cur string) (int64, float32, error) {
+	return defaultClient.ConvertToFPV(context.Background(), accid, price, order_cur)
+}
+
+func ShortenLink(accid, link string) (string, error) {
+	return defaultClient.ShortenLink(context.Background(), accid, link)
+}
+
+func DownloadAsText(accid, url string) (string, error) {
+	return defaultClient.DownloadAsText(context.Background(), accid, url)
+}
+
+func LookupLink(shorten string) (*header.Link, error) {
+	return defaultClient.LookupLink(context.Background(), shorten)
+}
+
+func NewID_(accid, scope string) (int64, error) {
+	return defaultClient.NewID_(context.Background(), accid, scope)
+}
+
+func NewID2(accid, scope string) (int64, error) {
+	return defaultClient.NewID2(context.Background(), accid, scope)
+}
+
+func GetLastID(accid, scope string) (int64, error) {
+	return defaultClient.GetLastID(context.Background(), accid, scope)
+}
+
+func GetAttrAsStringWithDateFormat(user *header.User, key, dateformat string) string {
+	return defaultClient.GetAttrAsStringWithDateFormat(context.Background(), user, key, dateformat)
+}
+
+func GetAttrAsString(user *header.User, key string) string {
+	return defaultClient.GetAttrAsString(context.Background(), user, key)
+}
+
+func GetCreditUsage(accid string, filters []string, currency string) (int64, error) {
+	return defaultClient.GetCreditUsage(context.Background(), accid, filters, currency)
+}
+
+func TrySpend(accid string, item string, fpvunitpricevnd int64) error {
+	return defaultClient.TrySpend(context.Background(), accid, item, fpvunitpricevnd)
+}
+
+func Spend(accid string, itemType, source string, fpvunitpricevnd int64, data *header.CreditEntryData) {
+	defaultClient.Spend(accid, itemType, source, fpvunitpricevnd, data)
+}
+
+func Notify(accid, topic string) {
+	defaultClient.Notify(context.Background(), accid, topic)
+}
+
+func AccessFeature(accid string, objectType header.ObjectType, action header.ObjectAction, cred *compb.Credential) error {
+	return defaultClient.AccessFeature(context.Background(), accid, objectType, action, cred)
+}
+
+func CheckPerm(objectType header.ObjectType, action header.ObjectAction, accid, issuer, issuertype string, isOwned, isAssigned bool, resourceGroups ...header.IResourceGroup) error {
+	return defaultClient.CheckPerm(context.Background(), objectType, action, accid, issuer, issuertype, isOwned, isAssigned, resourceGroups...)
+}
+
+func GetAgentPerm(accid, agid string, resourceGroup header.IResourceGroup) (map[string]bool, error) {
+	return defaultClient.GetAgentPerm(context.Background(), accid, agid, resourceGroup)
+}
+
+func ListBlacklistIPs(accid string) (map[string]*header.BlacklistIP, error) {
+	return defaultClient.ListBlacklistIPs(context.Background(), accid)
+}
+
+func ListBannedUsers(accid string) (map[string]*header.BannedUser, error) {
+	return defaultClient.ListBannedUsers(context.Background(), accid)
+}
+
+func IncCounter(accid string, ts string, labels []string, payload []byte) {
+	defaultClient.IncCounter(accid, ts, labels, payload)
+}
+
+func SetDomainVerified(accid, domain string, verified bool) {
+	defaultClient.SetDomainVerified(accid, domain, verified)
+}
+
+func IsDomainVerified(accid, domain string) (bool, error) {
+	return defaultClient.IsDomainVerified(context.Background(), accid, domain)
+}
+
+func IsExactDomainVerified(accid, domain string) (bool, error) {
+	return defaultClient.IsExactDomainVerified(context.Background(), accid, domain)
+}
+
+func GetJob(accid, jobid string) (*header.Job, error) {
+	return defaultClient.GetJob(context.Background(), accid, jobid)
+}
+
+func StartJob(accid, name, description, category string, timeoutsec int64) (string, error) {
+	return defaultClient.StartJob(context.Background(), accid, name, description, category, timeoutsec)
+}
+
+func UpdateJobStatus(accid, jobid, status string) error {
+	return defaultClient.UpdateJobStatus(context.Background(), accid, jobid, status)
+}
+
+func ForceEndJob(accid, jobid string) error {
+	return defaultClient.ForceEndJob(context.Background(), accid, jobid)
+}
+
+func EndJob(accid, jobid, status string, output []byte) error {
+	return defaultClient.EndJob(context.Background(), accid, jobid, status, output)
+}
+
+func PingJob(accid, jobid string) (string, error) {
+	return defaultClient.PingJob(context.Background(), accid, jobid)
+}
+
+func GetJobInfo(accid, jobid string) (*JobInfo, error) {
+	return defaultClient.GetJobInfo(context.Background(), accid, jobid)
+}
+
+func UpdateJobProgress(accid, jobid string, done, total int64) error {
+	return defaultClient.UpdateJobProgress(context.Background(), accid, jobid, done, total)
+}
+
+func AppendJobLog(accid, jobid, level, msg string) error {
+	return defaultClient.AppendJobLog(context.Background(), accid, jobid, level, msg)
+}
+
+func ListJobLogs(accid, jobid string) ([]*JobLog, error) {
+	return defaultClient.ListJobLogs(context.Background(), accid, jobid)
+}
+
+func WaitJob(ctx context.Context, accid, jobid string) (*header.Job, error) {
+	return defaultClient.WaitJob(ctx, accid, jobid)
+}
+
+func OnJobEnded(accid, jobid string, cb func(*header.Job)) (func(), error) {
+	return defaultClient.OnJobEnded(context.Background(), accid, jobid, cb)
+}
+
+func OnChange(resource string, cb func(accid string)) func() {
+	return defaultClient.OnChange(resource, cb)
+}
+
+func ListJobs(accid string, filter *JobFilter) ([]*header.Job, string, error) {
+	return defaultClient.ListJobs(context.Background(), accid, filter)
+}
+
+func EnqueueJob(accid, category string, payload []byte) (string, error) {
+	return defaultClient.EnqueueJob(context.Background(), accid, category, payload)
+}
+
+func ClaimJob(category, workerid string, leasesec int64) (*JobInfo, error) {
+	return defaultClient.ClaimJob(context.Background(), category, workerid, leasesec)
+}
+
+func RenewJobLease(accid, jobid, workerid string) (string, error) {
+	return defaultClient.RenewJobLease(context.Background(), accid, jobid, workerid)
+}
+
+func EndClaimedJob(accid, jobid, workerid, status string, output []byte) error {
+	return defaultClient.EndClaimedJob(context.Background(), accid, jobid, workerid, status, output)
+}
+
+func ReleaseJob(accid, jobid, workerid string) error {
+	return defaultClient.ReleaseJob(context.Background(), accid, jobid, workerid)
+}
+
+func RunJob(ctx context.Context, accid, name, category string, timeout time.Duration, fn func(ctx context.Context, job *JobHandle) ([]byte, error)) (string, error) {
+	return defaultClient.RunJob(ctx, accid, name, category, timeout, fn)
+}
+
+func GetKV(scope, key string) (string, bool, error) {
+	return defaultClient.GetKV(context.Background(), scope, key)
+}
+
+func SetKV(scope, key, value string) error {
+	return defaultClient.SetKV(context.Background(), scope, key, value)
+}
+
+func SetKVTTL(scope, key, value string, ttlsec int) error {
+	return defaultClient.SetKVTTL(context.Background(), scope, key, value, ttlsec)
+}
+
+func DelKV(scope, key string) error {
+	return defaultClient.DelKV(context.Background(), scope, key)
+}
+
+func GetKVTTL(scope, key string) (int, bool, error) {
+	return defaultClient.GetKVTTL(context.Background(), scope, key)
+}
+
+func TouchKV(scope, key string, ttlsec int) (bool, error) {
+	return defaultClient.TouchKV(context.Background(), scope, key, ttlsec)
+}
+
+func GetKVWithVersion(scope, key string) (string, int64, bool, error) {
+	return defaultClient.GetKVWithVersion(context.Background(), scope, key)
+}
+
+func SetKVIfNotExists(scope, key, value string, ttlsec int) (bool, error) {
+	return defaultClient.SetKVIfNotExists(context.Background(), scope, key, value, ttlsec)
+}
+
+func CompareAndSwapKV(scope, key, oldvalue, newvalue string, ttlsec int) (bool, error) {
+	return defaultClient.CompareAndSwapKV(context.Background(), scope, key, oldvalue, newvalue, ttlsec)
+}
+
+func AcquireLease(ctx context.Context, scope, name string, ttl time.Duration) (*Lease, error) {
+	return defaultClient.AcquireLease(ctx, scope, name, ttl)
+}
+
+func RunWithLeader(ctx context.Context, name string, fn func(ctx context.Context) error) error {
+	return defaultClient.RunWithLeader(ctx, name, fn)
+}
+
+func KVScope(scope string) *KV {
+	return defaultClient.KVScope(scope)
+}
+
+func GetKVMulti(scope string, keys []string) (map[string]string, error) {
+	return defaultClient.GetKVMulti(context.Background(), scope, keys)
+}
+
+func SetKVMulti(scope string, kvs map[string]string, ttlsec int) error {
+	return defaultClient.SetKVMulti(context.Background(), scope, kvs, ttlsec)
+}
+
+func DelKVMulti(scope string, keys []string) error {
+	return defaultClient.DelKVMulti(context.Background(), scope, keys)
+}
+
+func CompactString2(str string) (int, error) {
+	return defaultClient.CompactString2(context.Background(), str)
+}
+
+func UncompactString2(num int) (string, error) {
+	return defaultClient.UncompactString2(context.Background(), num)
+}
+
+func Index(col, accid, doc, part, content string, activeSec int64) {
+	defaultClient.Index(col, accid, doc, part, content, activeSec)
+}
+
+func IndexByLocale(col, accid, doc, part, content string, locale string, owners ...string) {
+	defaultClient.IndexByLocale(col, accid, doc, part, content, locale, owners...)
+}
+
+func GetConvoClient() header.ConversationMgrClient {
+	return defaultClient.GetConvoClient()
+}
+
+func OnIntegrationUpdate(connectorTypes []string, serviceid string, cb func(*header.Integration)) error {
+	return defaultClient.OnIntegrationUpdate(connectorTypes, serviceid, cb)
+}
+
+func UpdateIntegration(service string, inte *header.Integration) error {
+	return defaultClient.UpdateIntegration(context.Background(), service, inte)
+}
+
+func ActivateIntegration(service, accid, inteid string, oldaccid string) error {
+	return defaultClient.ActivateIntegration(context.Background(), service, accid, inteid, oldaccid)
+}
+
+func ClearCache() {
+	defaultClient.ClearCache()
+}
@@ -2,6 +2,7 @@ package acclient
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/hex"
 	"encoding/json"
@@ -41,15 +42,18 @@ func getApiHost(accid string) string {
 	return _apihost // == LOCALAPIHOST
 }
 
-// check if local api server is available, use that instead
-func loopfileapidomain() {
+// check if local api server is available, use that instead. Stops when ctx is done
+func loopfileapidomain(ctx context.Context) {
 	for {
 		if _apihost == LOCALAPIHOST {
-			time.Sleep(60 * time.Second)
+			if !sleepCtx(ctx, 60*time.Second) {
+				return
+			}
 			continue
 		}
 
-		if resp, _ := http.Get(LOCALAPIHOST + "/ping"); resp != nil {
+		req, _ := http.NewRequestWithContext(ctx, "GET", LOCALAPIHOST+"/ping", nil)
+		if resp, _ := httpClient.Do(req); resp != nil {
 			out, _ := io.ReadAll(resp.Body)
 			resp.Body.Close()
 			if resp.StatusCode == 200 && strings.HasPrefix(string(out), "SUBIZAPI") {
@@ -57,7 +61,9 @@ func loopfileapidomain() {
 				_apihost = LOCALAPIHOST
 			}
 		}
-		time.Sleep(60 * time.Second)
+		if !sleepCtx(ctx, 60*time.Second) {
+			return
+		}
 	}
 }
 
@@ -111,12 +117,23 @@ func newFileURLLRUCache() *expirable.LRU[string, *header.File] {
 	return expirable.NewLRU[string, *header.File](10240, nil, 10*time.Minute) // 10k
 }
 
+// The functions below have a ...Ctx variant which cancels the HTTP request
+// when ctx is done
+
 func UploadFileUrl(accid, url string) (*header.File, error) {
-	return UploadTypedFileUrl(accid, url, "", "")
+	return UploadFileUrlCtx(context.Background(), accid, url)
+}
+
+func UploadFileUrlCtx(ctx context.Context, accid, url string) (*header.File, error) {
+	return UploadTypedFileUrlCtx(ctx, accid, url, "", "")
 }
 
 func SummaryTextFile(accid, fileid string) (*header.File, error) {
-	resp, err := http.Post(getApiHost(accid)+"/4.1/files/"+fileid+"/summary?account-id="+accid, "application/json", nil)
+	return SummaryTextFileCtx(context.Background(), accid, fileid)
+}
+
+func SummaryTextFileCtx(ctx context.Context, accid, fileid string) (*header.File, error) {
+	resp, err := httpPost(ctx, getApiHost(accid)+"/4.1/files/"+fileid+"/summary?account-id="+accid, nil)
 	if err != nil {
 		return nil, log.EInternalConnect(err, log.M{"url": "/4.1/files/" + fileid + "/summary?account-id=" + accid})
 	}
@@ -136,6 +153,10 @@ func SummaryTextFile(accid, fileid string) (*header.File, error) {
 }
 
 func UploadImage(accid, url string, maxWidth, maxHeight int64) (*header.File, error) {
+	return UploadImageCtx(context.Background(), accid, url, maxWidth, maxHeight)
+}
+
+func UploadImageCtx(ctx context.Context, accid, url string, maxWidth, maxHeight int64) (*header.File, error) {
 	url = strings.TrimSpace(url)
 	if url == "" {
 		return &header.File{}, nil
@@ -154,7 +175,7 @@ func UploadImage(accid, url string, maxWidth, maxHeight int64) (*header.File, er
 		MaxHeight:  maxHeight,
 	})
 
-	resp, err := http.Post(getApiHost(accid)+"/4.0/accounts/"+accid+"/files/url/download", "application/json", bytes.NewBuffer(body))
+	resp, err := httpPost(ctx, getApiHost(accid)+"/4.0/accounts/"+accid+"/files/url/download", body)
 	if err != nil {
 		return nil, log.EInternalConnect(err, log.M{"accid": accid, "url": url, "maxwidth": maxWidth, "maxheight": maxHeight})
 	}
@@ -175,6 +196,10 @@ func UploadImage(accid, url string, maxWidth, maxHeight int64) (*header.File, er
 }
 
 func UploadTypedFileUrl(accid, url, extension, filetype string) (*header.File, error) {
+	return UploadTypedFileUrlCtx(context.Background(), accid, url, extension, filetype)
+}
+
+func UploadTypedFileUrlCtx(ctx context.Context, accid, url, extension, filetype string) (*header.File, error) {
 	url = strings.TrimSpace(url)
 	if url == "" {
 		return &header.File{}, nil
@@ -196,7 +221,7 @@ func UploadTypedFileUrl(accid, url, extension, filetype string) (*header.File, e
 		Extension: extension,
 	})
 
-	resp, err := http.Post(getApiHost(accid)+"/4.0/accounts/"+accid+"/files/url/download", "application/json", bytes.NewBuffer(body))
+	resp, err := httpPost(ctx, getApiHost(accid)+"/4.0/accounts/"+accid+"/files/url/download", body)
 	if err != nil {
 		return nil, log.EInternalConnect(err, log.M{"accid": accid, "url": url})
 	}
@@ -217,7 +242,11 @@ func UploadTypedFileUrl(accid, url, extension, filetype string) (*header.File, e
 }
 
 func UploadFile(accid, name, category string, data []byte, cd string, ttlsec int64, gentext bool) (*header.File, error) {
-	req, _ := http.NewRequest("POST", getApiHost(accid)+"/4.1/files", bytes.NewBuffer(data))
+	return UploadFileCtx(context.Background(), accid, name, category, data, cd, ttlsec, gentext)
+}
+
+func UploadFileCtx(ctx context.Context, accid, name, category string, data []byte, cd string, ttlsec int64, gentext bool) (*header.File, error) {
+	req, _ := http.NewRequestWithContext(ctx, "POST", getApiHost(accid)+"/4.1/files", bytes.NewBuffer(data))
 	q := req.URL.Query()
 	q.Add("account-id", accid)
 	q.Add("name", name)
@@ -237,7 +266,7 @@ func UploadFile(accid, name, category string, data []byte, cd string, ttlsec int
 	req.URL.RawQuery = q.Encode()
 	req.Header.Set("Content-Type", "application/octet-stream")
 	req.Header.Set("X-By", "acclient")
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return nil, log.ERetry(err, log.M{"account_id": accid})
 	}
@@ -256,9 +285,13 @@ func UploadFile(accid, name, category string, data []byte, cd string, ttlsec int
 }
 
 func HTMLContent2PDF(apikey, accid string, html []byte) ([]byte, error) {
+	return HTMLContent2PDFCtx(context.Background(), apikey, accid, html)
+}
+
+func HTMLContent2PDFCtx(ctx context.Context, apikey, accid string, html []byte) ([]byte, error) {
 	url := "https://html2pdf-457995922934.asia-southeast1.run.app/content?secret=" + apikey
-	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(html))
-	resp, err := http.DefaultClient.Do(req)
+	req, _ := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(html))
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return nil, log.ERetry(err)
 	}
@@ -273,12 +306,16 @@ func HTMLContent2PDF(apikey, accid string, html []byte) ([]byte, error) {
 
 // path must start with /
 func HTML2PDF(apikey, path, accid, filename, content_disposition string, input any) (*header.File, error) {
+	return HTML2PDFCtx(context.Background(), apikey, path, accid, filename, content_disposition, input)
+}
+
+func HTML2PDFCtx(ctx context.Context, apikey, path, accid, filename, content_disposition string, input any) (*header.File, error) {
 	body, err := json.Marshal(input)
 	if err != nil {
 		return nil, log.EData(err, nil, log.M{"account_id": accid, "path": path, "filename": filename})
 	}
 	url := "https://html2pdf-457995922934.asia-southeast1.run.app/" + path
-	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(body))
+	req, _ := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(body))
 	req.Header.Set("Content-Type", "application/json")
 
 	q := req.URL.Query()
@@ -287,14 +324,24 @@ func HTML2PDF(apikey, path, accid, filename, content_disposition string, input a
 	q.Add("account-id", accid)
 	req.URL.RawQuery = q.Encode()
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return nil, log.ERetry(err, log.M{"account_id": accid, "path": path})
 	}
 
 	defer resp.Body.Close()
 	out, _ := io.ReadAll(resp.Body)
-	return UploadFile(accid, filename, "other", out, content_disposition, 0, false)
+	return UploadFileCtx(ctx, accid, filename, "other", out, content_disposition, 0, false)
+}
+
+// httpPost is http.Post with a JSON content type, cancelled when ctx is done
+func httpPost(ctx context.Context, url string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return httpClient.Do(req)
 }
 
 func md5sum(text string) string {
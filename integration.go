@@ -55,8 +55,6 @@ import (
 // NO deleted -> activated, by connector, when user authorize
 // failed -> deleted, by convo when user delete the integration
 
-var convoclient header.ConversationMgrClient
-
 // 5 times in a row under 1 second -> loop
 type InteUpdateLog struct {
 	last  int64 // millisec
@@ -65,24 +63,44 @@ type InteUpdateLog struct {
 
 var inteUpdateLogCache = gocache.New(5 * time.Minute)
 
-func GetConvoClient() header.ConversationMgrClient {
-	if convoclient != nil {
-		return convoclient
+// GetConvoClient returns the conversation service client, connecting on
+// first use. It returns nil when the client is closed or the service cannot
+// be reached.
+func (me *Client) GetConvoClient() header.ConversationMgrClient {
+	convo, err := me.convoClient(me.ctx)
+	if err != nil {
+		log.WarnContext(me.ctx, "acclient: cannot connect to the conversation service", "addr", me.convoAddr, "err", err.Error())
+		return nil
 	}
+	return convo
+}
 
-	defer header.KLock("convolock_2482350")()
-	if convoclient != nil {
-		return convoclient
+// convoClient connects to the conversation service on first use, the
+// connection is closed by Close
+func (me *Client) convoClient(ctx context.Context) (header.ConversationMgrClient, error) {
+	me.convoLock.Lock()
+	defer me.convoLock.Unlock()
+	if me.convoclient != nil {
+		return me.convoclient, nil
 	}
 
-	conn := header.DialGrpc("convo-0.convo:18021", header.WithShardRedirect())
-	convoclient = header.NewConversationMgrClient(conn)
-	return convoclient
+	// Close takes the closers under initLock
+	me.initLock.Lock()
+	defer me.initLock.Unlock()
+	if me.ctx.Err() != nil {
+		return nil, errClosed()
+	}
+	conn, err := me.dialGrpc(ctx, me.convoAddr, header.WithShardRedirect())
+	if err != nil {
+		return nil, err
+	}
+	me.convoclient = header.NewConversationMgrClient(conn)
+	return me.convoclient, nil
 }
 
 // zaloperson-0, or fabikon-4
-func OnIntegrationUpdate(connectorTypes []string, serviceid string, cb func(*header.Integration)) error {
-	_, err := kafka.Consume("kafkaatm:9094", serviceid, "integration-updated", func(_ int32, _ int64, data []byte, _ string) {
+func (me *Client) OnIntegrationUpdate(connectorTypes []string, serviceid string, cb func(*header.Integration)) error {
+	_, err := kafka.Consume(me.kafkaBrokers, serviceid, "integration-updated", func(_ int32, _ int64, data []byte, _ string) {
 		inte := &header.Integration{}
 		proto.Unmarshal(data, inte)
 		if inte.GetAccountId() == "" {
@@ -106,9 +124,11 @@ func OnIntegrationUpdate(connectorTypes []string, serviceid string, cb func(*hea
 }
 
 // service: fabikon/zaloperson
-func UpdateIntegration(service string, inte *header.Integration) error {
+func (me *Client) UpdateIntegration(ctx context.Context, service string, inte *header.Integration) error {
+	ctx, span := me.startSpan(ctx, "UpdateIntegration", "")
+	defer span.End()
 	accid := inte.GetAccountId()
-	ctx := &cpb.Context{
+	pctx := &cpb.Context{
 		AccountId: accid,
 		Credential: &cpb.Credential{
 			Scopes:   []string{"all"},
@@ -138,23 +158,29 @@ func UpdateIntegration(service string, inte *header.Integration) error {
 	logEntry.last = now // Always update the last seen time
 
 	if logEntry.count >= 5 {
-		log.Track(context.Background(), "re-integrate-loop", "account_id", accid, "service", service, "inteid", inte.GetId())
+		log.Track(ctx, "re-integrate-loop", "account_id", accid, "service", service, "inteid", inte.GetId())
 		inteUpdateLogCache.Set(key, logEntry) // Save the updated state
 		return nil                            // loop -> stop and swallow the update
 	}
 
 	inteUpdateLogCache.Set(key, logEntry)
 
-	if _, err := GetConvoClient().UpsertIntegration(header.ToGrpcCtx(ctx), inte); err != nil {
-		log.Track(context.Background(), "re-integrate-error", "account_id", accid, "service", service, "inte", inte, "error", err.Error())
+	convo, err := me.convoClient(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err := convo.UpsertIntegration(toGrpcCtx(ctx, pctx), inte); err != nil {
+		log.Track(ctx, "re-integrate-error", "account_id", accid, "service", service, "inte", inte, "error", err.Error())
 		return err
 	}
 	return nil
 }
 
 // service zalokon, zaloperson, fabikon
-func ActivateIntegration(service, accid, inteid string, oldaccid string) error {
-	ctx := &cpb.Context{
+func (me *Client) ActivateIntegration(ctx context.Context, service, accid, inteid string, oldaccid string) error {
+	ctx, span := me.startSpan(ctx, "ActivateIntegration", accid)
+	defer span.End()
+	pctx := &cpb.Context{
 		AccountId: accid,
 		Credential: &cpb.Credential{
 			Scopes:   []string{"all"},
@@ -163,12 +189,16 @@ func ActivateIntegration(service, accid, inteid string, oldaccid string) error {
 			ClientId: service,
 		},
 	}
-	if _, err := GetConvoClient().ActivateIntegration(header.ToGrpcCtx(ctx), &header.Id{AccountId: accid, Id: inteid}); err != nil {
+	convo, err := me.convoClient(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err := convo.ActivateIntegration(toGrpcCtx(ctx, pctx), &header.Id{AccountId: accid, Id: inteid}); err != nil {
 		return err
 	}
 
 	if oldaccid != "" && oldaccid != accid {
-		ctx := &cpb.Context{
+		pctx := &cpb.Context{
 			AccountId: oldaccid,
 			Credential: &cpb.Credential{
 				Scopes:   []string{"all"},
@@ -181,13 +211,13 @@ func ActivateIntegration(service, accid, inteid string, oldaccid string) error {
 		inteids := strings.Split(inteid, ".") // acqsulrowbxiugvginhw.instagram_17841452312522417.fabikon
 		inteids[0] = oldaccid                 // swap accountid
 		oldinteid := strings.Join(inteids, ".")
-		if _, err := GetConvoClient().UpsertIntegration(header.ToGrpcCtx(ctx), &header.Integration{
+		if _, err := convo.UpsertIntegration(toGrpcCtx(ctx, pctx), &header.Integration{
 			AccountId: oldaccid,
 			Id:        oldinteid,
 			State:     "failed",
 			ErrorCode: "unlinked",
 		}); err != nil {
-			log.Track(context.Background(), "channel-activation-error", "account_id", accid, "service", service, "inteid", inteid, "error", err)
+			log.Track(ctx, "channel-activation-error", "account_id", accid, "service", service, "inteid", inteid, "error", err)
 			return err
 		}
 	}
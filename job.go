@@ -1,154 +1,420 @@
 package acclient
 
 import (
+	"context"
+	"math"
+	"strconv"
+	"strings"
 	"time"
 
-	"github.com/gocql/gocql"
 	"github.com/subiz/header"
 	"github.com/subiz/idgen"
 	"github.com/subiz/log"
 )
 
-// CREATE TABLE account.job (accid ascii, id ascii, name text, desscription text, category text, timeout_sec bigint, created bigint, force_ended bigint, ended bigint, status text, status_updated bigint, output blob, PRIMARY KEY ((accid, id)));
-
-func GetJob(accid, jobid string) *header.Job {
-	waitUntilReady()
-	var name, description, category, status string
-	var timeout_sec, created, force_ended, ended, status_updated, last_ping_ms int64
-	output := []byte{}
-	for {
-		err := session.Query(`SELECT name, description, category, timeout_sec, created, force_ended, ended, status, status_updated, output, last_ping_ms FROM account.job WHERE accid=? AND id=?`, accid, jobid).Scan(&name, &description, &category, &timeout_sec, &created, &force_ended, &ended, &status, &status_updated, &output, &last_ping_ms)
-		if err != nil && err.Error() == gocql.ErrNotFound.Error() {
-			return nil
-		}
+// Job writes and reads are retried following the client retry policy (see
+// WithRetryPolicy), the last error is returned once the policy is exhausted.
 
-		if err != nil {
-			log.ERetry(err, log.M{"account_id": accid, "jobid": jobid})
-			time.Sleep(5 * time.Second)
-			continue
-		}
+// JobInfo is a job with the fields header.Job has no room for
+type JobInfo struct {
+	*header.Job
 
-		if ended == 0 && time.Now().UnixMilli() > created+timeout_sec*1000 {
-			ended = created + timeout_sec*1000
-			if force_ended == 0 {
-				force_ended = ended
-			}
-		}
+	// set by UpdateJobProgress
+	ProgressDone  int64
+	ProgressTotal int64
+
+	// OutputUrl points to the uploaded output when it was larger than the
+	// output limit (see WithJobOutputLimit), Job.Output is then empty
+	OutputUrl string
 
-		return &header.Job{
-			AccountId:     accid,
-			Id:            jobid,
-			Name:          name,
-			Description:   description,
-			Category:      category,
-			TimeoutSec:    timeout_sec,
-			Created:       created,
-			ForceEnded:    force_ended,
-			Ended:         ended,
-			Status:        status,
-			StatusUpdated: status_updated,
-			Output:        output,
-			LastPingMs:    last_ping_ms,
+	// set for enqueued jobs, see EnqueueJob
+	Payload  []byte
+	Queued   bool
+	Worker   string // holder of the lease, "" when not leased
+	LeaseSec int64
+	Attempts int // number of claims, released ones excepted
+}
+
+// JobLog is an entry written by AppendJobLog
+type JobLog struct {
+	Created int64 // unix ms
+	Level   string
+	Message string
+}
+
+// GetJob returns nil, nil if the job does not exist. An output stored as a
+// file is downloaded into Output.
+func (me *Client) GetJob(ctx context.Context, accid, jobid string) (*header.Job, error) {
+	ctx, span := me.startSpan(ctx, "GetJob", accid)
+	defer span.End()
+	info, err := me.GetJobInfo(ctx, accid, jobid)
+	if err != nil || info == nil {
+		return nil, err
+	}
+	if info.OutputUrl != "" {
+		err := me.retry.Do(ctx, func(ctx context.Context) error {
+			var err error
+			info.Output, err = me.files.Download(ctx, info.OutputUrl)
+			return err
+		})
+		if err != nil {
+			return nil, err
 		}
 	}
+	return info.Job, nil
+}
+
+// GetJobInfo is GetJob with the progress, an output stored as a file is not
+// downloaded
+func (me *Client) GetJobInfo(ctx context.Context, accid, jobid string) (*JobInfo, error) {
+	ctx, span := me.startSpan(ctx, "GetJobInfo", accid)
+	defer span.End()
+	if err := me.waitUntilReady(ctx); err != nil {
+		return nil, err
+	}
+	var info *JobInfo
+	err := me.retry.Do(ctx, func(ctx context.Context) error {
+		var err error
+		info, err = me.store.GetJob(ctx, accid, jobid)
+		return err
+	})
+	if err != nil || info == nil {
+		return nil, err
+	}
+	expireJob(info.Job)
+	return info, nil
 }
 
-func StartJob(accid, name, description, category string, timeoutsec int64) string {
-	waitUntilReady()
+func (me *Client) StartJob(ctx context.Context, accid, name, description, category string, timeoutsec int64) (string, error) {
+	ctx, span := me.startSpan(ctx, "StartJob", accid)
+	defer span.End()
+	if err := me.waitUntilReady(ctx); err != nil {
+		return "", err
+	}
 	jobid := idgen.NewJobId()
-	for range 1000 {
-		err := session.Query(`INSERT INTO account.job(accid, id, name, description, category, timeout_sec, created) VALUES(?,?,?,?,?,?,?) USING TTL 864000`, accid, jobid, name, description, category, timeoutsec, time.Now().UnixMilli()).Exec()
-		if err != nil {
-			log.ERetry(err, log.M{"account_id": accid, "name": name, "description": description, "category": category})
-			time.Sleep(30 * time.Second)
-			continue
-		}
-		break
+	// created is set once so a retried insert does not index the job twice
+	job := &header.Job{AccountId: accid, Id: jobid, Name: name, Description: description, Category: category, TimeoutSec: timeoutsec, Created: time.Now().UnixMilli()}
+	err := me.retry.Do(ctx, func(ctx context.Context) error {
+		return me.store.InsertJob(ctx, job)
+	})
+	if err != nil {
+		return "", err
 	}
-	return jobid
+	return jobid, nil
 }
 
-func UpdateJobStatus(accid, jobid, status string) {
-	waitUntilReady()
+func (me *Client) UpdateJobStatus(ctx context.Context, accid, jobid, status string) error {
+	ctx, span := me.startSpan(ctx, "UpdateJobStatus", accid)
+	defer span.End()
+	if err := me.waitUntilReady(ctx); err != nil {
+		return err
+	}
 	updated := time.Now().UnixMilli()
-	for range 1000 {
-		err := session.Query(`INSERT INTO account.job(accid, id, status, status_updated) VALUES(?,?,?,?) USING TTL 864000`, accid, jobid, status, updated).Exec()
-		if err != nil {
-			log.ERetry(err, log.M{"account_id": accid, "jobid": jobid, "status": status})
-			time.Sleep(30 * time.Second)
-			continue
-		}
-		break
+	info, err := me.GetJobInfo(ctx, accid, jobid)
+	if err != nil {
+		return err
+	}
+	if info != nil && info.Queued {
+		return me.writeQueuedJob(ctx, info, func(ctx context.Context, worker string) (bool, error) {
+			return me.store.UpdateQueuedJobStatus(ctx, accid, jobid, worker, status, updated)
+		})
 	}
+	return me.retry.Do(ctx, func(ctx context.Context) error {
+		return me.store.UpdateJobStatus(ctx, accid, jobid, status, updated)
+	})
 }
 
 // force end -> status code -5
-func ForceEndJob(accid, jobid string) {
-	waitUntilReady()
+func (me *Client) ForceEndJob(ctx context.Context, accid, jobid string) error {
+	ctx, span := me.startSpan(ctx, "ForceEndJob", accid)
+	defer span.End()
+	if err := me.waitUntilReady(ctx); err != nil {
+		return err
+	}
 	ended := time.Now().UnixMilli()
-	for range 1000 {
-		err := session.Query(`INSERT INTO account.job(accid, id, force_ended, ended) VALUES(?,?,?,?) USING TTL 864000`, accid, jobid, ended, ended).Exec()
-		if err != nil {
-			log.ERetry(err, log.M{"account_id": accid, "job_id": jobid})
-			time.Sleep(30 * time.Second)
-			continue
+	info, err := me.GetJobInfo(ctx, accid, jobid)
+	if err != nil {
+		return err
+	}
+	if info != nil && info.Queued {
+		err = me.writeQueuedJob(ctx, info, func(ctx context.Context, worker string) (bool, error) {
+			return me.store.ForceEndQueuedJob(ctx, accid, jobid, worker, ended)
+		})
+		if err == nil {
+			err = me.retry.Do(ctx, func(ctx context.Context) error { return me.store.DequeueJob(ctx, queueEntry(info)) })
 		}
-		break
+	} else {
+		err = me.retry.Do(ctx, func(ctx context.Context) error {
+			return me.store.ForceEndJob(ctx, accid, jobid, ended)
+		})
+	}
+	if err != nil {
+		return err
+	}
+	me.fireJobEnded(ctx, accid, jobid)
+	return nil
+}
+
+// UpdateJobProgress records that done out of total units of work are done
+func (me *Client) UpdateJobProgress(ctx context.Context, accid, jobid string, done, total int64) error {
+	ctx, span := me.startSpan(ctx, "UpdateJobProgress", accid)
+	defer span.End()
+	if err := me.waitUntilReady(ctx); err != nil {
+		return err
+	}
+	updated := time.Now().UnixMilli()
+	info, err := me.GetJobInfo(ctx, accid, jobid)
+	if err != nil {
+		return err
+	}
+	if info != nil && info.Queued {
+		return me.writeQueuedJob(ctx, info, func(ctx context.Context, worker string) (bool, error) {
+			return me.store.UpdateQueuedJobProgress(ctx, accid, jobid, worker, done, total, updated)
+		})
+	}
+	return me.retry.Do(ctx, func(ctx context.Context) error {
+		return me.store.UpdateJobProgress(ctx, accid, jobid, done, total, updated)
+	})
+}
+
+// AppendJobLog adds an entry to the log of a job, level is usually info,
+// warn or error
+func (me *Client) AppendJobLog(ctx context.Context, accid, jobid, level, msg string) error {
+	ctx, span := me.startSpan(ctx, "AppendJobLog", accid)
+	defer span.End()
+	if err := me.waitUntilReady(ctx); err != nil {
+		return err
 	}
+	entry := &JobLog{Created: time.Now().UnixMilli(), Level: level, Message: msg}
+	return me.retry.Do(ctx, func(ctx context.Context) error {
+		return me.store.AppendJobLog(ctx, accid, jobid, entry)
+	})
 }
 
-func EndJob(accid, jobid, status string, output []byte) {
-	waitUntilReady()
+// ListJobLogs returns the first 1000 log entries of a job, oldest first
+func (me *Client) ListJobLogs(ctx context.Context, accid, jobid string) ([]*JobLog, error) {
+	ctx, span := me.startSpan(ctx, "ListJobLogs", accid)
+	defer span.End()
+	if err := me.waitUntilReady(ctx); err != nil {
+		return nil, err
+	}
+	var entries []*JobLog
+	err := me.retry.Do(ctx, func(ctx context.Context) error {
+		var err error
+		entries, err = me.store.ListJobLogs(ctx, accid, jobid, 1000)
+		return err
+	})
+	return entries, err
+}
+
+// EndJob ends a job, an output larger than the output limit (see
+// WithJobOutputLimit) is uploaded as a file, GetJob downloads it back.
+// Workers end the jobs they claimed with EndClaimedJob instead.
+func (me *Client) EndJob(ctx context.Context, accid, jobid, status string, output []byte) error {
+	ctx, span := me.startSpan(ctx, "EndJob", accid)
+	defer span.End()
+	if err := me.waitUntilReady(ctx); err != nil {
+		return err
+	}
+	output, outputurl, err := me.uploadJobOutput(ctx, accid, jobid, output)
+	if err != nil {
+		return err
+	}
 	ended := time.Now().UnixMilli()
-	for range 1000 {
-		err := session.Query(`INSERT INTO account.job(accid, id, status, ended, output, last_ping_ms) VALUES(?,?,?,?,?,?) USING TTL 864000`, accid, jobid, status, ended, output, ended).Exec()
-		if err != nil {
-			log.ERetry(err, log.M{"account_id": accid, "jobid": jobid, "status": status})
-			time.Sleep(30 * time.Second)
-			continue
+	info, err := me.GetJobInfo(ctx, accid, jobid)
+	if err != nil {
+		return err
+	}
+	if info != nil && info.Queued {
+		err = me.writeQueuedJob(ctx, info, func(ctx context.Context, worker string) (bool, error) {
+			return me.store.EndLeasedJob(ctx, accid, jobid, worker, status, ended, output, outputurl)
+		})
+		if err == nil {
+			err = me.retry.Do(ctx, func(ctx context.Context) error { return me.store.DequeueJob(ctx, queueEntry(info)) })
 		}
-		break
+	} else {
+		err = me.retry.Do(ctx, func(ctx context.Context) error {
+			return me.store.EndJob(ctx, accid, jobid, status, ended, output, outputurl)
+		})
+	}
+	if err != nil {
+		return err
 	}
+	me.fireJobEnded(ctx, accid, jobid)
+	return nil
+}
+
+// uploadJobOutput uploads an output larger than the output limit, it
+// returns either the output to store in the job row or the url of the file
+func (me *Client) uploadJobOutput(ctx context.Context, accid, jobid string, output []byte) ([]byte, string, error) {
+	if len(output) <= me.jobOutputLimit {
+		return output, "", nil
+	}
+	outputurl := ""
+	err := me.retry.Do(ctx, func(ctx context.Context) error {
+		// the file lives as long as the job row
+		file, err := me.files.Upload(ctx, accid, "job-"+jobid+".out", output, 864000)
+		outputurl = file.GetUrl()
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return nil, outputurl, nil
 }
 
 // return ended or job status
-func PingJob(accid, jobid string) string {
-	waitUntilReady()
+// the leases of queued jobs are renewed with RenewJobLease, not PingJob
+func (me *Client) PingJob(ctx context.Context, accid, jobid string) (string, error) {
+	ctx, span := me.startSpan(ctx, "PingJob", accid)
+	defer span.End()
+	if err := me.waitUntilReady(ctx); err != nil {
+		return "", err
+	}
 	ping := time.Now().UnixMilli()
-	var status string
-	var timeout_sec, created, force_ended, ended, last_ping_ms int64
+	var info *JobInfo
+	err := me.retry.Do(ctx, func(ctx context.Context) error {
+		var err error
+		if info, err = me.store.GetJob(ctx, accid, jobid); err != nil || info == nil || info.Queued {
+			return err
+		}
+		return me.store.PingJob(ctx, accid, jobid, ping)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if info == nil {
+		return "ended", nil
+	}
+	job := info.Job
+	expireJob(job)
+	if job.GetEnded() > 0 {
+		return "ended", nil
+	}
+	return job.GetStatus(), nil
+}
+
+const (
+	JobStateRunning  = "running"
+	JobStateEnded    = "ended" // ended or force ended
+	JobStateTimedOut = "timed_out"
+)
+
+// JobFilter selects the jobs returned by ListJobs, zero fields match all jobs
+type JobFilter struct {
+	Category string
+	Status   string
+	State    string // JobStateRunning, JobStateEnded or JobStateTimedOut
+
+	// unix ms, CreatedFrom <= created < CreatedTo
+	CreatedFrom int64
+	CreatedTo   int64
+
+	Limit  int    // page size, default 50, max 500
+	Anchor string // returned by the previous page
+}
+
+// jobListBatch is how many jobs ListJobs reads from the store at a time
+const jobListBatch = 100
 
-	for range 1000 {
-		err := session.Query(`SELECT timeout_sec, created, force_ended, ended, status, last_ping_ms FROM account.job WHERE accid=? AND id=?`, accid, jobid).Scan(&timeout_sec, &created, &force_ended, &ended, &status, &last_ping_ms)
-		if err != nil && err.Error() == gocql.ErrNotFound.Error() {
-			return "ended"
+// ListJobs returns the jobs of an account matching filter, newest first.
+// Pass the returned anchor back in filter.Anchor to read the next page, the
+// anchor is empty after the last page. Jobs are kept for 10 days.
+func (me *Client) ListJobs(ctx context.Context, accid string, filter *JobFilter) ([]*header.Job, string, error) {
+	ctx, span := me.startSpan(ctx, "ListJobs", accid)
+	defer span.End()
+	if err := me.waitUntilReady(ctx); err != nil {
+		return nil, "", err
+	}
+	if filter == nil {
+		filter = &JobFilter{}
+	}
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = 50
+	}
+	limit = min(limit, 500)
+
+	from, to := max(filter.CreatedFrom, 0), int64(math.MaxInt64)
+	if filter.CreatedTo > 0 {
+		to = filter.CreatedTo - 1
+	}
+	beforeid := ""
+	if filter.Anchor != "" {
+		created, id, ok := strings.Cut(filter.Anchor, "-")
+		anchorcreated, err := strconv.ParseInt(created, 10, 64)
+		if !ok || err != nil || id == "" {
+			return nil, "", log.NewError(err, log.M{"account_id": accid, "anchor": filter.Anchor}, log.E_invalid_input)
 		}
+		if anchorcreated <= to {
+			to, beforeid = anchorcreated, id
+		}
+	}
 
+	now := time.Now().UnixMilli()
+	jobs := []*header.Job{}
+	more := true
+	for more && len(jobs) < limit {
+		var batch []*header.Job
+		var last *header.Job
+		err := me.retry.Do(ctx, func(ctx context.Context) error {
+			var err error
+			batch, last, err = me.store.ListJobs(ctx, accid, from, to, beforeid, jobListBatch)
+			return err
+		})
 		if err != nil {
-			log.ERetry(err, log.M{"account_id": accid, "jobid": jobid})
-			time.Sleep(5 * time.Second)
-			continue
+			return nil, "", err
 		}
-
-		if ended == 0 && time.Now().UnixMilli() > created+timeout_sec*1000 {
-			ended = created + timeout_sec*1000
-			if force_ended == 0 {
-				force_ended = ended
+		more = last != nil
+		for i, job := range batch {
+			to, beforeid = job.GetCreated(), job.GetId()
+			if matchJob(job, filter, now) {
+				expireJob(job)
+				jobs = append(jobs, job)
+			}
+			if len(jobs) == limit {
+				more = more || i < len(batch)-1
+				break
 			}
 		}
-
-		err = session.Query(`INSERT INTO account.job(accid, id, last_ping_ms) VALUES(?,?,?) USING TTL 864000`, accid, jobid, ping).Exec()
-		if err != nil {
-			log.ERetry(err, log.M{"account_id": accid, "jobid": jobid})
-			time.Sleep(30 * time.Second)
-			continue
+		if len(jobs) < limit && last != nil {
+			// skip the index entries of expired jobs too
+			to, beforeid = last.GetCreated(), last.GetId()
 		}
-		break
 	}
 
-	if ended > 0 {
-		return "ended"
+	if !more {
+		return jobs, "", nil
+	}
+	return jobs, strconv.FormatInt(to, 10) + "-" + beforeid, nil
+}
+
+func matchJob(job *header.Job, filter *JobFilter, now int64) bool {
+	if filter.Category != "" && job.GetCategory() != filter.Category {
+		return false
+	}
+	if filter.Status != "" && job.GetStatus() != filter.Status {
+		return false
 	}
+	if filter.State == "" {
+		return true
+	}
+	state := JobStateRunning
+	if job.GetEnded() > 0 {
+		state = JobStateEnded
+	} else if now > job.GetCreated()+job.GetTimeoutSec()*1000 {
+		state = JobStateTimedOut
+	}
+	return state == filter.State
+}
 
-	return status
+// expireJob marks a job that ran past its timeout as force ended
+func expireJob(job *header.Job) {
+	if job != nil && job.Ended == 0 && time.Now().UnixMilli() > job.Created+job.TimeoutSec*1000 {
+		job.Ended = job.Created + job.TimeoutSec*1000
+		if job.ForceEnded == 0 {
+			job.ForceEnded = job.Ended
+		}
+	}
 }
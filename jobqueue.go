@@ -0,0 +1,301 @@
+package acclient
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/subiz/header"
+	"github.com/subiz/idgen"
+	"github.com/subiz/log"
+)
+
+// JobStatusDead ends a queued job whose lease expired too many times, see
+// WithJobMaxAttempts
+const JobStatusDead = "dead"
+
+// ErrJobLeaseLost is returned to a worker which no longer holds the lease of
+// a claimed job, by RenewJobLease, EndClaimedJob and ReleaseJob
+var ErrJobLeaseLost = errors.New("acclient: job lease lost")
+
+// queued jobs wait at most as long as the job row lives
+const queuedJobTimeoutSec = 864000
+
+// queueScanLimit is how many queue entries ClaimJob reads at a time
+const queueScanLimit = 100
+
+// queueDayMs is the time span of a queue partition, see Store.ListQueuedJobs
+const queueDayMs = 24 * 3600 * 1000
+
+// EnqueueJob adds a job to the queue of category, a worker gets it back with
+// its payload from ClaimJob
+func (me *Client) EnqueueJob(ctx context.Context, accid, category string, payload []byte) (string, error) {
+	ctx, span := me.startSpan(ctx, "EnqueueJob", accid)
+	defer span.End()
+	if err := me.waitUntilReady(ctx); err != nil {
+		return "", err
+	}
+	jobid := idgen.NewJobId()
+	job := &JobInfo{
+		Job:     &header.Job{AccountId: accid, Id: jobid, Name: category, Category: category, TimeoutSec: queuedJobTimeoutSec, Created: time.Now().UnixMilli()},
+		Payload: payload,
+		Queued:  true,
+	}
+	err := me.retry.Do(ctx, func(ctx context.Context) error {
+		return me.store.EnqueueJob(ctx, job)
+	})
+	if err != nil {
+		return "", err
+	}
+	return jobid, nil
+}
+
+// ClaimJob leases the oldest available job of category to workerid for
+// leasesec seconds, it returns nil, nil when no job is available.
+//
+// The worker renews the lease with RenewJobLease and finishes with
+// EndClaimedJob, or gives the job back with ReleaseJob. A lease without
+// renewal for leasesec expires and the job is claimed again. A job whose
+// lease expired as many times as the client max attempts (see
+// WithJobMaxAttempts) is ended with JobStatusDead.
+func (me *Client) ClaimJob(ctx context.Context, category, workerid string, leasesec int64) (*JobInfo, error) {
+	ctx, span := me.startSpan(ctx, "ClaimJob", "")
+	defer span.End()
+	if err := me.waitUntilReady(ctx); err != nil {
+		return nil, err
+	}
+
+	today := time.Now().UnixMilli() / queueDayMs
+	for day := today - queuedJobTimeoutSec*1000/queueDayMs; day <= today; day++ {
+		var after *header.Job
+		for {
+			var entries []*JobInfo
+			err := me.retry.Do(ctx, func(ctx context.Context) error {
+				var err error
+				entries, err = me.store.ListQueuedJobs(ctx, category, day, after, queueScanLimit)
+				return err
+			})
+			if err != nil {
+				return nil, err
+			}
+			for _, entry := range entries {
+				if job := me.claimQueuedJob(ctx, entry, workerid, leasesec); job != nil {
+					return job, nil
+				}
+			}
+			if len(entries) < queueScanLimit {
+				break
+			}
+			after = entries[len(entries)-1].Job
+		}
+	}
+	return nil, nil
+}
+
+// claimQueuedJob leases the job of a queue entry to workerid, it returns nil
+// when the job is leased to someone else or cannot be claimed. Failures are
+// logged and skipped, so one bad job does not block the queue.
+func (me *Client) claimQueuedJob(ctx context.Context, entry *JobInfo, workerid string, leasesec int64) *JobInfo {
+	now := time.Now().UnixMilli()
+	if entry.Worker != "" && now <= entry.GetLastPingMs()+entry.LeaseSec*1000 {
+		return nil // leased, as far as the queue knows
+	}
+	job, err := me.claimJob(ctx, entry.Job, workerid, now, leasesec)
+	if err != nil {
+		log.WarnContext(ctx, "acclient: cannot claim queued job", "account_id", entry.GetAccountId(), "job_id", entry.GetId(), "err", err.Error())
+		return nil
+	}
+	return job
+}
+
+func (me *Client) claimJob(ctx context.Context, entry *header.Job, workerid string, now, leasesec int64) (*JobInfo, error) {
+	job, err := me.GetJobInfo(ctx, entry.GetAccountId(), entry.GetId())
+	if err != nil {
+		return nil, err
+	}
+	if job == nil || job.GetEnded() > 0 {
+		// jobs ended without EndJob or EndClaimedJob leave the queue lazily
+		return nil, me.retry.Do(ctx, func(ctx context.Context) error { return me.store.DequeueJob(ctx, entry) })
+	}
+
+	if job.Worker != "" && now <= job.GetLastPingMs()+job.LeaseSec*1000 {
+		// the queue entry missed a claim or a renewal
+		me.setQueuedJobLease(ctx, job)
+		return nil, nil
+	}
+	var claimed bool
+	err = me.retry.Do(ctx, func(ctx context.Context) error {
+		var err error
+		claimed, err = me.store.SetJobWorker(ctx, job.GetAccountId(), job.GetId(), job.Worker, job.GetLastPingMs(), workerid, now, leasesec, job.Attempts+1)
+		return err
+	})
+	if err != nil || !claimed {
+		return nil, err // another worker was faster
+	}
+	job.Worker, job.LastPingMs, job.LeaseSec, job.Attempts = workerid, now, leasesec, job.Attempts+1
+	if job.Attempts > me.jobMaxAttempts {
+		err := me.EndClaimedJob(ctx, job.GetAccountId(), job.GetId(), workerid, JobStatusDead, nil)
+		if errors.Is(err, ErrJobLeaseLost) {
+			err = nil
+		}
+		return nil, err
+	}
+	me.setQueuedJobLease(ctx, job)
+	return job, nil
+}
+
+// setQueuedJobLease copies the lease of a queued job to its queue entry, a
+// failure only costs ClaimJob a read of the job
+func (me *Client) setQueuedJobLease(ctx context.Context, job *JobInfo) {
+	if err := me.store.SetQueuedJobLease(ctx, queueEntry(job), job.Worker, job.GetLastPingMs(), job.LeaseSec); err != nil {
+		log.WarnContext(ctx, "acclient: cannot set queued job lease", "account_id", job.GetAccountId(), "job_id", job.GetId(), "err", err.Error())
+	}
+}
+
+// RenewJobLease extends the lease of a claimed job for another lease
+// duration, it returns "ended" or the job status like PingJob, and fails
+// with ErrJobLeaseLost when the job is no longer leased to workerid
+func (me *Client) RenewJobLease(ctx context.Context, accid, jobid, workerid string) (string, error) {
+	ctx, span := me.startSpan(ctx, "RenewJobLease", accid)
+	defer span.End()
+	if err := me.waitUntilReady(ctx); err != nil {
+		return "", err
+	}
+	job, err := me.GetJobInfo(ctx, accid, jobid)
+	if err != nil {
+		return "", err
+	}
+	if job == nil || job.GetEnded() > 0 {
+		return "ended", nil
+	}
+	if job.Worker != workerid {
+		return "", ErrJobLeaseLost
+	}
+
+	ping := time.Now().UnixMilli()
+	var renewed bool
+	err = me.retry.Do(ctx, func(ctx context.Context) error {
+		var err error
+		renewed, err = me.store.RenewJobLease(ctx, accid, jobid, workerid, ping)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	if !renewed {
+		return "", ErrJobLeaseLost
+	}
+	job.LastPingMs = ping
+	me.setQueuedJobLease(ctx, job)
+	return job.GetStatus(), nil
+}
+
+// EndClaimedJob is EndJob for a job claimed by workerid, it fails with
+// ErrJobLeaseLost when the job is no longer leased to workerid. The job
+// leaves the queue.
+func (me *Client) EndClaimedJob(ctx context.Context, accid, jobid, workerid, status string, output []byte) error {
+	ctx, span := me.startSpan(ctx, "EndClaimedJob", accid)
+	defer span.End()
+	if err := me.waitUntilReady(ctx); err != nil {
+		return err
+	}
+	job, err := me.GetJobInfo(ctx, accid, jobid)
+	if err != nil {
+		return err
+	}
+	if job == nil || job.Worker != workerid {
+		return ErrJobLeaseLost
+	}
+	output, outputurl, err := me.uploadJobOutput(ctx, accid, jobid, output)
+	if err != nil {
+		return err
+	}
+
+	ended := time.Now().UnixMilli()
+	var done bool
+	err = me.retry.Do(ctx, func(ctx context.Context) error {
+		var err error
+		if done, err = me.store.EndLeasedJob(ctx, accid, jobid, workerid, status, ended, output, outputurl); err != nil || done {
+			return err
+		}
+		// an attempt which timed out may have ended the job already
+		latest, err := me.store.GetJob(ctx, accid, jobid)
+		done = latest != nil && latest.GetEnded() == ended && latest.GetStatus() == status
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if !done {
+		return ErrJobLeaseLost
+	}
+	if err := me.retry.Do(ctx, func(ctx context.Context) error { return me.store.DequeueJob(ctx, queueEntry(job)) }); err != nil {
+		return err
+	}
+	me.fireJobEnded(ctx, accid, jobid)
+	return nil
+}
+
+// ReleaseJob gives a claimed job back to the queue so another worker can
+// claim it right away, the claim does not count as an attempt. It fails
+// with ErrJobLeaseLost if the lease expired and the job was claimed again.
+func (me *Client) ReleaseJob(ctx context.Context, accid, jobid, workerid string) error {
+	ctx, span := me.startSpan(ctx, "ReleaseJob", accid)
+	defer span.End()
+	job, err := me.GetJobInfo(ctx, accid, jobid)
+	if err != nil {
+		return err
+	}
+	if job == nil || job.GetEnded() > 0 || job.Worker != workerid {
+		return ErrJobLeaseLost
+	}
+
+	var released bool
+	err = me.retry.Do(ctx, func(ctx context.Context) error {
+		var err error
+		released, err = me.store.ReleaseJobLease(ctx, accid, jobid, workerid, max(job.Attempts-1, 0))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if !released {
+		return ErrJobLeaseLost
+	}
+	job.Worker, job.LastPingMs, job.LeaseSec = "", 0, 0
+	me.setQueuedJobLease(ctx, job)
+	return nil
+}
+
+// queuedJobWriteAttempts bounds the conditional writes of a queued job
+// racing with claims and releases
+const queuedJobWriteAttempts = 5
+
+// writeQueuedJob applies write, a lightweight transaction conditional on the
+// worker of the job, rereading the worker when a claim or a release changed
+// it meanwhile. Every write of a queued job is conditional, Cassandra does
+// not order lightweight transactions with plain writes.
+func (me *Client) writeQueuedJob(ctx context.Context, job *JobInfo, write func(ctx context.Context, worker string) (bool, error)) error {
+	for attempt := 1; ; attempt++ {
+		var applied bool
+		err := me.retry.Do(ctx, func(ctx context.Context) error {
+			var err error
+			applied, err = write(ctx, job.Worker)
+			return err
+		})
+		if err != nil || applied {
+			return err
+		}
+		if attempt >= queuedJobWriteAttempts {
+			return log.ERetry(nil, log.M{"account_id": job.GetAccountId(), "job_id": job.GetId(), "reason": "the job lease keeps changing"})
+		}
+		if job, err = me.GetJobInfo(ctx, job.GetAccountId(), job.GetId()); err != nil || job == nil {
+			return err
+		}
+	}
+}
+
+// queueEntry returns the queue entry of a queued job
+func queueEntry(job *JobInfo) *header.Job {
+	return &header.Job{AccountId: job.GetAccountId(), Id: job.GetId(), Category: job.GetCategory(), Created: job.GetCreated()}
+}
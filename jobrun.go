@@ -0,0 +1,126 @@
+package acclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"strconv"
+	"time"
+
+	"github.com/subiz/log"
+)
+
+const (
+	JobStatusDone   = "done"
+	JobStatusFailed = "failed"
+)
+
+// ErrJobEnded is the cause of the work context of RunJob when the job was
+// force ended or ran past its timeout
+var ErrJobEnded = errors.New("acclient: job ended")
+
+// JobHandle is given to the function run by RunJob
+type JobHandle struct {
+	AccountId string
+	Id        string
+
+	client *Client
+	ctx    context.Context
+}
+
+// Progress writes the job status as "<pct>% <msg>"
+func (me *JobHandle) Progress(pct int, msg string) error {
+	status := strconv.Itoa(pct) + "%"
+	if msg != "" {
+		status += " " + msg
+	}
+	return me.client.UpdateJobStatus(me.ctx, me.AccountId, me.Id, status)
+}
+
+// SetProgress records that done out of total units of work are done
+func (me *JobHandle) SetProgress(done, total int64) error {
+	return me.client.UpdateJobProgress(me.ctx, me.AccountId, me.Id, done, total)
+}
+
+// Log adds an entry to the job log, see AppendJobLog
+func (me *JobHandle) Log(level, msg string) error {
+	return me.client.AppendJobLog(me.ctx, me.AccountId, me.Id, level, msg)
+}
+
+// RunJob starts a job then calls fn in the current goroutine while pinging
+// the job in the background. The ctx given to fn is cancelled with cause
+// ErrJobEnded when the job is force ended (see ForceEndJob) or times out.
+//
+// When fn returns, the job is ended with status JobStatusDone and fn's
+// output, or JobStatusFailed and the error message if fn failed or
+// panicked. A job ended by someone else is left untouched. RunJob returns
+// the job id and fn's error.
+func (me *Client) RunJob(ctx context.Context, accid, name, category string, timeout time.Duration, fn func(ctx context.Context, job *JobHandle) ([]byte, error)) (string, error) {
+	ctx, span := me.startSpan(ctx, "RunJob", accid)
+	defer span.End()
+	if timeout < time.Second {
+		return "", log.NewError(nil, log.M{"account_id": accid, "timeout": timeout.String()}, log.E_invalid_input)
+	}
+	jobid, err := me.StartJob(ctx, accid, name, "", category, int64(timeout/time.Second))
+	if err != nil {
+		return "", err
+	}
+
+	workctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	workctx, cancelTimeout := context.WithTimeoutCause(workctx, timeout, ErrJobEnded)
+	defer cancelTimeout()
+
+	stopPing, pingStopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(pingStopped)
+		ticker := time.NewTicker(min(max(timeout/3, 100*time.Millisecond), 30*time.Second))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopPing:
+				return
+			case <-workctx.Done():
+				return
+			case <-ticker.C:
+			}
+			// ping errors are transient, the next tick retries
+			if status, err := me.PingJob(workctx, accid, jobid); err == nil && status == "ended" {
+				cancel(ErrJobEnded)
+				return
+			}
+		}
+	}()
+
+	handle := &JobHandle{AccountId: accid, Id: jobid, client: me, ctx: workctx}
+	output, err := runJobFunc(workctx, handle, fn)
+	close(stopPing)
+	<-pingStopped
+
+	if errors.Is(context.Cause(workctx), ErrJobEnded) {
+		if err == nil {
+			err = ErrJobEnded
+		}
+		return jobid, err
+	}
+
+	status := JobStatusDone
+	if err != nil {
+		status, output = JobStatusFailed, []byte(err.Error())
+	}
+	// the job must be ended even if the caller has given up
+	if enderr := me.EndJob(context.WithoutCancel(ctx), accid, jobid, status, output); enderr != nil && err == nil {
+		err = enderr
+	}
+	return jobid, err
+}
+
+func runJobFunc(ctx context.Context, job *JobHandle, fn func(ctx context.Context, job *JobHandle) ([]byte, error)) (output []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = log.EServer(nil, log.M{"account_id": job.AccountId, "job_id": job.Id, "panic": fmt.Sprint(r), "stack": string(debug.Stack())})
+		}
+	}()
+	return fn(ctx, job)
+}
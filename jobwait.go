@@ -0,0 +1,169 @@
+package acclient
+
+import (
+	"context"
+	"time"
+
+	"github.com/subiz/header"
+	"google.golang.org/protobuf/proto"
+)
+
+// jobEndedTopic is fired by EndJob and ForceEndJob, the event id is the job id
+const jobEndedTopic = "job_ended"
+
+// jobRecheckInterval is how often a job which could not be read is checked
+// again for its waiters
+const jobRecheckInterval = 5 * time.Second
+
+// jobWaiter is a callback registered by OnJobEnded
+type jobWaiter struct {
+	cb    func(*header.Job)
+	timer *time.Timer // fires when the job times out, which fires no event
+}
+
+// OnJobEnded calls cb once, in its own goroutine, when the job ends, is force
+// ended or times out. cb receives nil if the job no longer exists. ctx only
+// bounds the registration, call the returned cancel to drop cb before the
+// job ends.
+//
+// Ends are learned from pubsub events fired by EndJob and ForceEndJob, so cb
+// runs about a second after the job ends.
+func (me *Client) OnJobEnded(ctx context.Context, accid, jobid string, cb func(*header.Job)) (func(), error) {
+	ctx, span := me.startSpan(ctx, "OnJobEnded", accid)
+	defer span.End()
+	if err := me.waitUntilReady(ctx); err != nil {
+		return nil, err
+	}
+	// subscribe before reading the job so an end in between is not missed
+	me.subscribe(accid, jobEndedTopic)
+
+	key := accid + "/" + jobid
+	w := &jobWaiter{cb: cb}
+	me.jobWaiterLock.Lock()
+	if me.jobWaiters[key] == nil {
+		me.jobWaiters[key] = map[*jobWaiter]bool{}
+	}
+	me.jobWaiters[key][w] = true
+	me.jobWaiterLock.Unlock()
+	cancel := func() {
+		me.jobWaiterLock.Lock()
+		defer me.jobWaiterLock.Unlock()
+		if w.timer != nil {
+			w.timer.Stop()
+		}
+		delete(me.jobWaiters[key], w)
+		if len(me.jobWaiters[key]) == 0 {
+			delete(me.jobWaiters, key)
+		}
+	}
+
+	job, err := me.GetJob(ctx, accid, jobid)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if job == nil || job.GetEnded() > 0 {
+		me.endJobWaiters(key, job)
+		return cancel, nil
+	}
+
+	timeout := time.Until(time.UnixMilli(job.GetCreated()+job.GetTimeoutSec()*1000)) + 100*time.Millisecond
+	me.jobWaiterLock.Lock()
+	if me.jobWaiters[key][w] {
+		w.timer = time.AfterFunc(timeout, func() {
+			if !me.checkJobEnded(accid, jobid) {
+				me.jobWaiterLock.Lock()
+				if me.jobWaiters[key][w] {
+					w.timer.Reset(jobRecheckInterval)
+				}
+				me.jobWaiterLock.Unlock()
+			}
+		})
+	}
+	me.jobWaiterLock.Unlock()
+	return cancel, nil
+}
+
+// WaitJob blocks until the job ends, is force ended or times out, then
+// returns it. It returns nil, nil if the job does not exist.
+func (me *Client) WaitJob(ctx context.Context, accid, jobid string) (*header.Job, error) {
+	ctx, span := me.startSpan(ctx, "WaitJob", accid)
+	defer span.End()
+	ended := make(chan *header.Job, 1)
+	cancel, err := me.OnJobEnded(ctx, accid, jobid, func(job *header.Job) { ended <- job })
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+
+	select {
+	case job := <-ended:
+		return job, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// checkJobEnded calls the waiters of the job if it has ended. It returns
+// false when the job could not be read and should be checked again.
+func (me *Client) checkJobEnded(accid, jobid string) bool {
+	key := accid + "/" + jobid
+	me.jobWaiterLock.Lock()
+	waiting := len(me.jobWaiters[key]) > 0
+	me.jobWaiterLock.Unlock()
+	if !waiting || me.ctx.Err() != nil {
+		return true
+	}
+
+	job, err := me.GetJob(me.ctx, accid, jobid)
+	if err != nil {
+		return false
+	}
+	if job == nil || job.GetEnded() > 0 {
+		me.endJobWaiters(key, job)
+	}
+	return true
+}
+
+// recheckJobEnded is checkJobEnded, repeated every jobRecheckInterval until
+// the job can be read or the client is closed
+func (me *Client) recheckJobEnded(accid, jobid string) {
+	for !me.checkJobEnded(accid, jobid) && sleepCtx(me.ctx, jobRecheckInterval) {
+	}
+}
+
+func (me *Client) endJobWaiters(key string, job *header.Job) {
+	me.jobWaiterLock.Lock()
+	waiters := me.jobWaiters[key]
+	delete(me.jobWaiters, key)
+	// timers are set and reset under the lock
+	for w := range waiters {
+		if w.timer != nil {
+			w.timer.Stop()
+		}
+	}
+	me.jobWaiterLock.Unlock()
+
+	for w := range waiters {
+		var clone *header.Job
+		if job != nil {
+			clone = proto.Clone(job).(*header.Job)
+		}
+		go w.cb(clone)
+	}
+}
+
+// fireJobEnded wakes the OnJobEnded waiters of every client, a lost event
+// only delays waiters until the job times out
+func (me *Client) fireJobEnded(ctx context.Context, accid, jobid string) {
+	me.numpubsub.Fire(ctx, &header.PsMessage{
+		AccountId: accid,
+		Event: &header.Event{
+			AccountId: accid,
+			Id:        jobid,
+			Type:      jobEndedTopic,
+			Created:   time.Now().UnixMilli(),
+		},
+		Topics: []string{jobEndedTopic + "." + accid},
+	})
+}
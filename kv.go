@@ -1,10 +1,22 @@
 package acclient
 
 import (
-	"github.com/gocql/gocql"
-	"github.com/subiz/log"
+	"context"
+	"fmt"
+	"sort"
+	"sync"
 )
 
+// DefaultKVTTL is the ttl in seconds SetKV gives keys, 60 days
+const DefaultKVTTL = 5184000
+
+// KVNoExpiry is the ttl of keys which never expire
+const KVNoExpiry = 0
+
+// kvConcurrency is how many keys the multi-key operations work on at the
+// same time
+const kvConcurrency = 16
+
 // Get returns the value matched the provided key
 // Note that this function dont return error when the value is not existed. Instead,
 // it returns an empty value "" and a boolean `true` indicate that the value is empty
@@ -14,37 +26,30 @@ import (
 // E.g: kvclient.Set("user", "324234", "onetwothree")
 //
 //	kvclient.Get("user", "324234") => "onetwothree"
-func GetKV(scope, key string) (string, bool, error) {
-	waitUntilReady()
-	key = scope + "@" + key
-	var val string
-	err := session.Query(`SELECT v FROM kv.kv WHERE k=?`, key).Scan(&val)
-	if err != nil && err.Error() == gocql.ErrNotFound.Error() {
-		return "", false, nil
+func (me *Client) GetKV(ctx context.Context, scope, key string) (string, bool, error) {
+	ctx, span := me.startSpan(ctx, "GetKV", "")
+	defer span.End()
+	if err := me.waitUntilReady(ctx); err != nil {
+		return "", false, err
 	}
-
-	if err != nil {
-		return "", false, log.ERetry(err, log.M{"scope": scope, "key": key})
-	}
-
-	return val, true, nil
+	key = scope + "@" + key
+	return me.store.GetKV(ctx, key)
 }
 
-// Set puts a new key-value pair to the database
+// Set puts a new key-value pair to the database, it expires after 60 days
+// unless the client is created with WithKVTTL
 // scope is a required paramenter, used as a namespace to prevent collision between
 // multiple services while using this lib concurrently.
 // E.g: kvclient.Set("user", "324234", "onetwothree")
 // E.g: kvclient.Set("account", "324234", "onetwothree")
-func SetKV(scope, key, value string) error {
-	waitUntilReady()
-	key = scope + "@" + key
-	// ttl 60 days
-	err := session.Query(`INSERT INTO kv.kv(k,v) VALUES(?,?) USING TTL 5184000`, key, value).Exec()
-	if err != nil {
-		return log.ERetry(err, log.M{"scope": scope, "key": key, "value": value})
+func (me *Client) SetKV(ctx context.Context, scope, key, value string) error {
+	ctx, span := me.startSpan(ctx, "SetKV", "")
+	defer span.End()
+	if err := me.waitUntilReady(ctx); err != nil {
+		return err
 	}
-
-	return nil
+	key = scope + "@" + key
+	return me.store.SetKV(ctx, key, value, me.kvTTL)
 }
 
 // Set puts a new key-value pair to the database
@@ -52,28 +57,210 @@ func SetKV(scope, key, value string) error {
 // multiple services while using this lib concurrently.
 // E.g: kvclient.Set("user", "324234", "onetwothree")
 // E.g: kvclient.Set("account", "324234", "onetwothree")
-func SetKVTTL(scope, key, value string, ttlsec int) error {
-	waitUntilReady()
-	key = scope + "@" + key
-	// ttl 60 days
-	err := session.Query(`INSERT INTO kv.kv(k,v) VALUES(?,?) USING TTL ?`, key, value, ttlsec).Exec()
-	if err != nil {
-		return log.ERetry(err, log.M{"scope": scope, "key": key, "value": value, "ttl_sec": ttlsec})
+// ttlsec KVNoExpiry keeps the key forever
+func (me *Client) SetKVTTL(ctx context.Context, scope, key, value string, ttlsec int) error {
+	ctx, span := me.startSpan(ctx, "SetKVTTL", "")
+	defer span.End()
+	if err := me.waitUntilReady(ctx); err != nil {
+		return err
 	}
-
-	return nil
+	key = scope + "@" + key
+	return me.store.SetKV(ctx, key, value, ttlsec)
 }
 
 // Del removes key from the database
 // scope is a required paramenter, used as a namespace to prevent collision between
 // multiple services while using this lib concurrently.
 // E.g: kvclient.Del("user", "324234")
-func DelKV(scope, key string) error {
-	waitUntilReady()
+func (me *Client) DelKV(ctx context.Context, scope, key string) error {
+	ctx, span := me.startSpan(ctx, "DelKV", "")
+	defer span.End()
+	if err := me.waitUntilReady(ctx); err != nil {
+		return err
+	}
+	key = scope + "@" + key
+	return me.store.DelKV(ctx, key)
+}
+
+// GetKVTTL returns the remaining ttl of the key in seconds, KVNoExpiry if
+// it never expires. found is false when the key does not exist.
+func (me *Client) GetKVTTL(ctx context.Context, scope, key string) (int, bool, error) {
+	ctx, span := me.startSpan(ctx, "GetKVTTL", "")
+	defer span.End()
+	if err := me.waitUntilReady(ctx); err != nil {
+		return 0, false, err
+	}
+	key = scope + "@" + key
+	return me.store.GetKVTTL(ctx, key)
+}
+
+// TouchKV sets the ttl of the key to ttlsec (KVNoExpiry keeps it forever)
+// without changing its value, it returns false when the key does not exist.
+// The touch is a plain write, not a conditional one: a write of the key made
+// at the same time wins over it and keeps its own ttl.
+func (me *Client) TouchKV(ctx context.Context, scope, key string, ttlsec int) (bool, error) {
+	ctx, span := me.startSpan(ctx, "TouchKV", "")
+	defer span.End()
+	if err := me.waitUntilReady(ctx); err != nil {
+		return false, err
+	}
+	key = scope + "@" + key
+	value, version, found, err := me.store.GetKVVersion(ctx, key)
+	if err != nil || !found {
+		return false, err
+	}
+	return true, me.store.TouchKV(ctx, key, value, version, ttlsec)
+}
+
+// GetKVWithVersion is GetKV which also returns the version of the value, the
+// write time in microseconds. It tells whether a key written only by
+// conditional writes (SetKVIfNotExists, CompareAndSwapKV) changed between
+// two reads, those always get increasing versions. Blind writes (SetKV,
+// TouchKV) are stamped with the clock of the writer, their versions may not
+// increase.
+//
+// No write is conditional on the version: CompareAndSwapKV compares values,
+// so a value changed then changed back passes. Keep a counter in the value
+// when that matters.
+func (me *Client) GetKVWithVersion(ctx context.Context, scope, key string) (string, int64, bool, error) {
+	ctx, span := me.startSpan(ctx, "GetKVWithVersion", "")
+	defer span.End()
+	if err := me.waitUntilReady(ctx); err != nil {
+		return "", 0, false, err
+	}
+	key = scope + "@" + key
+	return me.store.GetKVVersion(ctx, key)
+}
+
+// SetKVIfNotExists puts a new key-value pair to the database unless the key
+// exists, it returns false in that case. Use it for idempotency markers.
+func (me *Client) SetKVIfNotExists(ctx context.Context, scope, key, value string, ttlsec int) (bool, error) {
+	ctx, span := me.startSpan(ctx, "SetKVIfNotExists", "")
+	defer span.End()
+	if err := me.waitUntilReady(ctx); err != nil {
+		return false, err
+	}
 	key = scope + "@" + key
-	err := session.Query(`DELETE FROM kv.kv WHERE k=?`, key).Exec()
-	if err != nil {
-		return log.ERetry(err, log.M{"scope": scope, "key": key})
+	return me.store.InsertKVIfNotExists(ctx, key, value, ttlsec)
+}
+
+// CompareAndSwapKV sets the key to newvalue only if its value is still
+// oldvalue, it returns false otherwise or when the key does not exist.
+// E.g: a counter
+//
+//	kvclient.SetKVIfNotExists("user", "counter", "0", 0)
+//	for {
+//		val, _, _ := kvclient.GetKV("user", "counter")
+//		n, _ := strconv.Atoi(val)
+//		if ok, _ := kvclient.CompareAndSwapKV("user", "counter", val, strconv.Itoa(n+1), 0); ok {
+//			break
+//		}
+//	}
+//
+// Conditional writes and blind writes (SetKV, DelKV) of the same key must
+// not be mixed, Cassandra does not order them.
+func (me *Client) CompareAndSwapKV(ctx context.Context, scope, key, oldvalue, newvalue string, ttlsec int) (bool, error) {
+	ctx, span := me.startSpan(ctx, "CompareAndSwapKV", "")
+	defer span.End()
+	if err := me.waitUntilReady(ctx); err != nil {
+		return false, err
+	}
+	key = scope + "@" + key
+	return me.store.CompareAndSwapKV(ctx, key, oldvalue, newvalue, ttlsec)
+}
+
+// KVErrors maps the keys a multi-key operation failed on to their errors
+type KVErrors map[string]error
+
+func (me KVErrors) Error() string {
+	keys := make([]string, 0, len(me))
+	for key := range me {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if len(keys) == 0 {
+		return "acclient: no key failed"
+	}
+	return fmt.Sprintf("acclient: %d keys failed, %s: %v", len(keys), keys[0], me[keys[0]])
+}
+
+// GetKVMulti returns the values of the keys found, missing keys are left out.
+// The keys are fetched concurrently, when some fail the others are still
+// returned along with a KVErrors.
+func (me *Client) GetKVMulti(ctx context.Context, scope string, keys []string) (map[string]string, error) {
+	ctx, span := me.startSpan(ctx, "GetKVMulti", "")
+	defer span.End()
+	if err := me.waitUntilReady(ctx); err != nil {
+		return nil, err
+	}
+	lock := &sync.Mutex{}
+	values := make(map[string]string, len(keys))
+	err := forEachKey(keys, func(key string) error {
+		val, found, err := me.store.GetKV(ctx, scope+"@"+key)
+		if err != nil || !found {
+			return err
+		}
+		lock.Lock()
+		values[key] = val
+		lock.Unlock()
+		return nil
+	})
+	return values, err
+}
+
+// SetKVMulti puts the key-value pairs to the database, ttlsec is the same as
+// in SetKVTTL. The keys which could not be set are reported in a KVErrors.
+func (me *Client) SetKVMulti(ctx context.Context, scope string, kvs map[string]string, ttlsec int) error {
+	ctx, span := me.startSpan(ctx, "SetKVMulti", "")
+	defer span.End()
+	if err := me.waitUntilReady(ctx); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(kvs))
+	for key := range kvs {
+		keys = append(keys, key)
+	}
+	return forEachKey(keys, func(key string) error {
+		return me.store.SetKV(ctx, scope+"@"+key, kvs[key], ttlsec)
+	})
+}
+
+// DelKVMulti removes the keys from the database. The keys which could not be
+// removed are reported in a KVErrors.
+func (me *Client) DelKVMulti(ctx context.Context, scope string, keys []string) error {
+	ctx, span := me.startSpan(ctx, "DelKVMulti", "")
+	defer span.End()
+	if err := me.waitUntilReady(ctx); err != nil {
+		return err
+	}
+	return forEachKey(keys, func(key string) error {
+		return me.store.DelKV(ctx, scope+"@"+key)
+	})
+}
+
+// forEachKey calls fn for every key, kvConcurrency keys at a time. Keys are
+// spread over partitions, so concurrent single key queries are cheaper for
+// Cassandra than a batch.
+func forEachKey(keys []string, fn func(key string) error) error {
+	lock := &sync.Mutex{}
+	errs := KVErrors{}
+	wg := &sync.WaitGroup{}
+	sem := make(chan struct{}, kvConcurrency)
+	for _, key := range keys {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			if err := fn(key); err != nil {
+				lock.Lock()
+				errs[key] = err
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(errs) == 0 {
+		return nil
 	}
-	return nil
+	return errs
 }
@@ -0,0 +1,219 @@
+package acclient
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"strings"
+
+	"github.com/subiz/log"
+	"google.golang.org/protobuf/proto"
+)
+
+// kvMaxValueSize is the largest value, as stored, a KV handle writes. Larger
+// Cassandra cells slow the whole table down.
+const kvMaxValueSize = 1 << 20
+
+// kvCompressMinSize is the least size of the typed values which are stored
+// compressed
+const kvCompressMinSize = 1024
+
+// prefixes of the stored typed values which are not plain JSON, JSON never
+// starts with ~
+const (
+	kvGzipPrefix   = "~gz:"
+	kvBinaryPrefix = "~b64:"
+)
+
+// KV is the KV store namespaced by a scope, see KVScope
+type KV struct {
+	client *Client
+	scope  string
+}
+
+// KVScope returns a handle of the KV store which prefixes every key with
+// scope, the same way as the scope parameter of GetKV, SetKV, ...
+//
+// Besides plain strings, the handle stores JSON values (GetJSON, SetJSON) and
+// proto messages (GetProto, SetProto). Large typed values are compressed, so
+// they must be read back with the matching typed getter. Every write fails
+// with a payload too large error above 1MB.
+func (me *Client) KVScope(scope string) *KV {
+	return &KV{client: me, scope: scope}
+}
+
+// Scope returns the scope of the handle
+func (me *KV) Scope() string { return me.scope }
+
+// Get returns the value of key, see GetKV
+func (me *KV) Get(ctx context.Context, key string) (string, bool, error) {
+	return me.client.GetKV(ctx, me.scope, key)
+}
+
+// GetWithVersion returns the value of key and its version, see
+// GetKVWithVersion
+func (me *KV) GetWithVersion(ctx context.Context, key string) (string, int64, bool, error) {
+	return me.client.GetKVWithVersion(ctx, me.scope, key)
+}
+
+// Set puts the key-value pair, see SetKVTTL
+func (me *KV) Set(ctx context.Context, key, value string, ttlsec int) error {
+	if err := me.checkSize(key, value); err != nil {
+		return err
+	}
+	return me.client.SetKVTTL(ctx, me.scope, key, value, ttlsec)
+}
+
+// SetIfNotExists puts the key-value pair unless the key exists, see
+// SetKVIfNotExists
+func (me *KV) SetIfNotExists(ctx context.Context, key, value string, ttlsec int) (bool, error) {
+	if err := me.checkSize(key, value); err != nil {
+		return false, err
+	}
+	return me.client.SetKVIfNotExists(ctx, me.scope, key, value, ttlsec)
+}
+
+// CompareAndSwap sets key to newvalue if its value is still oldvalue, see
+// CompareAndSwapKV
+func (me *KV) CompareAndSwap(ctx context.Context, key, oldvalue, newvalue string, ttlsec int) (bool, error) {
+	if err := me.checkSize(key, newvalue); err != nil {
+		return false, err
+	}
+	return me.client.CompareAndSwapKV(ctx, me.scope, key, oldvalue, newvalue, ttlsec)
+}
+
+// GetTTL returns the remaining ttl of key in seconds, see GetKVTTL
+func (me *KV) GetTTL(ctx context.Context, key string) (int, bool, error) {
+	return me.client.GetKVTTL(ctx, me.scope, key)
+}
+
+// Touch sets the ttl of key without changing its value, see TouchKV
+func (me *KV) Touch(ctx context.Context, key string, ttlsec int) (bool, error) {
+	return me.client.TouchKV(ctx, me.scope, key, ttlsec)
+}
+
+// Del removes key, see DelKV
+func (me *KV) Del(ctx context.Context, key string) error {
+	return me.client.DelKV(ctx, me.scope, key)
+}
+
+// GetMulti returns the values of the keys found, see GetKVMulti
+func (me *KV) GetMulti(ctx context.Context, keys []string) (map[string]string, error) {
+	return me.client.GetKVMulti(ctx, me.scope, keys)
+}
+
+// SetMulti puts the key-value pairs, see SetKVMulti
+func (me *KV) SetMulti(ctx context.Context, kvs map[string]string, ttlsec int) error {
+	for key, value := range kvs {
+		if err := me.checkSize(key, value); err != nil {
+			return err
+		}
+	}
+	return me.client.SetKVMulti(ctx, me.scope, kvs, ttlsec)
+}
+
+// DelMulti removes the keys, see DelKVMulti
+func (me *KV) DelMulti(ctx context.Context, keys []string) error {
+	return me.client.DelKVMulti(ctx, me.scope, keys)
+}
+
+// GetProto reads the value of key into msg, found is false when the key does
+// not exist
+func (me *KV) GetProto(ctx context.Context, key string, msg proto.Message) (bool, error) {
+	value, found, err := me.Get(ctx, key)
+	if err != nil || !found {
+		return false, err
+	}
+	data, err := decodeKVValue(value)
+	if err == nil {
+		err = proto.Unmarshal(data, msg)
+	}
+	if err != nil {
+		return false, log.EData(err, nil, log.M{"scope": me.scope, "key": key})
+	}
+	return true, nil
+}
+
+// SetProto puts msg as the value of key
+func (me *KV) SetProto(ctx context.Context, key string, msg proto.Message, ttlsec int) error {
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		return log.EData(err, nil, log.M{"scope": me.scope, "key": key})
+	}
+	return me.Set(ctx, key, encodeKVValue(data, true), ttlsec)
+}
+
+// GetJSON reads the JSON value of key, found is false when the key does not
+// exist
+func GetJSON[T any](ctx context.Context, kv *KV, key string) (T, bool, error) {
+	var out T
+	value, found, err := kv.Get(ctx, key)
+	if err != nil || !found {
+		return out, false, err
+	}
+	data, err := decodeKVValue(value)
+	if err == nil {
+		err = json.Unmarshal(data, &out)
+	}
+	if err != nil {
+		return out, false, log.EData(err, nil, log.M{"scope": kv.scope, "key": key})
+	}
+	return out, true, nil
+}
+
+// SetJSON puts value, encoded as JSON, as the value of key
+func SetJSON[T any](ctx context.Context, kv *KV, key string, value T, ttlsec int) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return log.EData(err, nil, log.M{"scope": kv.scope, "key": key})
+	}
+	return kv.Set(ctx, key, encodeKVValue(data, false), ttlsec)
+}
+
+func (me *KV) checkSize(key, value string) error {
+	if len(value) > kvMaxValueSize {
+		return log.EPayloadTooLarge(int64(len(value)), kvMaxValueSize, log.M{"scope": me.scope, "key": key})
+	}
+	return nil
+}
+
+// encodeKVValue turns a typed value into the string stored in the KV table,
+// binary data is base64 encoded, large data is compressed
+func encodeKVValue(data []byte, binary bool) string {
+	if len(data) >= kvCompressMinSize {
+		buf := &bytes.Buffer{}
+		zw := gzip.NewWriter(buf)
+		zw.Write(data)
+		zw.Close()
+		if buf.Len() < len(data) {
+			return kvGzipPrefix + base64.StdEncoding.EncodeToString(buf.Bytes())
+		}
+	}
+	if binary {
+		return kvBinaryPrefix + base64.StdEncoding.EncodeToString(data)
+	}
+	return string(data)
+}
+
+// decodeKVValue reverses encodeKVValue
+func decodeKVValue(value string) ([]byte, error) {
+	if b64, found := strings.CutPrefix(value, kvBinaryPrefix); found {
+		return base64.StdEncoding.DecodeString(b64)
+	}
+	b64, found := strings.CutPrefix(value, kvGzipPrefix)
+	if !found {
+		return []byte(value), nil
+	}
+	zipped, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(zipped))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(io.LimitReader(zr, 64*kvMaxValueSize))
+}
@@ -0,0 +1,215 @@
+package acclient
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/subiz/log"
+	"github.com/thanhpk/randstr"
+)
+
+// ErrLeaseLost is returned by Lease.Renew when the lease expired or was
+// taken by another holder, it is also the cause of the ctx given to the fn of
+// RunWithLeader once the leadership is lost
+var ErrLeaseLost = errors.New("acclient: lease lost")
+
+// leaderScope is the KV scope of the leases of RunWithLeader
+const leaderScope = "leader"
+
+// leaderLeaseTTL is how long a leader keeps its lease without renewing it
+const leaderLeaseTTL = 15 * time.Second
+
+// Lease is a lock shared by every client, see AcquireLease
+type Lease struct {
+	Scope string
+	Name  string
+	// Token is the fencing token of the lease, it is greater than the tokens
+	// of every previous holder. Pass it along the writes guarded by the lease
+	// so the resources can reject the ones of a holder which lost the lease.
+	Token int64
+
+	client *Client
+	key    string
+	holder string
+	ttl    time.Duration
+
+	lock  *sync.Mutex
+	timer *time.Timer // fires when the lease expires
+	lost  chan struct{}
+}
+
+// AcquireLease takes the lease name of scope for ttl, it returns nil, nil
+// when someone else holds it. The holder keeps the lease with Renew before
+// ttl passes, and gives it back with Release.
+//
+// Leases are conditional writes on the KV table, so the other KV functions
+// must not be used on the keys of scope.
+func (me *Client) AcquireLease(ctx context.Context, scope, name string, ttl time.Duration) (*Lease, error) {
+	ctx, span := me.startSpan(ctx, "AcquireLease", "")
+	defer span.End()
+	if ttl < time.Second {
+		return nil, log.NewError(nil, log.M{"scope": scope, "name": name, "ttl": ttl.String()}, log.E_invalid_input)
+	}
+	if err := me.waitUntilReady(ctx); err != nil {
+		return nil, err
+	}
+
+	lease := &Lease{Scope: scope, Name: name, client: me, key: scope + "@" + name, holder: randstr.Hex(16), ttl: ttl, lock: &sync.Mutex{}, lost: make(chan struct{})}
+	start := time.Now()
+	ok, err := me.store.InsertKVIfNotExists(ctx, lease.key, lease.holder, lease.ttlsec())
+	if err != nil || !ok {
+		return nil, err
+	}
+	holder, token, found, err := me.store.GetKVVersion(ctx, lease.key)
+	if err != nil {
+		// give the lease back rather than block everyone until it expires
+		if _, derr := me.store.DeleteKVIf(context.WithoutCancel(ctx), lease.key, lease.holder); derr != nil {
+			log.WarnContext(ctx, "acclient: cannot release lease", "scope", scope, "name", name, "err", derr.Error())
+		}
+		return nil, err
+	}
+	if !found || holder != lease.holder {
+		// expired already
+		return nil, nil
+	}
+	lease.Token = token
+	// markLost reads the timer under the lock, it may fire right away
+	lease.lock.Lock()
+	lease.timer = time.AfterFunc(time.Until(start.Add(ttl)), lease.markLost)
+	lease.lock.Unlock()
+	return lease, nil
+}
+
+// Lost is closed once the lease is no longer held: it expired without being
+// renewed, Renew found it taken or it was released
+func (me *Lease) Lost() <-chan struct{} { return me.lost }
+
+// Renew extends the lease for another ttl, it fails with ErrLeaseLost if the
+// lease is no longer held. Other errors are transient, the lease is held
+// until Lost is closed.
+func (me *Lease) Renew(ctx context.Context) error {
+	ctx, span := me.client.startSpan(ctx, "RenewLease", "")
+	defer span.End()
+	if me.isLost() {
+		return ErrLeaseLost
+	}
+	start := time.Now()
+	ok, err := me.client.store.CompareAndSwapKV(ctx, me.key, me.holder, me.holder, me.ttlsec())
+	if err != nil {
+		return err
+	}
+	if !ok {
+		me.markLost()
+		return ErrLeaseLost
+	}
+
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	if me.isLost() {
+		return ErrLeaseLost
+	}
+	me.timer.Reset(time.Until(start.Add(me.ttl)))
+	return nil
+}
+
+// Release gives the lease back so others can acquire it right away
+func (me *Lease) Release(ctx context.Context) error {
+	ctx, span := me.client.startSpan(ctx, "ReleaseLease", "")
+	defer span.End()
+	me.markLost()
+	_, err := me.client.store.DeleteKVIf(ctx, me.key, me.holder)
+	return err
+}
+
+func (me *Lease) isLost() bool {
+	select {
+	case <-me.lost:
+		return true
+	default:
+		return false
+	}
+}
+
+func (me *Lease) markLost() {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	if me.timer != nil {
+		me.timer.Stop()
+	}
+	if !me.isLost() {
+		close(me.lost)
+	}
+}
+
+// ttlsec is the ttl rounded up to seconds, the lease expires locally before
+// it does in the database
+func (me *Lease) ttlsec() int {
+	return int((me.ttl + time.Second - 1) / time.Second)
+}
+
+// RunWithLeader calls fn when this client becomes the leader of name, only
+// one client at a time runs fn for a name. The leadership is renewed in the
+// background, when it is lost the ctx given to fn is cancelled with cause
+// ErrLeaseLost and the client campaigns again once fn returns.
+//
+// RunWithLeader returns fn's error once fn returns for another reason, or
+// ctx's error when ctx is done.
+func (me *Client) RunWithLeader(ctx context.Context, name string, fn func(ctx context.Context) error) error {
+	for {
+		lease, err := me.AcquireLease(ctx, leaderScope, name, leaderLeaseTTL)
+		if err != nil && ctx.Err() == nil {
+			me.metrics.Add("acclient_leader_errors_total", 1, "name", name)
+			log.WarnContext(ctx, "acclient: cannot campaign for leader", "name", name, "err", err.Error())
+		}
+		if err == nil && lease != nil {
+			if err := me.lead(ctx, lease, fn); !errors.Is(err, ErrLeaseLost) {
+				return err
+			}
+		}
+		if !sleepCtx(ctx, leaderLeaseTTL/3) {
+			return ctx.Err()
+		}
+	}
+}
+
+// lead runs fn while renewing lease, it returns ErrLeaseLost when fn stopped
+// because the lease was lost
+func (me *Client) lead(ctx context.Context, lease *Lease, fn func(ctx context.Context) error) error {
+	workctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	renewStopped := make(chan struct{})
+	go func() {
+		defer close(renewStopped)
+		ticker := time.NewTicker(lease.ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-workctx.Done():
+				return
+			case <-lease.Lost():
+				cancel(ErrLeaseLost)
+				return
+			case <-ticker.C:
+			}
+			// renew errors are transient, the next tick retries
+			if err := lease.Renew(workctx); err != nil && !errors.Is(err, ErrLeaseLost) && workctx.Err() == nil {
+				me.metrics.Add("acclient_leader_errors_total", 1, "name", lease.Name)
+				log.WarnContext(ctx, "acclient: cannot renew leader lease", "name", lease.Name, "err", err.Error())
+			}
+		}
+	}()
+
+	err := fn(workctx)
+	lost := errors.Is(context.Cause(workctx), ErrLeaseLost)
+	cancel(nil)
+	<-renewStopped
+	// the lease must be released even if the caller has given up
+	lease.Release(context.WithoutCancel(ctx))
+	if lost {
+		return ErrLeaseLost
+	}
+	return err
+}
@@ -0,0 +1,137 @@
+package acclient
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/subiz/log"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// loadTimeout bounds a shared load, which outlives the ctx of the caller
+// that started it
+const loadTimeout = 30 * time.Second
+
+// loadGroup deduplicates concurrent loads of the same key, like
+// golang.org/x/sync/singleflight
+type loadGroup struct {
+	lock    *sync.Mutex
+	calls   map[string]*loadCall
+	loaders map[string]func(ctx context.Context, id string) (any, error) // resource
+}
+
+type loadCall struct {
+	done  chan struct{}
+	value any
+	err   error
+}
+
+func newLoadGroup() *loadGroup {
+	return &loadGroup{lock: &sync.Mutex{}, calls: map[string]*loadCall{}, loaders: map[string]func(ctx context.Context, id string) (any, error){}}
+}
+
+// register remembers how to load resource, so it can be reloaded when it
+// changes
+func (me *loadGroup) register(resource string, fn func(ctx context.Context, id string) (any, error)) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	me.loaders[resource] = fn
+}
+
+// reload loads a resource again with the loader last used by load, it
+// does nothing if the resource was never loaded
+func (me *loadGroup) reload(ctx context.Context, resource, id string) error {
+	me.lock.Lock()
+	fn := me.loaders[resource]
+	me.lock.Unlock()
+	if fn == nil {
+		return nil
+	}
+	_, err := me.do(ctx, resource+"."+id, func(ctx context.Context) (any, error) { return fn(ctx, id) })
+	return err
+}
+
+// do calls fn once for all the callers asking for key at the same time. A
+// caller stops waiting when its ctx is done, the load goes on for the
+// others.
+func (me *loadGroup) do(ctx context.Context, key string, fn func(ctx context.Context) (any, error)) (any, error) {
+	call, _ := me.start(ctx, key, fn)
+	select {
+	case <-call.done:
+		return call.value, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// start calls fn in the background unless a load of key is running, it
+// returns the running load and whether it was started by this call
+func (me *loadGroup) start(ctx context.Context, key string, fn func(ctx context.Context) (any, error)) (*loadCall, bool) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	if call := me.calls[key]; call != nil {
+		return call, false
+	}
+
+	call := &loadCall{done: make(chan struct{}), err: log.NewError(nil, log.M{"key": key, "reason": "load panicked"}, log.E_internal)}
+	me.calls[key] = call
+	loadctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), loadTimeout)
+	go func() {
+		defer cancel()
+		defer func() {
+			me.lock.Lock()
+			delete(me.calls, key)
+			me.lock.Unlock()
+			close(call.done)
+		}()
+		call.value, call.err = fn(loadctx)
+	}()
+	return call, true
+}
+
+// load returns the cached value of a resource, or calls fn to load it on a
+// miss. fn is expected to cache what it loads. Concurrent misses of the
+// same resource share a single fn call, each caller gets its own copy of
+// the result unless ctx is marked by NoCopy.
+//
+// A stale value (see WithMaxStale) is returned right away while fn reloads
+// it in the background, it keeps being served if the reload fails.
+func load[T any](ctx context.Context, me *Client, resource, id string, fn func(ctx context.Context, id string) (T, error)) (T, error) {
+	key := resource + "." + id
+	value, state := cacheLookup[T](ctx, me, resource, id)
+	if state == cacheFresh {
+		return value, nil
+	}
+
+	loader := func(ctx context.Context, id string) (any, error) {
+		start := time.Now()
+		ctx, span := startChildSpan(ctx, "acclient.load", attribute.String("resource", resource), attribute.String("id", id))
+		value, err := fn(ctx, id)
+		endSpan(span, err)
+		me.metrics.Observe("acclient_load_duration_seconds", time.Since(start).Seconds(), "resource", resource, "result", resultLabel(err))
+		return value, err
+	}
+	loadfn := func(ctx context.Context) (any, error) { return loader(ctx, id) }
+	me.loads.register(resource, loader)
+	switch state {
+	case cacheStale:
+		if call, started := me.loads.start(ctx, key, loadfn); started {
+			go func() {
+				<-call.done
+				if call.err != nil {
+					log.WarnContext(context.WithoutCancel(ctx), "acclient: serving stale cache, reload failed", "key", key, "err", call.err.Error())
+				}
+			}()
+		}
+		return value, nil
+	}
+
+	var zero T
+	loaded, err := me.loads.do(ctx, key, loadfn)
+	if err != nil {
+		return zero, err
+	}
+	typed, _ := loaded.(T)
+	return copyOf(ctx, typed), nil
+}
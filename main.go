@@ -11,7 +11,6 @@ import (
 	"hash/crc32"
 	"io"
 	"math/rand"
-	"net/http"
 	neturl "net/url"
 	"os"
 	"slices"
@@ -21,7 +20,6 @@ import (
 	"time"
 	"unicode"
 
-	"github.com/gocql/gocql"
 	"github.com/subiz/goutils/business_hours"
 	"github.com/subiz/goutils/clock"
 	"github.com/subiz/goutils/conv"
@@ -30,11 +28,7 @@ import (
 	compb "github.com/subiz/header/common"
 	pm "github.com/subiz/header/payment"
 	"github.com/subiz/idgen"
-	"github.com/subiz/kafka"
 	"github.com/subiz/log"
-	gocache "github.com/thanhpk/go-cache"
-	"github.com/thanhpk/randstr"
-	"google.golang.org/protobuf/proto"
 )
 
 //go:embed do_not_crawl.txt
@@ -45,30 +39,13 @@ var skipdomain string
 // 09 Apr, 2026: 26_316
 var USD2VND = 26_316
 
-var (
-	readyLock  = &sync.Mutex{}
-	missingAcc = map[string]bool{}
-
-	ready    bool
-	hostname string
-
-	session            *gocql.Session
-	accmgr             header.AccountMgrClient
-	paymgr             header.PaymentMgrClient
-	fabikon            header.FabikonServiceClient
-	creditmgr          header.CreditMgrClient
-	registryClient     header.NumberRegistryClient
-	numpubsub          header.PubsubClient
-	cache              = gocache.New(60 * time.Minute)
-	subscribeTopicLock = &sync.Mutex{}
-	subscribeTopics    = map[string]bool{}
-)
+var hostname string
 
 // var EACCESS_DENY = log.NewError(nil, log.M{}, log.E_access_deny)
 var skipDomainM = map[string]bool{}
 var skipWholeDomainM = map[string]bool{}
 
-func _init() {
+func init() {
 	for domain := range strings.SplitSeq(skipdomain, "\n") {
 		domain = strings.ToLower(strings.TrimSpace(strings.Split(domain, ";")[0]))
 		domain = strings.TrimPrefix(domain, ".")
@@ -86,50 +63,30 @@ func _init() {
 	}
 
 	hostname, _ = os.Hostname()
-	session = header.ConnectDB([]string{"db-0"}, "account")
-	conn := header.DialGrpc("account-0.account:10283", header.WithShardRedirect())
-	accmgr = header.NewAccountMgrClient(conn)
-	paymgr = header.NewPaymentMgrClient(conn)
-	fabikonconn := header.DialGrpc("fabikon:21111")
-	fabikon = header.NewFabikonServiceClient(fabikonconn)
-	creditmgr = header.NewCreditMgrClient(conn)
-
-	conn = header.DialGrpc("numreg-0.numreg:8665")
-	registryClient = header.NewNumberRegistryClient(conn)
-	numpubsub = header.NewPubsubClient(conn)
-	go pollLoop()
-	go loopfileapidomain()
 }
 
-// for testing purpose
-func ClearCache() {
-	cache = gocache.New(60 * time.Minute)
-}
+// a missing account is looked up again after missingAccountTTL, or as soon
+// as its account topic fires. At most missingAccountSize missing accounts are
+// remembered, so random ids from bad requests cannot grow the memory.
+const (
+	missingAccountTTL  = 5 * time.Minute
+	missingAccountSize = 10_000
+)
 
-func waitUntilReady() {
-	if ready {
-		return
-	}
-	readyLock.Lock()
-	if ready {
-		readyLock.Unlock()
-		return
-	}
-	_init()
-	ready = true
-	readyLock.Unlock()
+func (me *Client) isMissingAccount(id string) bool {
+	expires, found := me.missingAccs.Get(id)
+	return found && time.Now().Before(expires)
 }
 
-func getAccountDB(id string) (*pb.Account, error) {
-	subscribe(id, "account")
-	waitUntilReady()
+func (me *Client) getAccountDB(ctx context.Context, id string) (*pb.Account, error) {
+	me.subscribe(id, "account")
+	if err := me.waitUntilReady(ctx); err != nil {
+		return nil, err
+	}
 
-	readyLock.Lock()
-	if missingAcc[id] {
-		readyLock.Unlock()
+	if me.isMissingAccount(id) {
 		return nil, nil
 	}
-	readyLock.Unlock()
 
 	if id == "acctest" {
 		return &pb.Account{
@@ -142,158 +99,79 @@ func getAccountDB(id string) (*pb.Account, error) {
 		}, nil
 	}
 
-	account, err := accmgr.GetAccount(header.ToGrpcCtx(&compb.Context{
+	account, err := me.accmgr.GetAccount(toGrpcCtx(ctx, &compb.Context{
 		AccountId:  id,
 		Credential: &compb.Credential{Issuer: hostname, Type: compb.Type_subiz},
 	}), &header.Id{AccountId: id, Id: id})
 	if err == nil && account != nil {
-		cache.Set("account."+id, account)
+		me.cacheSet("account", id, account)
 		return account, nil
 	}
 
 	if log.IsErr(err, log.E_missing_resource.String()) {
-		cache.Set("account."+id, nil)
-		readyLock.Lock()
-		missingAcc[id] = true
-		readyLock.Unlock()
+		me.cacheSetTTL("account", id, nil, min(missingAccountTTL, me.cacheTTL("account")))
+		me.missingAccs.Add(id, time.Now().Add(missingAccountTTL))
 		return nil, nil
 	}
 	return nil, err
 }
 
-func getSubDB(id string) (*pm.Subscription, error) {
-	subscribe(id, "subscription")
-	waitUntilReady()
+func (me *Client) getSubDB(ctx context.Context, id string) (*pm.Subscription, error) {
+	me.subscribe(id, "subscription")
+	if err := me.waitUntilReady(ctx); err != nil {
+		return nil, err
+	}
 
-	readyLock.Lock()
-	if missingAcc[id] {
-		readyLock.Unlock()
+	if me.isMissingAccount(id) {
 		return nil, nil
 	}
-	readyLock.Unlock()
 
-	sub, err := paymgr.GetSubscription(header.ToGrpcCtx(&compb.Context{
+	sub, err := me.paymgr.GetSubscription(toGrpcCtx(ctx, &compb.Context{
 		AccountId:  id,
 		Credential: &compb.Credential{Issuer: hostname, Type: compb.Type_subiz},
 	}), &header.Id{AccountId: id, Id: id})
 	if err == nil && sub != nil {
-		cache.Set("subscription."+id, sub)
+		me.cacheSet("subscription", id, sub)
 		return sub, nil
 	}
 	return nil, err
 }
 
-func getShopSettingDb(id string) (*header.ShopSetting, error) {
-	waitUntilReady()
-	subscribe(id, "shop_setting")
-	var data = []byte{}
-	err := session.Query("SELECT data FROM account.shop_setting WHERE account_id=?", id).Scan(&data)
-	setting := &header.ShopSetting{}
-
-	if err != nil && err.Error() != gocql.ErrNotFound.Error() {
-		return nil, log.ERetry(err, log.M{"id": id})
-	}
-	if len(data) > 0 {
-		proto.Unmarshal(data, setting)
-	}
-
-	shopAddresses := []*header.Address{}
-	// read pos
-	data = []byte{}
-	iter := session.Query(`SELECT data FROM account.shop_address WHERE account_id=?`, id).Iter()
-	for iter.Scan(&data) {
-		shopAddress := header.Address{}
-		proto.Unmarshal(data, &shopAddress)
-		shopAddresses = append(shopAddresses, &shopAddress)
-	}
-	if err := iter.Close(); err != nil {
-		return nil, log.ERetry(err, log.M{"id": id})
-	}
-
-	taxes := []*header.Tax{}
-	// read pos
-	data = []byte{}
-	iter = session.Query(`SELECT data FROM account.tax WHERE account_id=?`, id).Iter()
-	for iter.Scan(&data) {
-		tax := header.Tax{}
-		proto.Unmarshal(data, &tax)
-		taxes = append(taxes, &tax)
-	}
-	if err := iter.Close(); err != nil {
-		return nil, log.ERetry(err, log.M{"id": id})
-	}
-
-	paymentmethods := []*header.PaymentMethod{}
-	// read pos
-	data = []byte{}
-	iter = session.Query(`SELECT data FROM account.payment_method WHERE account_id=?`, id).Iter()
-	for iter.Scan(&data) {
-		pm := header.PaymentMethod{}
-		proto.Unmarshal(data, &pm)
-		paymentmethods = append(paymentmethods, &pm)
-	}
-	if err := iter.Close(); err != nil {
-		return nil, log.ERetry(err, log.M{"id": id})
-	}
-
-	shops := make([]*header.ShopeeShop, 0)
-	iter = session.Query(`SELECT data from proder.shopee_shop WHERE account_id=? LIMIT 1000`, id).Iter()
-	b := make([]byte, 0)
-	for iter.Scan(&b) {
-		shop := &header.ShopeeShop{}
-		if err := proto.Unmarshal(b, shop); err != nil {
-			return nil, log.EData(err, b, log.M{"account_id": id})
-		}
-		shops = append(shops, shop)
-	}
-	if err := iter.Close(); err != nil {
-		return nil, log.ERetry(err, log.M{"id": id})
-	}
-
-	ccs := []*header.CancellationCode{}
-	iter = session.Query(`SELECT data FROM account.cancellation_code WHERE account_id=?`, id).Iter()
-	for iter.Scan(&data) {
-		cc := header.CancellationCode{}
-		proto.Unmarshal(data, &cc)
-		ccs = append(ccs, &cc)
+func (me *Client) getShopSettingDb(ctx context.Context, id string) (*header.ShopSetting, error) {
+	if err := me.waitUntilReady(ctx); err != nil {
+		return nil, err
 	}
-	if err := iter.Close(); err != nil {
-		return nil, log.ERetry(err, log.M{"account_id": id})
+	me.subscribe(id, "shop_setting")
+	setting, err := me.store.GetShopSetting(ctx, id)
+	if err != nil {
+		return nil, err
 	}
 
-	setting.CancellationCodes = ccs
-	setting.Taxes = taxes
-	setting.PaymentMethods = paymentmethods
-	setting.Addresses = shopAddresses
-	// setting.Shippings = ishippings
-	// setting.ShippingPolicies = sps
-	setting.ShopeeShops = shops
-	setting.AccountId = id
-
-	cache.Set("shop_setting."+id, setting)
+	me.cacheSet("shop_setting", id, setting)
 	return setting, nil
 }
 
-func loadLangDB(accid, locale string, old *header.Lang, fallback bool) (*header.Lang, error) {
-	waitUntilReady()
+func (me *Client) loadLangDB(ctx context.Context, accid, locale string, old *header.Lang, fallback bool) (*header.Lang, error) {
+	if err := me.waitUntilReady(ctx); err != nil {
+		return nil, err
+	}
 
 	lang := &header.Lang{}
-	var message, lastmsg, updatedby, public, category string
-	var updated int64
-	var k string
-
-	iter := session.Query(`SELECT k, message, public_state, last_message, updated, author, category FROM account.lang WHERE account_id=? AND locale=?`, accid, locale).Iter()
-	for iter.Scan(&k, &message, &public, &lastmsg, &updated, &updatedby, &category) {
-		if message == "" {
+	messages, err := me.store.ListLangMessages(ctx, accid, locale)
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range messages {
+		if msg.GetMessage() == "" {
 			continue
 		}
 		found := false
 		for _, m := range old.GetMessages() {
-			if k == m.Key {
+			if msg.GetKey() == m.Key {
 				// only category in locale en-US of acc subiz is valid
 				// so this override all categories
 				if accid == "subiz" && locale == "en-US" {
-					m.Category = category
+					m.Category = msg.GetCategory()
 				}
 				found = true
 				break
@@ -302,36 +180,36 @@ func loadLangDB(accid, locale string, old *header.Lang, fallback bool) (*header.
 
 		// add missing key
 		if !found {
-			lang.Messages = append(lang.Messages, &header.LangMessage{Key: k, FromDefault: fallback, Message: message, PublicState: public, LastMessage: lastmsg, Updated: updated, Author: updatedby, Locale: locale, Category: category})
+			msg.FromDefault = fallback
+			lang.Messages = append(lang.Messages, msg)
 		}
 	}
-	if err := iter.Close(); err != nil {
-		return nil, log.ERetry(err, log.M{"account_id": accid})
-	}
 
 	old.Messages = append(old.Messages, lang.Messages...)
 	return old, nil
 }
 
-func ListLocaleMessageDB(accid, locale string) (*header.Lang, error) {
+func (me *Client) ListLocaleMessageDB(ctx context.Context, accid, locale string) (*header.Lang, error) {
+	ctx, span := me.startSpan(ctx, "ListLocaleMessageDB", accid)
+	defer span.End()
 	lang := &header.Lang{}
 	var err error
 	// read in custom lang first
 	if accid != "subiz" {
-		lang, err = loadLangDB(accid, locale, lang, false)
+		lang, err = me.loadLangDB(ctx, accid, locale, lang, false)
 		if err != nil {
 			return nil, err
 		}
 	}
 	if locale != "en-US" {
 		// fallback to default locale in subiz
-		lang, err = loadLangDB("subiz", locale, lang, false)
+		lang, err = me.loadLangDB(ctx, "subiz", locale, lang, false)
 		if err != nil {
 			return nil, err
 		}
 
 		// fallback to primary_locale of acount
-		acc, err := GetAccount(accid)
+		acc, err := me.GetAccount(NoCopy(ctx), accid)
 		if err != nil {
 			return nil, err
 		}
@@ -339,14 +217,14 @@ func ListLocaleMessageDB(accid, locale string) (*header.Lang, error) {
 		if acc.GetLocale() != "" && acc.GetLocale() != "en-US" && acc.GetLocale() != locale {
 			if accid != "subiz" {
 				// check to see missing key in the en-US locale - the most completed locale
-				lang, err = loadLangDB(accid, acc.GetLocale(), lang, true)
+				lang, err = me.loadLangDB(ctx, accid, acc.GetLocale(), lang, true)
 				if err != nil {
 					return nil, err
 				}
 			}
 
 			// fallback to default custom lang
-			lang, err = loadLangDB("subiz", acc.GetLocale(), lang, true)
+			lang, err = me.loadLangDB(ctx, "subiz", acc.GetLocale(), lang, true)
 			if err != nil {
 				return nil, err
 			}
@@ -356,7 +234,7 @@ func ListLocaleMessageDB(accid, locale string) (*header.Lang, error) {
 	// finally, fallback to the en-US locale - the most completed locale
 	enlang := &header.Lang{}
 	isfromdef := locale != "en-US"
-	enlang, err = loadLangDB("subiz", "en-US", enlang, isfromdef)
+	enlang, err = me.loadLangDB(ctx, "subiz", "en-US", enlang, isfromdef)
 	if err != nil {
 		return nil, err
 	}
@@ -381,46 +259,40 @@ func ListLocaleMessageDB(accid, locale string) (*header.Lang, error) {
 	return lang, nil
 }
 
-func listLocaleMessagesDB(accid, locale string) (*header.Lang, error) {
-	waitUntilReady()
-	subscribe(accid+"_"+locale, "lang")
+func (me *Client) listLocaleMessagesDB(ctx context.Context, accid, locale string) (*header.Lang, error) {
+	if err := me.waitUntilReady(ctx); err != nil {
+		return nil, err
+	}
+	me.subscribe(accid+"_"+locale, "lang")
 
-	lang, err := ListLocaleMessageDB(accid, locale)
+	lang, err := me.ListLocaleMessageDB(ctx, accid, locale)
 	if err != nil {
 		return nil, err
 	}
-	cache.Set("lang."+accid+"_"+locale, lang)
+	me.cacheSet("lang", accid+"_"+locale, lang)
 	return lang, nil
 }
 
 // see https://www.localeplanet.com/icu/
-func GetLocale(accid, locale string) (*header.Lang, error) {
+func (me *Client) GetLocale(ctx context.Context, accid, locale string) (*header.Lang, error) {
+	ctx, span := me.startSpan(ctx, "GetLocale", accid)
+	defer span.End()
 	if !header.LocaleM[locale] {
 		return &header.Lang{}, nil
 	}
-	if value, found := cache.Get("lang." + accid + "_" + locale); found {
-		if value == nil {
-			return nil, nil
-		}
-		return value.(*header.Lang), nil
-	}
-
-	return listLocaleMessagesDB(accid, locale)
+	return load(ctx, me, "lang", accid+"_"+locale, func(ctx context.Context, id string) (*header.Lang, error) {
+		accid, locale, _ := strings.Cut(id, "_")
+		return me.listLocaleMessagesDB(ctx, accid, locale)
+	})
 }
 
-// TODO return proto clone of other methods
-func GetAccount(accid string) (*pb.Account, error) {
-	waitUntilReady()
-	defer header.KLock("acclient_getacc." + accid)()
-	// cache hit
-	if value, found := cache.Get("account." + accid); found {
-		if value == nil {
-			return nil, nil
-		}
-		return value.(*pb.Account), nil
+func (me *Client) GetAccount(ctx context.Context, accid string) (*pb.Account, error) {
+	ctx, span := me.startSpan(ctx, "GetAccount", accid)
+	defer span.End()
+	if err := me.waitUntilReady(ctx); err != nil {
+		return nil, err
 	}
-
-	return getAccountDB(accid)
+	return load(ctx, me, "account", accid, me.getAccountDB)
 }
 
 func MakeDefNotiSetting(accid, agid string) *header.NotiSetting {
@@ -441,52 +313,42 @@ func MakeDefNotiSetting(accid, agid string) *header.NotiSetting {
 	}
 }
 
-func GetNotificationSetting(accid, agid string) (*header.NotiSetting, error) {
-	subscribe(accid, "notification_setting")
-	waitUntilReady()
-	if value, found := cache.Get("notification_setting." + accid); found {
-		if value == nil {
-			return MakeDefNotiSetting(accid, agid), nil
-		}
-		list := value.([]*header.NotiSetting)
-		for _, item := range list {
-			if item.GetAgentId() == agid {
-				return item, nil
-			}
-		}
-		return MakeDefNotiSetting(accid, agid), nil
+func (me *Client) GetNotificationSetting(ctx context.Context, accid, agid string) (*header.NotiSetting, error) {
+	ctx, span := me.startSpan(ctx, "GetNotificationSetting", accid)
+	defer span.End()
+	me.subscribe(accid, "notification_setting")
+	if err := me.waitUntilReady(ctx); err != nil {
+		return nil, err
 	}
-
-	settings, err := getNotificationSettingDB(accid)
+	settings, err := load(NoCopy(ctx), me, "notification_setting", accid, me.getNotificationSettingDB)
 	if err != nil {
 		return nil, err
 	}
 	for _, setting := range settings {
 		if setting.GetAgentId() == agid {
-			return setting, nil
+			return copyOf(ctx, setting), nil
 		}
 	}
 	return MakeDefNotiSetting(accid, agid), nil
 }
 
-func GetSubscription(accid string) (*pm.Subscription, error) {
-	waitUntilReady()
-	defer header.KLock("acclient_getsub." + accid)()
-
-	// cache hit
-	if value, found := cache.Get("subscription." + accid); found {
-		if value == nil {
-			return nil, nil
-		}
-		return value.(*pm.Subscription), nil
+func (me *Client) GetSubscription(ctx context.Context, accid string) (*pm.Subscription, error) {
+	ctx, span := me.startSpan(ctx, "GetSubscription", accid)
+	defer span.End()
+	if err := me.waitUntilReady(ctx); err != nil {
+		return nil, err
 	}
 
-	return getSubDB(accid)
+	return load(ctx, me, "subscription", accid, me.getSubDB)
 }
 
-func ListAgentProfileAccounts(agid string) ([]*pb.Account, error) {
-	waitUntilReady()
-	res, err := accmgr.ListAgentProfileAccounts(header.ToGrpcCtx(&compb.Context{
+func (me *Client) ListAgentProfileAccounts(ctx context.Context, agid string) ([]*pb.Account, error) {
+	ctx, span := me.startSpan(ctx, "ListAgentProfileAccounts", "")
+	defer span.End()
+	if err := me.waitUntilReady(ctx); err != nil {
+		return nil, err
+	}
+	res, err := me.accmgr.ListAgentProfileAccounts(toGrpcCtx(ctx, &compb.Context{
 		Credential: &compb.Credential{
 			Issuer: hostname,
 			Type:   compb.Type_subiz,
@@ -498,12 +360,14 @@ func ListAgentProfileAccounts(agid string) ([]*pb.Account, error) {
 	return res.GetAccounts(), nil
 }
 
-func listAgentsDB(accid string) (map[string]*pb.Agent, error) {
-	subscribe(accid, "agent")
-	waitUntilReady()
+func (me *Client) listAgentsDB(ctx context.Context, accid string) (map[string]*pb.Agent, error) {
+	me.subscribe(accid, "agent")
+	if err := me.waitUntilReady(ctx); err != nil {
+		return nil, err
+	}
 	listM := map[string]*pb.Agent{}
 
-	res, err := accmgr.ListAgents(header.ToGrpcCtx(&compb.Context{
+	res, err := me.accmgr.ListAgents(toGrpcCtx(ctx, &compb.Context{
 		AccountId:  accid,
 		Credential: &compb.Credential{Type: compb.Type_subiz, Issuer: hostname},
 	}), &header.Id{AccountId: accid})
@@ -516,51 +380,45 @@ func listAgentsDB(accid string) (map[string]*pb.Agent, error) {
 			listM[ag.GetId()] = ag
 		}
 	}
-	cache.Set("agent."+accid, listM)
+	me.cacheSet("agent", accid, listM)
 	return listM, nil
 }
 
-func listAttrDefsDB(accid string) (map[string]*header.AttributeDefinition, error) {
-	subscribe(accid, "attribute_definition")
+func (me *Client) listAttrDefsDB(ctx context.Context, accid string) (map[string]*header.AttributeDefinition, error) {
+	me.subscribe(accid, "attribute_definition")
+	list, err := me.store.ListAttrDefs(ctx, accid)
+	if err != nil {
+		return nil, err
+	}
+
 	defs := make(map[string]*header.AttributeDefinition, 0)
-	iter := session.Query("SELECT data FROM user.attr_defs WHERE account_id=? LIMIT 1000", accid).Iter()
-	var data []byte
-	for iter.Scan(&data) {
-		def := &header.AttributeDefinition{}
-		if err := proto.Unmarshal(data, def); err != nil {
-			return nil, log.ERetry(err, log.M{"account_id": accid})
-		}
+	for _, def := range list {
 		defs[def.Key] = def
 	}
-	if err := iter.Close(); err != nil {
-		return nil, log.ERetry(err, log.M{"account_id": accid})
-	}
 
 	defaults := header.ListDefaultDefs()
 	for _, a := range defaults {
 		defs[a.Key] = a
 	}
 
-	cache.Set("attribute_definition."+accid, defs)
+	me.cacheSet("attribute_definition", accid, defs)
 	return defs, nil
 }
 
-func ListFanpageSyncLifecycleStages(accid string) (map[string]bool, error) {
-	waitUntilReady()
-	if value, found := cache.Get("fb_setting." + accid); found {
-		if value == nil {
-			return nil, nil
-		}
-		return value.(map[string]bool), nil
+func (me *Client) ListFanpageSyncLifecycleStages(ctx context.Context, accid string) (map[string]bool, error) {
+	ctx, span := me.startSpan(ctx, "ListFanpageSyncLifecycleStages", accid)
+	defer span.End()
+	if err := me.waitUntilReady(ctx); err != nil {
+		return nil, err
 	}
-	return listFanpageSetting(accid)
+	return load(ctx, me, "fb_setting", accid, me.listFanpageSetting)
 }
 
-func listFanpageSetting(accid string) (map[string]bool, error) {
-	subscribe(accid, "fb_setting")
+func (me *Client) listFanpageSetting(ctx context.Context, accid string) (map[string]bool, error) {
+	me.subscribe(accid, "fb_setting")
 	lss := map[string]bool{}
-	ctx := header.ToGrpcCtx(&compb.Context{AccountId: accid, Credential: &compb.Credential{Issuer: hostname, Type: compb.Type_subiz}})
-	res, err := fabikon.ListFbFanpageSettings2(ctx, &header.ListPageSettingRequest{AccountId: accid, OnlyLeadConversion: true})
+	gctx := toGrpcCtx(ctx, &compb.Context{AccountId: accid, Credential: &compb.Credential{Issuer: hostname, Type: compb.Type_subiz}})
+	res, err := me.fabikon.ListFbFanpageSettings2(gctx, &header.ListPageSettingRequest{AccountId: accid, OnlyLeadConversion: true})
 	if err != nil {
 		return nil, err
 	}
@@ -571,99 +429,94 @@ func listFanpageSetting(accid string) (map[string]bool, error) {
 			}
 		}
 	}
-	cache.Set("fb_setting."+accid, lss)
+	me.cacheSet("fb_setting", accid, lss)
 	return lss, nil
 }
 
-func getNotificationSettingDB(accid string) ([]*header.NotiSetting, error) {
-	subscribe(accid, "notification_setting")
-	waitUntilReady()
-	agents, err := ListAgentM(accid)
+func (me *Client) getNotificationSettingDB(ctx context.Context, accid string) ([]*header.NotiSetting, error) {
+	me.subscribe(accid, "notification_setting")
+	if err := me.waitUntilReady(ctx); err != nil {
+		return nil, err
+	}
+	agents, err := me.ListAgentM(NoCopy(ctx), accid)
 	if err != nil {
 		return nil, err
 	}
 	settings := []*header.NotiSetting{}
 	for _, ag := range agents {
 		agid := ag.GetId()
-		setting := &header.NotiSetting{}
-		data := []byte{}
-		err := session.Query("SELECT data FROM notibox.setting WHERE accid=? AND agid=?", accid, agid).Scan(&data)
-		if err != nil && err.Error() == gocql.ErrNotFound.Error() {
-			setting = MakeDefNotiSetting(accid, agid)
-			settings = append(settings, setting)
-			continue
-		}
-
+		setting, err := me.store.GetNotiSetting(ctx, accid, agid)
 		if err != nil {
-			return nil, log.ERetry(err, log.M{"account_id": accid, "agent_id": agid})
+			return nil, err
 		}
 
-		proto.Unmarshal(data, setting)
+		if setting == nil {
+			setting = MakeDefNotiSetting(accid, agid)
+		}
 		settings = append(settings, setting)
 	}
 
-	cache.Set("notification_setting."+accid, settings)
+	me.cacheSet("notification_setting", accid, settings)
 	return settings, nil
 }
 
-func listBotsDB(accid string) ([]*header.Bot, error) {
-	subscribe(accid, "bot")
-	waitUntilReady()
-	iter := session.Query(`SELECT bot FROM bizbot.bots WHERE account_id=?`, accid).Iter()
-	var botb []byte
+func (me *Client) listBotsDB(ctx context.Context, accid string) ([]*header.Bot, error) {
+	me.subscribe(accid, "bot")
+	if err := me.waitUntilReady(ctx); err != nil {
+		return nil, err
+	}
+	bots, err := me.store.ListBots(ctx, accid)
+	if err != nil {
+		return nil, err
+	}
+
 	list := make([]*header.Bot, 0)
-	for iter.Scan(&botb) {
-		bot := &header.Bot{}
-		proto.Unmarshal(botb, bot)
+	for _, bot := range bots {
 		bot.WelcomeMessages = searchWelcomeMessage(bot.Action)
 		bot.Action = nil
 		if bot.GetState() != pb.Agent_deleted.String() {
 			list = append(list, bot)
 		}
 	}
-	if err := iter.Close(); err != nil {
-		return nil, log.ERetry(err, log.M{"account_id": accid})
-	}
 
-	cache.Set("bot."+accid, list)
+	me.cacheSet("bot", accid, list)
 	return list, nil
 }
 
-func listAIAgentsDB(accid string) (map[string]*header.AIAgent, error) {
-	subscribe(accid, "ai_agent")
-	waitUntilReady()
-	iter := session.Query(`SELECT id, data FROM workflow.ai_agents WHERE accid=?`, accid).Iter()
-	aiAgentM := map[string]*header.AIAgent{}
-	var data []byte
-	var id string
-	for iter.Scan(&id, &data) {
-		agent := &header.AIAgent{}
-		proto.Unmarshal(data, agent)
-		agent.Id = id
-		aiAgentM[id] = agent
-		data = []byte{}
+func (me *Client) listAIAgentsDB(ctx context.Context, accid string) (map[string]*header.AIAgent, error) {
+	me.subscribe(accid, "ai_agent")
+	if err := me.waitUntilReady(ctx); err != nil {
+		return nil, err
+	}
+	agents, err := me.store.ListAIAgents(ctx, accid)
+	if err != nil {
+		return nil, err
 	}
-	if err := iter.Close(); err != nil {
-		return nil, log.ERetry(err, log.M{"account_id": accid})
+
+	aiAgentM := map[string]*header.AIAgent{}
+	for _, agent := range agents {
+		aiAgentM[agent.GetId()] = agent
 	}
 
-	cache.Set("ai_agent."+accid, aiAgentM)
+	me.cacheSet("ai_agent", accid, aiAgentM)
 	return aiAgentM, nil
 }
 
-func GetAgent(accid, agid string) (*pb.Agent, error) {
-	agM, err := ListAgentM(accid)
+func (me *Client) GetAgent(ctx context.Context, accid, agid string) (*pb.Agent, error) {
+	ctx, span := me.startSpan(ctx, "GetAgent", accid)
+	defer span.End()
+	agM, err := me.ListAgentM(NoCopy(ctx), accid)
 	if err != nil {
 		return nil, err
 	}
 
 	ag, has := agM[agid]
 	if has {
-		return ag, nil
+		return copyOf(ctx, ag), nil
 	}
 
 	if strings.HasPrefix(agid, "at") {
-		aiag, err := GetAIAgent(accid, agid)
+		aiag, err := me.GetAIAgent(ctx, accid, agid)
 		if err != nil {
 			return nil, err
 		}
@@ -671,7 +524,7 @@ func GetAgent(accid, agid string) (*pb.Agent, error) {
 	}
 
 	if strings.HasPrefix(agid, "bb") {
-		bot, err := GetBot(accid, agid)
+		bot, err := me.GetBot(ctx, accid, agid)
 		if err != nil {
 			return nil, err
 		}
@@ -722,8 +575,10 @@ func Bot2Agent(bot *header.Bot) *pb.Agent {
 	}
 }
 
-func ListAgentsInGroup(accid, groupid string) ([]*pb.Agent, error) {
-	groups, err := ListGroups(accid)
+func (me *Client) ListAgentsInGroup(ctx context.Context, accid, groupid string) ([]*pb.Agent, error) {
+	ctx, span := me.startSpan(ctx, "ListAgentsInGroup", accid)
+	defer span.End()
+	groups, err := me.ListGroups(NoCopy(ctx), accid)
 	if err != nil {
 		return nil, err
 	}
@@ -732,7 +587,7 @@ func ListAgentsInGroup(accid, groupid string) ([]*pb.Agent, error) {
 		if group.GetId() == groupid {
 			out := make([]*pb.Agent, 0)
 			for _, id := range group.GetAgentIds() {
-				if ag, err := GetAgent(accid, id); err != nil {
+				if ag, err := me.GetAgent(ctx, accid, id); err != nil {
 					return nil, err
 				} else {
 					out = append(out, ag)
@@ -744,88 +599,70 @@ func ListAgentsInGroup(accid, groupid string) ([]*pb.Agent, error) {
 	return nil, nil
 }
 
-func ListAgentM(accid string) (map[string]*pb.Agent, error) {
-	waitUntilReady()
-	defer header.KLock("acclient_list_agent." + accid)()
-	// cache exists
-	if value, found := cache.Get("agent." + accid); found {
-		if value == nil {
-			return nil, nil
-		}
-		return value.(map[string]*pb.Agent), nil
+func (me *Client) ListAgentM(ctx context.Context, accid string) (map[string]*pb.Agent, error) {
+	ctx, span := me.startSpan(ctx, "ListAgentM", accid)
+	defer span.End()
+	if err := me.waitUntilReady(ctx); err != nil {
+		return nil, err
 	}
-
-	return listAgentsDB(accid)
+	return load(ctx, me, "agent", accid, me.listAgentsDB)
 }
 
-func ListGroups(accid string) ([]*header.AgentGroup, error) {
-	waitUntilReady()
-	// cache exists
-	if value, found := cache.Get("agent_group." + accid); found {
-		if value == nil {
-			return nil, nil
-		}
-		return value.([]*header.AgentGroup), nil
+func (me *Client) ListGroups(ctx context.Context, accid string) ([]*header.AgentGroup, error) {
+	ctx, span := me.startSpan(ctx, "ListGroups", accid)
+	defer span.End()
+	if err := me.waitUntilReady(ctx); err != nil {
+		return nil, err
 	}
-	return listGroupsDB(accid)
+	return load(ctx, me, "agent_group", accid, me.listGroupsDB)
 }
 
-func GetGroup(accid, grid string) (*header.AgentGroup, error) {
-	groups, err := ListGroups(accid)
+func (me *Client) GetGroup(ctx context.Context, accid, grid string) (*header.AgentGroup, error) {
+	ctx, span := me.startSpan(ctx, "GetGroup", accid)
+	defer span.End()
+	groups, err := me.ListGroups(NoCopy(ctx), accid)
 	if err != nil {
 		return nil, err
 	}
 
 	for _, gr := range groups {
 		if gr.GetId() == grid {
-			return gr, nil
+			return copyOf(ctx, gr), nil
 		}
 	}
 
 	return nil, nil
 }
 
-func listGroupsDB(accid string) ([]*header.AgentGroup, error) {
-	subscribe(accid, "agent_group")
-	waitUntilReady()
-	var arr = make([]*header.AgentGroup, 0)
-	iter := session.Query("SELECT id, data FROM account.agent_groups WHERE account_id=? LIMIT 500", accid).Iter()
-	var id string
-	data := make([]byte, 0)
-	for iter.Scan(&id, &data) {
-		group := &header.AgentGroup{}
-		if err := proto.Unmarshal(data, group); err != nil {
-			return nil, log.EData(err, data, log.M{"account_id": accid, "group_id": id})
-		}
-		group.AccountId = accid
-		group.Id = id
-		data = make([]byte, 0)
-		arr = append(arr, group)
+func (me *Client) listGroupsDB(ctx context.Context, accid string) ([]*header.AgentGroup, error) {
+	me.subscribe(accid, "agent_group")
+	if err := me.waitUntilReady(ctx); err != nil {
+		return nil, err
 	}
-	if err := iter.Close(); err != nil {
-		return nil, log.ERetry(err, log.M{"account_id": accid})
+	arr, err := me.store.ListAgentGroups(ctx, accid)
+	if err != nil {
+		return nil, err
 	}
-	cache.Set("agent_group."+accid, arr)
+	me.cacheSet("agent_group", accid, arr)
 	return arr, nil
 }
 
-func ListOnlineAgents(accid string) ([]*pb.Presence, error) {
-	waitUntilReady()
-	// cache exists
-	if value, found := cache.Get("presence." + accid); found {
-		if value == nil {
-			return nil, nil
-		}
-		return value.([]*pb.Presence), nil
+func (me *Client) ListOnlineAgents(ctx context.Context, accid string) ([]*pb.Presence, error) {
+	ctx, span := me.startSpan(ctx, "ListOnlineAgents", accid)
+	defer span.End()
+	if err := me.waitUntilReady(ctx); err != nil {
+		return nil, err
 	}
-	return listPresencesDB(accid)
+	return load(ctx, me, "presence", accid, me.listPresencesDB)
 }
 
-func listPresencesDB(accid string) ([]*pb.Presence, error) {
-	waitUntilReady()
-	subscribe(accid, "presence")
+func (me *Client) listPresencesDB(ctx context.Context, accid string) ([]*pb.Presence, error) {
+	if err := me.waitUntilReady(ctx); err != nil {
+		return nil, err
+	}
+	me.subscribe(accid, "presence")
 
-	pres, err := accmgr.ListAgentOnlines(header.ToGrpcCtx(&compb.Context{
+	pres, err := me.accmgr.ListAgentOnlines(toGrpcCtx(ctx, &compb.Context{
 		AccountId: accid,
 		Credential: &compb.Credential{
 			Issuer: hostname,
@@ -838,13 +675,17 @@ func listPresencesDB(accid string) ([]*pb.Presence, error) {
 		return nil, err
 	}
 	presences := pres.GetPresences()
-	cache.Set("presence."+accid, presences)
+	me.cacheSet("presence", accid, presences)
 	return presences, nil
 }
 
-func ListActiveAccountIds() ([]string, error) {
-	waitUntilReady()
-	res, err := accmgr.ListActiveAccountIds(header.ToGrpcCtx(&compb.Context{
+func (me *Client) ListActiveAccountIds(ctx context.Context) ([]string, error) {
+	ctx, span := me.startSpan(ctx, "ListActiveAccountIds", "")
+	defer span.End()
+	if err := me.waitUntilReady(ctx); err != nil {
+		return nil, err
+	}
+	res, err := me.accmgr.ListActiveAccountIds(toGrpcCtx(ctx, &compb.Context{
 		Credential: &compb.Credential{Issuer: hostname, Type: compb.Type_subiz},
 	}), &header.Id{})
 	if err != nil {
@@ -853,151 +694,132 @@ func ListActiveAccountIds() ([]string, error) {
 	return res.GetIds(), nil
 }
 
-func GetAIAgent(accid, agid string) (*header.AIAgent, error) {
-	aiags, err := ListAIAgents(accid)
+func (me *Client) GetAIAgent(ctx context.Context, accid, agid string) (*header.AIAgent, error) {
+	ctx, span := me.startSpan(ctx, "GetAIAgent", accid)
+	defer span.End()
+	aiags, err := me.ListAIAgents(NoCopy(ctx), accid)
 	if err != nil {
 		return nil, err
 	}
 
-	return aiags[agid], nil
+	return copyOf(ctx, aiags[agid]), nil
 }
 
-func GetBot(accid, botid string) (*header.Bot, error) {
-	bots, err := ListBots(accid)
+func (me *Client) GetBot(ctx context.Context, accid, botid string) (*header.Bot, error) {
+	ctx, span := me.startSpan(ctx, "GetBot", accid)
+	defer span.End()
+	bots, err := me.ListBots(NoCopy(ctx), accid)
 	if err != nil {
 		return nil, err
 	}
 
 	for _, bot := range bots {
 		if bot.GetId() == botid {
-			return bot, nil
+			return copyOf(ctx, bot), nil
 		}
 	}
 	return nil, nil
 }
 
-func ListBots(accid string) ([]*header.Bot, error) {
-	waitUntilReady()
-	// cache exists
-	if value, found := cache.Get("bot." + accid); found {
-		if value == nil {
-			return nil, nil
-		}
-		return value.([]*header.Bot), nil
+func (me *Client) ListBots(ctx context.Context, accid string) ([]*header.Bot, error) {
+	ctx, span := me.startSpan(ctx, "ListBots", accid)
+	defer span.End()
+	if err := me.waitUntilReady(ctx); err != nil {
+		return nil, err
 	}
-	return listBotsDB(accid)
+	return load(ctx, me, "bot", accid, me.listBotsDB)
 }
 
-func ListAIAgents(accid string) (map[string]*header.AIAgent, error) {
-	waitUntilReady()
-	// cache exists
-	if value, found := cache.Get("ai_agent." + accid); found {
-		if value == nil {
-			return nil, nil
-		}
-		return value.(map[string]*header.AIAgent), nil
-	}
-	return listAIAgentsDB(accid)
-}
-
-func listPipelineDB(accid string) ([]*header.Pipeline, error) {
-	waitUntilReady()
-	subscribe(accid, "pipeline")
-	iter := session.Query(`SELECT id, pipeline FROM apiece.pipelines WHERE account_id=? LIMIT 100`, accid).Iter()
-	pipelines := make([]*header.Pipeline, 0)
-	var dbid string
-	var pipelineb []byte
-	for iter.Scan(&dbid, &pipelineb) {
-		pipeline := &header.Pipeline{}
-		proto.Unmarshal(pipelineb, pipeline)
-		pipeline.AccountId = accid
-		pipeline.Id = dbid
-		pipelines = append(pipelines, pipeline)
-	}
-	err := iter.Close()
+func (me *Client) ListAIAgents(ctx context.Context, accid string) (map[string]*header.AIAgent, error) {
+	ctx, span := me.startSpan(ctx, "ListAIAgents", accid)
+	defer span.End()
+	if err := me.waitUntilReady(ctx); err != nil {
+		return nil, err
+	}
+	return load(ctx, me, "ai_agent", accid, me.listAIAgentsDB)
+}
+
+func (me *Client) listPipelineDB(ctx context.Context, accid string) ([]*header.Pipeline, error) {
+	if err := me.waitUntilReady(ctx); err != nil {
+		return nil, err
+	}
+	me.subscribe(accid, "pipeline")
+	pipelines, err := me.store.ListPipelines(ctx, accid)
 	if err != nil {
-		return nil, log.ERetry(err, log.M{"account_id": accid})
+		return nil, err
 	}
-	cache.Set("pipeline."+accid, pipelines)
+	me.cacheSet("pipeline", accid, pipelines)
 	return pipelines, nil
 }
 
-func ListPipelines(accid string) ([]*header.Pipeline, error) {
-	waitUntilReady()
-	// cache exists
-	if value, found := cache.Get("pipeline." + accid); found {
-		if value == nil {
-			return nil, nil
-		}
-		return value.([]*header.Pipeline), nil
+func (me *Client) ListPipelines(ctx context.Context, accid string) ([]*header.Pipeline, error) {
+	ctx, span := me.startSpan(ctx, "ListPipelines", accid)
+	defer span.End()
+	if err := me.waitUntilReady(ctx); err != nil {
+		return nil, err
 	}
-	return listPipelineDB(accid)
+	return load(ctx, me, "pipeline", accid, me.listPipelineDB)
 }
 
-func SignKey(accid, issuer, typ, keytype string, objects []string) (string, error) {
-	waitUntilReady()
+func (me *Client) SignKey(ctx context.Context, accid, issuer, typ, keytype string, objects []string) (string, error) {
+	ctx, span := me.startSpan(ctx, "SignKey", accid)
+	defer span.End()
+	if err := me.waitUntilReady(ctx); err != nil {
+		return "", err
+	}
 	key := randomID("SK", 28)
-	err := session.Query(`INSERT INTO account.signed_key(account_id, issuer, type, objects, key_type, key, created) VALUES(?,?,?,?,?,?,?)`, accid, issuer, typ, objects, keytype, key, time.Now().UnixMilli()).Exec()
+	err := me.store.InsertSignedKey(ctx, accid, issuer, typ, keytype, key, objects, time.Now().UnixMilli())
 	if err != nil {
-		return "", log.ERetry(err, log.M{"account_id": accid, "issuer": issuer, "type": typ, "keytype": keytype})
+		return "", err
 	}
 
 	return key, nil
 }
 
-func LookupSignedKey(key string) (string, string, string, string, []string, error) {
-	waitUntilReady()
-	var accid, issuer, typ, keytype string
-	objects := make([]string, 0)
-	err := session.Query(`SELECT account_id, issuer, type, key_type, objects FROM account.signed_key WHERE key=?`, key).Scan(&accid, &issuer, &typ, &keytype, &objects)
-	if err != nil {
-		return "", "", "", "", nil, log.ERetry(err, log.M{"key": key})
-	}
-
-	if err != nil && err.Error() == gocql.ErrNotFound.Error() {
-		return "", "", "", "", nil, nil
+func (me *Client) LookupSignedKey(ctx context.Context, key string) (string, string, string, string, []string, error) {
+	ctx, span := me.startSpan(ctx, "LookupSignedKey", "")
+	defer span.End()
+	if err := me.waitUntilReady(ctx); err != nil {
+		return "", "", "", "", nil, err
 	}
-
-	return accid, issuer, typ, keytype, objects, nil
+	return me.store.LookupSignedKey(ctx, key)
 }
 
-func ListDefs(accid string) (map[string]*header.AttributeDefinition, error) {
-	waitUntilReady()
-	if value, found := cache.Get("attribute_definition." + accid); found {
-		if value == nil {
-			return nil, nil
-		}
-		return value.(map[string]*header.AttributeDefinition), nil
+func (me *Client) ListDefs(ctx context.Context, accid string) (map[string]*header.AttributeDefinition, error) {
+	ctx, span := me.startSpan(ctx, "ListDefs", accid)
+	defer span.End()
+	if err := me.waitUntilReady(ctx); err != nil {
+		return nil, err
 	}
-	return listAttrDefsDB(accid)
+	return load(ctx, me, "attribute_definition", accid, me.listAttrDefsDB)
 }
 
 // for testing
-func SetShopSetting(accid string, setting *header.ShopSetting) {
-	waitUntilReady()
-	cache.Set("shop_setting."+accid, setting)
+func (me *Client) SetShopSetting(accid string, setting *header.ShopSetting) {
+	if me.waitUntilReady(context.Background()) != nil {
+		return
+	}
+	me.cacheSet("shop_setting", accid, setting)
 }
 
-func GetShopSetting(accid string) (*header.ShopSetting, error) {
-	waitUntilReady()
-	// cache hit
-	if value, found := cache.Get("shop_setting." + accid); found {
-		if value == nil {
-			return nil, nil
-		}
-		return value.(*header.ShopSetting), nil
+func (me *Client) GetShopSetting(ctx context.Context, accid string) (*header.ShopSetting, error) {
+	ctx, span := me.startSpan(ctx, "GetShopSetting", accid)
+	defer span.End()
+	if err := me.waitUntilReady(ctx); err != nil {
+		return nil, err
 	}
-
-	return getShopSettingDb(accid)
+	return load(ctx, me, "shop_setting", accid, me.getShopSettingDb)
 }
 
 // account currency /order currency  (E.g: order currency: VND, acc currency: USD, => currency_rate = 1/20k = 0.00005)
-func ConvertToFPV(accid string, price float32, order_cur string) (int64, float32, error) {
-	acc, err := GetAccount(accid)
+func (me *Client) ConvertToFPV(ctx context.Context, accid string, price float32, order_cur string) (int64, float32, error) {
+	ctx, span := me.startSpan(ctx, "ConvertToFPV", accid)
+	defer span.End()
+	acc, err := me.GetAccount(NoCopy(ctx), accid)
 	if err != nil {
 		return 0, 0, err
 	}
-	setting, err := GetShopSetting(accid)
+	setting, err := me.GetShopSetting(NoCopy(ctx), accid)
 	if err != nil {
 		return 0, 0, err
 	}
@@ -1072,8 +894,12 @@ func randomID(sign string, randomfactor int) string {
 //    FPV: 20000000,
 // }
 
-func ShortenLink(accid, link string) (string, error) {
-	waitUntilReady()
+func (me *Client) ShortenLink(ctx context.Context, accid, link string) (string, error) {
+	ctx, span := me.startSpan(ctx, "ShortenLink", accid)
+	defer span.End()
+	if err := me.waitUntilReady(ctx); err != nil {
+		return "", err
+	}
 	link = header.Norm(link, 2000)
 	if link == "" || link == "/" {
 		return link, nil
@@ -1087,7 +913,7 @@ func ShortenLink(accid, link string) (string, error) {
 	params := neturl.Values{}
 	params.Add("url", link)
 	params.Add("account-id", accid)
-	resp, err := http.Post(getApiHost(accid)+"/4.1/shorten-links?"+params.Encode(), "application/json", nil)
+	resp, err := httpPost(ctx, getApiHost(accid)+"/4.1/shorten-links?"+params.Encode(), nil)
 	if err != nil {
 		return "", log.EInternalConnect(err, log.M{"account_id": accid, "url": "/4.1/shorten-links/"})
 	}
@@ -1117,7 +943,9 @@ func ShortenLink(accid, link string) (string, error) {
 const SHORTENDOMAIN = "a.sbz.vn"
 
 // shorten=/11kG
-func LookupLink(shorten string) (*header.Link, error) {
+func (me *Client) LookupLink(ctx context.Context, shorten string) (*header.Link, error) {
+	ctx, span := me.startSpan(ctx, "LookupLink", "")
+	defer span.End()
 	if strings.HasPrefix(shorten, "http:") || strings.HasPrefix(shorten, "https:") {
 		if !strings.Contains(shorten, SHORTENDOMAIN) {
 			return &header.Link{Url: shorten}, nil
@@ -1139,65 +967,66 @@ func LookupLink(shorten string) (*header.Link, error) {
 		shorten = shorten[:i]
 	}
 
-	waitUntilReady()
-	cachekey := "shortenlink." + shorten
-	if val, has := cache.Get(cachekey); has {
-		return val.(*header.Link), nil
-	}
-
-	link, err := registryClient.LookupLink(context.Background(), &header.String{Str: shorten})
-	if err != nil {
+	if err := me.waitUntilReady(ctx); err != nil {
 		return nil, err
 	}
-	cache.Set(cachekey, link)
-	return link, nil
-}
-
-func NewID_(accid, scope string) int64 {
-	waitUntilReady()
-	for range 100 {
-		id, err := accmgr.NewID(context.Background(), &header.Id{AccountId: accid, Id: scope})
+	return load(ctx, me, "shortenlink", shorten, func(ctx context.Context, shorten string) (*header.Link, error) {
+		link, err := me.registryClient.LookupLink(ctx, &header.String{Str: shorten})
 		if err != nil {
-			time.Sleep(1 * time.Second)
-			continue
+			return nil, err
 		}
-		idint, _ := strconv.ParseInt(id.Id, 10, 0)
-		return idint
-	}
-	return -1
+		me.cacheSet("shortenlink", shorten, link)
+		return link, nil
+	})
 }
 
-func NewID2(accid, scope string) int64 {
+func (me *Client) NewID_(ctx context.Context, accid, scope string) (int64, error) {
+	ctx, span := me.startSpan(ctx, "NewID_", accid)
+	defer span.End()
+	return me.callID(ctx, func(ctx context.Context) (*header.Id, error) {
+		return me.accmgr.NewID(ctx, &header.Id{AccountId: accid, Id: scope})
+	})
+}
+
+func (me *Client) NewID2(ctx context.Context, accid, scope string) (int64, error) {
+	ctx, span := me.startSpan(ctx, "NewID2", accid)
+	defer span.End()
 	scope = header.Ascii(scope)
-	waitUntilReady()
-	for range 100 {
-		id, err := registryClient.NewID2(context.Background(), &header.Id{AccountId: accid, Id: scope})
-		if err != nil {
-			time.Sleep(1 * time.Second)
-			continue
-		}
-		idint, _ := strconv.ParseInt(id.Id, 10, 0)
-		return idint
-	}
-	return -1
+	return me.callID(ctx, func(ctx context.Context) (*header.Id, error) {
+		return me.registryClient.NewID2(ctx, &header.Id{AccountId: accid, Id: scope})
+	})
 }
 
-func GetLastID(accid, scope string) int64 {
+func (me *Client) GetLastID(ctx context.Context, accid, scope string) (int64, error) {
+	ctx, span := me.startSpan(ctx, "GetLastID", accid)
+	defer span.End()
 	scope = header.Ascii(scope)
-	waitUntilReady()
-	for range 100 {
-		id, err := registryClient.GetLastID(context.Background(), &header.Id{AccountId: accid, Id: scope})
-		if err != nil {
-			time.Sleep(1 * time.Second)
-			continue
-		}
-		idint, _ := strconv.ParseInt(id.Id, 10, 0)
-		return idint
+	return me.callID(ctx, func(ctx context.Context) (*header.Id, error) {
+		return me.registryClient.GetLastID(ctx, &header.Id{AccountId: accid, Id: scope})
+	})
+}
+
+// callID calls an ID generator following the retry policy
+func (me *Client) callID(ctx context.Context, call func(context.Context) (*header.Id, error)) (int64, error) {
+	if err := me.waitUntilReady(ctx); err != nil {
+		return 0, err
+	}
+	var id *header.Id
+	err := me.retry.Do(ctx, func(ctx context.Context) error {
+		var err error
+		id, err = call(ctx)
+		return err
+	})
+	if err != nil {
+		return 0, err
 	}
-	return -1
+	idint, _ := strconv.ParseInt(id.GetId(), 10, 0)
+	return idint, nil
 }
 
-func GetAttrAsStringWithDateFormat(user *header.User, key, dateformat string) string {
+func (me *Client) GetAttrAsStringWithDateFormat(ctx context.Context, user *header.User, key, dateformat string) string {
+	ctx, span := me.startSpan(ctx, "GetAttrAsStringWithDateFormat", "")
+	defer span.End()
 	accid := user.AccountId
 	if accid == "" {
 		return ""
@@ -1215,7 +1044,7 @@ func GetAttrAsStringWithDateFormat(user *header.User, key, dateformat string) st
 		return ""
 	}
 
-	defM, _ := ListDefs(accid)
+	defM, _ := me.ListDefs(NoCopy(ctx), accid)
 	if defM == nil {
 		return ""
 	}
@@ -1247,7 +1076,7 @@ func GetAttrAsStringWithDateFormat(user *header.User, key, dateformat string) st
 		if timezone == "" {
 			// fallback to account timeonze
 			// to get timezone
-			acc, _ := GetAccount(accid)
+			acc, _ := me.GetAccount(NoCopy(ctx), accid)
 			timezone = acc.GetTimezone()
 		}
 
@@ -1263,7 +1092,9 @@ func GetAttrAsStringWithDateFormat(user *header.User, key, dateformat string) st
 	return ""
 }
 
-func GetAttrAsString(user *header.User, key string) string {
+func (me *Client) GetAttrAsString(ctx context.Context, user *header.User, key string) string {
+	ctx, span := me.startSpan(ctx, "GetAttrAsString", "")
+	defer span.End()
 	var foundAttr *header.Attribute
 	for _, attr := range user.Attributes {
 		if attr.GetKey() == key {
@@ -1276,7 +1107,7 @@ func GetAttrAsString(user *header.User, key string) string {
 		return ""
 	}
 
-	defM, _ := ListDefs(user.AccountId)
+	defM, _ := me.ListDefs(NoCopy(ctx), user.AccountId)
 	if defM == nil {
 		return ""
 	}
@@ -1309,10 +1140,14 @@ func GetAttrAsString(user *header.User, key string) string {
 }
 
 // currency: VND, USD
-func GetCreditUsage(accid string, filters []string, currency string) (int64, error) {
-	waitUntilReady()
-	ctx := header.ToGrpcCtx(&compb.Context{AccountId: accid, Credential: &compb.Credential{Type: compb.Type_subiz}})
-	res, err := creditmgr.GetTotalCreditSpend(ctx, &header.CreditSpendReportRequest{AccountId: accid, Filters: filters, Currency: currency})
+func (me *Client) GetCreditUsage(ctx context.Context, accid string, filters []string, currency string) (int64, error) {
+	ctx, span := me.startSpan(ctx, "GetCreditUsage", accid)
+	defer span.End()
+	if err := me.waitUntilReady(ctx); err != nil {
+		return 0, err
+	}
+	gctx := toGrpcCtx(ctx, &compb.Context{AccountId: accid, Credential: &compb.Credential{Type: compb.Type_subiz}})
+	res, err := me.creditmgr.GetTotalCreditSpend(gctx, &header.CreditSpendReportRequest{AccountId: accid, Filters: filters, Currency: currency})
 	if err != nil {
 		return 0, err
 	}
@@ -1331,14 +1166,18 @@ func SpendItemToCredit(item string) Credit {
 	}
 }
 
-func TrySpend(accid string, item string, fpvunitpricevnd int64) error {
-	waitUntilReady()
+func (me *Client) TrySpend(ctx context.Context, accid string, item string, fpvunitpricevnd int64) error {
+	ctx, span := me.startSpan(ctx, "TrySpend", accid)
+	defer span.End()
+	if err := me.waitUntilReady(ctx); err != nil {
+		return err
+	}
 	if accid == "" {
 		return nil // alway allow
 	}
 
 	creditId := SpendItemToCredit(item)
-	sub, err := GetSubscription(accid)
+	sub, err := me.GetSubscription(NoCopy(ctx), accid)
 	if err != nil {
 		return err
 	}
@@ -1363,7 +1202,7 @@ func TrySpend(accid string, item string, fpvunitpricevnd int64) error {
 		}
 	}
 
-	_, err = creditmgr.TrySpendCredit(context.Background(), &header.CreditSpendEntry{
+	_, err = me.creditmgr.TrySpendCredit(ctx, &header.CreditSpendEntry{
 		AccountId:       accid,
 		CreditId:        string(creditId),
 		Quantity:        1,
@@ -1377,14 +1216,14 @@ type Credit string
 const MARKETING Credit = "marketing" // currency VND
 const BALANCE Credit = "balance"     // currency USD
 
-func Spend(accid string, itemType, source string, fpvunitpricevnd int64, data *header.CreditEntryData) {
+func (me *Client) Spend(accid string, itemType, source string, fpvunitpricevnd int64, data *header.CreditEntryData) {
 	if accid == "" {
 		log.Track(context.Background(), "record-credit-missing-account-id")
 		return
 	}
 
 	creditId := SpendItemToCredit(itemType)
-	kafka.Publish("kafkaatm:9094", "credit-spend-log", &header.CreditSpendEntry{
+	me.publisher.Publish("credit-spend-log", &header.CreditSpendEntry{
 		AccountId:       accid,
 		CreditId:        string(creditId),
 		Id:              idgen.NewPaymentLogID(),
@@ -1397,9 +1236,13 @@ func Spend(accid string, itemType, source string, fpvunitpricevnd int64, data *h
 	})
 }
 
-func Notify(accid, topic string) {
-	waitUntilReady()
-	numpubsub.Fire(context.Background(), &header.PsMessage{
+func (me *Client) Notify(ctx context.Context, accid, topic string) {
+	ctx, span := me.startSpan(ctx, "Notify", accid)
+	defer span.End()
+	if me.waitUntilReady(ctx) != nil {
+		return
+	}
+	me.numpubsub.Fire(ctx, &header.PsMessage{
 		AccountId: accid,
 		Event: &header.Event{
 			AccountId: accid,
@@ -1410,35 +1253,7 @@ func Notify(accid, topic string) {
 	})
 }
 
-func pollLoop() {
-	connId := idgen.NewPollingConnId("0", "", randstr.Hex(8))
-	for {
-		time.Sleep(1 * time.Second)
-		topics := []string{}
-		subscribeTopicLock.Lock()
-		for topic := range subscribeTopics {
-			topics = append(topics, topic)
-		}
-		subscribeTopicLock.Unlock()
-
-		out, err := numpubsub.Poll(context.Background(), &header.RealtimeSubscription{Events: topics, ConnectionId: connId})
-		if err != nil {
-			fmt.Println("ERR", connId, err)
-			time.Sleep(30 * time.Second)
-			continue
-		}
-		for _, event := range out.GetEvents() {
-			accid := event.GetAccountId()
-			if accid == "" {
-				continue
-			}
-			cache.Delete(event.GetType() + "." + accid)
-		}
-	}
-}
-
 var emptyM = map[string]bool{}
-var agentScopeCache = gocache.New(30 * time.Second)
 
 func joinMap(a, b map[string]bool) {
 	for k, v := range b {
@@ -1455,7 +1270,9 @@ func MustBeSuperAdmin(cred *compb.Credential) error {
 	return log.NewError(nil, log.M{}, log.E_access_deny)
 }
 
-func AccessFeature(accid string, objectType header.ObjectType, action header.ObjectAction, cred *compb.Credential) error {
+func (me *Client) AccessFeature(ctx context.Context, accid string, objectType header.ObjectType, action header.ObjectAction, cred *compb.Credential) error {
+	ctx, span := me.startSpan(ctx, "AccessFeature", accid)
+	defer span.End()
 	if action == "" {
 		return nil
 	}
@@ -1471,7 +1288,7 @@ func AccessFeature(accid string, objectType header.ObjectType, action header.Obj
 		return log.NewError(nil, log.M{"account_id": accid, "cred_type": cred.GetType(), "issuer": cred.GetIssuer()}, log.E_access_deny)
 	}
 
-	acc, err := GetAccount(accid)
+	acc, err := me.GetAccount(NoCopy(ctx), accid)
 	if err != nil {
 		return err
 	}
@@ -1480,7 +1297,7 @@ func AccessFeature(accid string, objectType header.ObjectType, action header.Obj
 		return log.EAccountLocked(accid)
 	}
 
-	agent, err := GetAgent(accid, cred.GetIssuer())
+	agent, err := me.GetAgent(NoCopy(ctx), accid, cred.GetIssuer())
 	if err != nil {
 		return err
 	}
@@ -1504,7 +1321,9 @@ func AccessFeature(accid string, objectType header.ObjectType, action header.Obj
 	return log.NewError(nil, log.M{"account_id": accid, "cred_type": cred.GetType(), "issuer": cred.GetIssuer()}, log.E_access_deny)
 }
 
-func CheckPerm(objectType header.ObjectType, action header.ObjectAction, accid, issuer, issuertype string, isOwned, isAssigned bool, resourceGroups ...header.IResourceGroup) error {
+func (me *Client) CheckPerm(ctx context.Context, objectType header.ObjectType, action header.ObjectAction, accid, issuer, issuertype string, isOwned, isAssigned bool, resourceGroups ...header.IResourceGroup) error {
+	ctx, span := me.startSpan(ctx, "CheckPerm", accid)
+	defer span.End()
 	if issuertype == "system" || issuertype == "subiz" || issuertype == "connector" {
 		return nil
 	}
@@ -1513,7 +1332,7 @@ func CheckPerm(objectType header.ObjectType, action header.ObjectAction, accid,
 		return nil
 	}
 
-	acc, err := GetAccount(accid)
+	acc, err := me.GetAccount(NoCopy(ctx), accid)
 	if err != nil {
 		return err
 	}
@@ -1523,7 +1342,7 @@ func CheckPerm(objectType header.ObjectType, action header.ObjectAction, accid,
 	}
 
 	for _, resourceGroup := range resourceGroups {
-		pM, err := GetAgentPerm(accid, issuer, resourceGroup)
+		pM, err := me.GetAgentPerm(NoCopy(ctx), accid, issuer, resourceGroup)
 		if err != nil {
 			return err
 		}
@@ -1533,7 +1352,7 @@ func CheckPerm(objectType header.ObjectType, action header.ObjectAction, accid,
 	}
 
 	if len(resourceGroups) == 0 && accid != "" {
-		agent, err := GetAgent(accid, issuer)
+		agent, err := me.GetAgent(NoCopy(ctx), accid, issuer)
 		if err != nil {
 			return err
 		}
@@ -1573,7 +1392,9 @@ func CheckAgentPerm(objectType header.ObjectType, action header.ObjectAction, pe
 	return false
 }
 
-func GetAgentPerm(accid, agid string, resourceGroup header.IResourceGroup) (map[string]bool, error) {
+func (me *Client) GetAgentPerm(ctx context.Context, accid, agid string, resourceGroup header.IResourceGroup) (map[string]bool, error) {
+	ctx, span := me.startSpan(ctx, "GetAgentPerm", accid)
+	defer span.End()
 	if accid == "" || agid == "" {
 		return emptyM, nil
 	}
@@ -1582,17 +1403,18 @@ func GetAgentPerm(accid, agid string, resourceGroup header.IResourceGroup) (map[
 	if resourceGroup != nil {
 		resourceGroupId = resourceGroup.GetId()
 	}
-	if value, found := agentScopeCache.Get(accid + "_" + agid + "_" + resourceGroupId); found && value != nil {
-		return value.(map[string]bool), nil
+	cacheid := accid + "_" + agid + "_" + resourceGroupId
+	if value, found := cacheGet[map[string]bool](ctx, me, "agent_scope", cacheid); found && value != nil {
+		return value, nil
 	}
 
-	agent, err := GetAgent(accid, agid)
+	agent, err := me.GetAgent(NoCopy(ctx), accid, agid)
 	if err != nil {
 		return nil, err
 	}
 
 	if agent == nil || agent.GetState() != "active" {
-		agentScopeCache.Set(accid+"_"+agid+"_"+resourceGroupId, emptyM)
+		me.cacheSet("agent_scope", cacheid, emptyM)
 		return emptyM, nil
 	}
 
@@ -1602,7 +1424,7 @@ func GetAgentPerm(accid, agid string, resourceGroup header.IResourceGroup) (map[
 		for _, scope := range agentScopes {
 			joinMap(permM, header.ScopeM[scope])
 		}
-		agentScopeCache.Set(accid+"_"+agid+"_"+resourceGroupId, permM)
+		me.cacheSet("agent_scope", cacheid, permM)
 		return permM, nil
 	}
 
@@ -1630,7 +1452,7 @@ func GetAgentPerm(accid, agid string, resourceGroup header.IResourceGroup) (map[
 		}
 		if myGroup == nil {
 			myGroup = map[string]bool{}
-			groups, err := ListGroups(accid)
+			groups, err := me.ListGroups(NoCopy(ctx), accid)
 			if err != nil {
 				return nil, err
 			}
@@ -1651,78 +1473,75 @@ func GetAgentPerm(accid, agid string, resourceGroup header.IResourceGroup) (map[
 	for _, scope := range agentScopes {
 		joinMap(permM, header.ScopeM[scope])
 	}
-	agentScopeCache.Set(accid+"_"+agid+"_"+resourceGroupId, permM)
+	me.cacheSet("agent_scope", cacheid, permM)
 	return permM, nil
 }
 
-func ListBlacklistIPs(accid string) (map[string]*header.BlacklistIP, error) {
-	waitUntilReady()
-
-	// cache exists
-	if value, found := cache.Get("blacklist_ip." + accid); found {
-		if value == nil {
-			return nil, nil
-		}
-		return value.(map[string]*header.BlacklistIP), nil
+func (me *Client) ListBlacklistIPs(ctx context.Context, accid string) (map[string]*header.BlacklistIP, error) {
+	ctx, span := me.startSpan(ctx, "ListBlacklistIPs", accid)
+	defer span.End()
+	if err := me.waitUntilReady(ctx); err != nil {
+		return nil, err
 	}
-	return listBlacklistIPsDB(accid)
+
+	return load(ctx, me, "blacklist_ip", accid, me.listBlacklistIPsDB)
 }
 
 // ListBlacklistIPs returns all blacklist IPs for an account
 // it may updates cache if needed
-func listBlacklistIPsDB(accid string) (map[string]*header.BlacklistIP, error) {
-	subscribe(accid, "blacklist_ip")
-	waitUntilReady()
+func (me *Client) listBlacklistIPsDB(ctx context.Context, accid string) (map[string]*header.BlacklistIP, error) {
+	me.subscribe(accid, "blacklist_ip")
+	if err := me.waitUntilReady(ctx); err != nil {
+		return nil, err
+	}
+
+	rows, err := me.store.ListBlacklistIPs(ctx, accid)
+	if err != nil {
+		return nil, err
+	}
 
 	ips := map[string]*header.BlacklistIP{}
-	iter := session.Query(`SELECT ip, "by", created, num_blocked, last_blocked, expired_at FROM api.wlips WHERE account_id=? LIMIT 1000`, accid).Iter()
-	var ip, by string
-	var created, num_blocked, expired, last_blocked int64
-	for iter.Scan(&ip, &by, &created, &num_blocked, &last_blocked, &expired) {
+	for _, ip := range rows {
+		expired := ip.GetExpiredAt()
 		if expired == 0 {
-			expired = clock.UnixMili(created) + 86400*90*1000 // 90 days after created
+			expired = clock.UnixMili(ip.GetCreated()) + 86400*90*1000 // 90 days after created
 		}
 
-		if last_blocked+expired < time.Now().UnixMilli() {
-			session.Query(`DELETE FROM api.wlips WHERE account_id=? AND ip=?`, accid, ip).Exec()
+		if ip.GetLastBlocked()+expired < time.Now().UnixMilli() {
+			me.store.DeleteBlacklistIP(ctx, accid, ip.GetIp())
 			continue
 		}
-		ips[ip] = &header.BlacklistIP{AccountId: accid, Ip: ip, By: by, Created: clock.UnixMili(created), NumBlocked: num_blocked, ExpiredAt: expired, LastBlocked: last_blocked}
+		ip.Created = clock.UnixMili(ip.GetCreated())
+		ip.ExpiredAt = expired
+		ips[ip.GetIp()] = ip
 	}
-	if err := iter.Close(); err != nil {
-		return nil, log.ERetry(err, log.M{"account_id": accid})
-	}
-	cache.Set("blacklist_ip."+accid, ips)
+	me.cacheSet("blacklist_ip", accid, ips)
 	return ips, nil
 }
 
-func ListBannedUsers(accid string) (map[string]*header.BannedUser, error) {
-	waitUntilReady()
-
-	// cache exists
-	if value, found := cache.Get("banned_user." + accid); found {
-		if value == nil {
-			return nil, nil
-		}
-		return value.(map[string]*header.BannedUser), nil
+func (me *Client) ListBannedUsers(ctx context.Context, accid string) (map[string]*header.BannedUser, error) {
+	ctx, span := me.startSpan(ctx, "ListBannedUsers", accid)
+	defer span.End()
+	if err := me.waitUntilReady(ctx); err != nil {
+		return nil, err
 	}
-	return listBannedUserDB(accid)
+
+	return load(ctx, me, "banned_user", accid, me.listBannedUserDB)
 }
 
-func listBannedUserDB(accid string) (map[string]*header.BannedUser, error) {
-	subscribe(accid, "banned_user")
+func (me *Client) listBannedUserDB(ctx context.Context, accid string) (map[string]*header.BannedUser, error) {
+	me.subscribe(accid, "banned_user")
 
-	users := map[string]*header.BannedUser{}
-	iter := session.Query(`SELECT user_id, "by", created FROM api.wlusers WHERE account_id=? LIMIT 10000`, accid).Iter()
-	var userid, by string
-	var created int64
-	for iter.Scan(&userid, &by, &created) {
-		users[userid] = &header.BannedUser{AccountId: accid, UserId: userid, By: by, Created: created}
+	rows, err := me.store.ListBannedUsers(ctx, accid)
+	if err != nil {
+		return nil, err
 	}
-	if err := iter.Close(); err != nil {
-		return nil, log.ERetry(err, log.M{"account_id": accid})
+
+	users := map[string]*header.BannedUser{}
+	for _, user := range rows {
+		users[user.GetUserId()] = user
 	}
-	cache.Set("banned_user."+accid, users)
+	me.cacheSet("banned_user", accid, users)
 	return users, nil
 }
 
@@ -1730,10 +1549,10 @@ const COUNTERSHARD = 4
 
 // TTL 30days
 // labels: ["code=success", "type=purchased", "_ts=ts"]
-func IncCounter(accid string, ts string, labels []string, payload []byte) {
+func (me *Client) IncCounter(accid string, ts string, labels []string, payload []byte) {
 	topic := "counter-" + strconv.Itoa(header.GetAccShard(accid, COUNTERSHARD))
 	labels = append(labels, "_ts="+ts)
-	kafka.Publish("kafkaatm:9094", topic, &header.CounterDataPoint{
+	me.publisher.Publish(topic, &header.CounterDataPoint{
 		AccountId: accid,
 		Labels:    labels,
 		Count:     1,
@@ -1742,13 +1561,6 @@ func IncCounter(accid string, ts string, labels []string, payload []byte) {
 	}, ts)
 }
 
-func subscribe(accid, topic string) {
-	waitUntilReady()
-	subscribeTopicLock.Lock()
-	subscribeTopics[topic+"."+accid] = true
-	subscribeTopicLock.Unlock()
-}
-
 func GetAccPar(accid string, N int) string {
 	if accid == "acpxkgumifuoofoosble" || accid == "acqsulrowbxiugvginhw" {
 		return "stg"
@@ -1757,20 +1569,25 @@ func GetAccPar(accid string, N int) string {
 }
 
 // for testing
-func SetDomainVerified(accid, domain string, verified bool) {
-	waitUntilReady()
+func (me *Client) SetDomainVerified(accid, domain string, verified bool) {
+	if me.waitUntilReady(context.Background()) != nil {
+		return
+	}
 	domain = strings.TrimPrefix(domain, "www.")
-	cachekey := "website." + accid + "/" + domain
-	cache.SetWithExpire(cachekey, verified, time.Hour)
+	me.cacheSetTTL("website", accid+"/"+domain, verified, time.Hour)
 }
 
-func IsDomainVerified(accid, domain string) (bool, error) {
-	waitUntilReady()
+func (me *Client) IsDomainVerified(ctx context.Context, accid, domain string) (bool, error) {
+	ctx, span := me.startSpan(ctx, "IsDomainVerified", accid)
+	defer span.End()
+	if err := me.waitUntilReady(ctx); err != nil {
+		return false, err
+	}
 	domains := strings.Split(domain, ".")
 
 	// example.com
 	if len(domains) <= 2 {
-		return IsExactDomainVerified(accid, domain)
+		return me.IsExactDomainVerified(ctx, accid, domain)
 	}
 
 	// support upto 10 sub domains
@@ -1782,7 +1599,7 @@ func IsDomainVerified(accid, domain string) (bool, error) {
 	// e.g. domain is a.b.c.com, it will check c.com, then b.c.com, then a.b.c.com
 	for i := len(domains) - 2; i >= 0; i-- {
 		thedomain := strings.Join(domains[i:], ".")
-		verified, err := IsExactDomainVerified(accid, thedomain)
+		verified, err := me.IsExactDomainVerified(ctx, accid, thedomain)
 		if err != nil {
 			return false, err
 		}
@@ -1795,7 +1612,6 @@ func IsDomainVerified(accid, domain string) (bool, error) {
 }
 
 func IsDomainSkip(domain string) bool {
-	waitUntilReady()
 	domain = strings.ToLower(strings.TrimPrefix(header.Norm(domain, 1000), "www."))
 	if skipDomainM[domain] {
 		return true
@@ -1814,8 +1630,12 @@ func IsDomainSkip(domain string) bool {
 	return false
 }
 
-func IsExactDomainVerified(accid, domain string) (bool, error) {
-	waitUntilReady()
+func (me *Client) IsExactDomainVerified(ctx context.Context, accid, domain string) (bool, error) {
+	ctx, span := me.startSpan(ctx, "IsExactDomainVerified", accid)
+	defer span.End()
+	if err := me.waitUntilReady(ctx); err != nil {
+		return false, err
+	}
 	domain = strings.ToLower(strings.TrimPrefix(header.Norm(domain, 1000), "www."))
 	if skipDomainM[domain] {
 		return false, nil
@@ -1832,29 +1652,22 @@ func IsExactDomainVerified(accid, domain string) (bool, error) {
 		}
 	}
 
-	cachekey := "website." + accid + "/" + domain
-	if value, found := cache.Get(cachekey); found {
-		if value == nil {
-			return false, nil
-		}
-		b, _ := value.(bool)
-		return b, nil
+	if verified, found := cacheGet[bool](ctx, me, "website", accid+"/"+domain); found {
+		return verified, nil
 	}
 
 	inteid := accid + "." + base64.StdEncoding.EncodeToString([]byte(domain)) + ".website"
-	data := make([]byte, 0)
-	err := session.Query("SELECT data FROM convo.channels WHERE account_id=? AND id=?", accid, inteid).Scan(&data)
-	if err != nil && err.Error() != gocql.ErrNotFound.Error() {
-		return false, log.ERetry(err, log.M{"account_id": accid, "domain": domain})
+	inte, err := me.store.GetIntegration(ctx, accid, inteid)
+	if err != nil {
+		return false, err
 	}
 
-	inte := &header.Integration{}
-	proto.Unmarshal(data, inte)
 	verified := inte.GetWebsiteVerified() > 0
+	// unverified domains are rechecked sooner
 	if verified {
-		cache.SetWithExpire(cachekey, verified, time.Hour)
+		me.cacheSetTTL("website", accid+"/"+domain, verified, time.Hour)
 	} else {
-		cache.SetWithExpire(cachekey, verified, time.Minute)
+		me.cacheSetTTL("website", accid+"/"+domain, verified, time.Minute)
 	}
 	return verified, nil
 }
@@ -0,0 +1,275 @@
+package acclient
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// Metrics receives the measurements of a Client. Labels are given as name,
+// value pairs. Implementations must be safe for concurrent use.
+//
+// Reported metrics:
+//
+//	acclient_cache_requests_total{resource,result}   result is hit, stale or miss
+//	acclient_load_duration_seconds{resource,result}  loads of cached resources, result is ok or error
+//	acclient_grpc_duration_seconds{method,code}
+//	acclient_http_duration_seconds{host,code}        code is 0 when no response
+//	acclient_publish_total{topic,result}             kafka publishes, result is ok or panic
+//	acclient_pubsub_polls_total{result}
+//	acclient_pubsub_lag_seconds                      from an event to its poll
+//	acclient_pubsub_topics                           watched topics
+//	acclient_retries_total                           attempts retried by the retry policy
+//	acclient_leader_errors_total{name}               failed campaigns and renewals of RunWithLeader
+type Metrics interface {
+	// Add increases a counter by delta
+	Add(name string, delta float64, labels ...string)
+	// Set sets a gauge
+	Set(name string, value float64, labels ...string)
+	// Observe adds a value, in seconds, to a histogram
+	Observe(name string, value float64, labels ...string)
+}
+
+// DefaultMetrics collects the metrics of every client created without
+// WithMetrics and of the package level HTTP calls (UploadFile,
+// DownloadAsText, ...). Serve it on the metrics endpoint of the process.
+var DefaultMetrics = NewPrometheusMetrics()
+
+type noMetrics struct{}
+
+// NoMetrics returns a Metrics which drops everything
+func NoMetrics() Metrics { return noMetrics{} }
+
+func (noMetrics) Add(name string, delta float64, labels ...string)     {}
+func (noMetrics) Set(name string, value float64, labels ...string)     {}
+func (noMetrics) Observe(name string, value float64, labels ...string) {}
+
+// metricBuckets are the upper bounds of the histograms, in seconds
+var metricBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// PrometheusMetrics keeps metrics in memory and serves them in the
+// Prometheus text exposition format
+type PrometheusMetrics struct {
+	lock       *sync.Mutex
+	counters   map[string]map[string]float64 // name -> labels -> value
+	gauges     map[string]map[string]float64
+	histograms map[string]map[string]*histogram
+}
+
+// NewPrometheusMetrics creates an empty PrometheusMetrics
+func NewPrometheusMetrics() *PrometheusMetrics {
+	return &PrometheusMetrics{
+		lock:       &sync.Mutex{},
+		counters:   map[string]map[string]float64{},
+		gauges:     map[string]map[string]float64{},
+		histograms: map[string]map[string]*histogram{},
+	}
+}
+
+func (me *PrometheusMetrics) Add(name string, delta float64, labels ...string) {
+	key := formatLabels(labels)
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	if me.counters[name] == nil {
+		me.counters[name] = map[string]float64{}
+	}
+	me.counters[name][key] += delta
+}
+
+func (me *PrometheusMetrics) Set(name string, value float64, labels ...string) {
+	key := formatLabels(labels)
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	if me.gauges[name] == nil {
+		me.gauges[name] = map[string]float64{}
+	}
+	me.gauges[name][key] = value
+}
+
+func (me *PrometheusMetrics) Observe(name string, value float64, labels ...string) {
+	key := formatLabels(labels)
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	if me.histograms[name] == nil {
+		me.histograms[name] = map[string]*histogram{}
+	}
+	h := me.histograms[name][key]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(metricBuckets))}
+		me.histograms[name][key] = h
+	}
+	if i, _ := slices.BinarySearch(metricBuckets, value); i < len(metricBuckets) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += value
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format
+func (me *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	me.WriteTo(w)
+}
+
+// WriteTo writes the metrics in the Prometheus text exposition format
+func (me *PrometheusMetrics) WriteTo(w io.Writer) (int64, error) {
+	bw := &bytes.Buffer{}
+	me.lock.Lock()
+	writeSamples(bw, "counter", me.counters)
+	writeSamples(bw, "gauge", me.gauges)
+	for _, name := range sortedKeys(me.histograms) {
+		bw.WriteString("# TYPE " + name + " histogram\n")
+		for _, key := range sortedKeys(me.histograms[name]) {
+			h := me.histograms[name][key]
+			var cumulative uint64
+			for i, le := range metricBuckets {
+				cumulative += h.counts[i]
+				writeSample(bw, name+"_bucket", joinLabels(key, `le="`+formatFloat(le)+`"`), float64(cumulative))
+			}
+			writeSample(bw, name+"_bucket", joinLabels(key, `le="+Inf"`), float64(h.count))
+			writeSample(bw, name+"_sum", key, h.sum)
+			writeSample(bw, name+"_count", key, float64(h.count))
+		}
+	}
+	me.lock.Unlock()
+	return bw.WriteTo(w)
+}
+
+func writeSamples(w *bytes.Buffer, typ string, samples map[string]map[string]float64) {
+	for _, name := range sortedKeys(samples) {
+		w.WriteString("# TYPE " + name + " " + typ + "\n")
+		for _, key := range sortedKeys(samples[name]) {
+			writeSample(w, name, key, samples[name][key])
+		}
+	}
+}
+
+func writeSample(w *bytes.Buffer, name, labels string, value float64) {
+	w.WriteString(name)
+	if labels != "" {
+		w.WriteString("{" + labels + "}")
+	}
+	w.WriteString(" " + formatFloat(value) + "\n")
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// formatLabels renders name, value pairs as `name="value",...`
+func formatLabels(labels []string) string {
+	var sb strings.Builder
+	for i := 0; i+1 < len(labels); i += 2 {
+		if sb.Len() > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(labels[i] + `="` + labelEscaper.Replace(labels[i+1]) + `"`)
+	}
+	return sb.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func joinLabels(a, b string) string {
+	if a == "" {
+		return b
+	}
+	return a + "," + b
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func resultLabel(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+// grpcMetrics is a gRPC interceptor timing every call
+func (me *Client) grpcMetrics(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	start := time.Now()
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	me.metrics.Observe("acclient_grpc_duration_seconds", time.Since(start).Seconds(), "method", method, "code", status.Code(err).String())
+	return err
+}
+
+// metricsTransport times and traces the HTTP calls made through httpClient,
+// reporting to the Metrics of the request context (see withMetrics), or
+// DefaultMetrics for the package level functions
+type metricsTransport struct {
+	next http.RoundTripper
+}
+
+type metricsCtxKey struct{}
+
+// withMetrics makes the HTTP calls made with ctx report to metrics
+func withMetrics(ctx context.Context, metrics Metrics) context.Context {
+	return context.WithValue(ctx, metricsCtxKey{}, metrics)
+}
+
+func (me metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	req, span := traceRequest(req)
+	resp, err := me.next.RoundTrip(req)
+	code := 0
+	if resp != nil {
+		code = resp.StatusCode
+		span.SetAttributes(attribute.Int("http.response.status_code", code))
+	}
+	endSpan(span, err)
+	metrics, ok := req.Context().Value(metricsCtxKey{}).(Metrics)
+	if !ok {
+		metrics = DefaultMetrics
+	}
+	metrics.Observe("acclient_http_duration_seconds", time.Since(start).Seconds(), "host", req.URL.Host, "code", strconv.Itoa(code))
+	return resp, err
+}
+
+// httpClient is used for every HTTP call of the package
+var httpClient = &http.Client{Transport: metricsTransport{next: http.DefaultTransport}}
+
+// metricsPublisher counts the messages given to a Publisher. The kafka
+// publisher reports no delivery error, only panics are seen as failures.
+type metricsPublisher struct {
+	next    Publisher
+	metrics Metrics
+}
+
+func (me *metricsPublisher) Publish(topic string, msg proto.Message, keys ...string) {
+	result := "panic"
+	defer func() { me.metrics.Add("acclient_publish_total", 1, "topic", topic, "result", result) }()
+	me.next.Publish(topic, msg, keys...)
+	result = "ok"
+}
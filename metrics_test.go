@@ -0,0 +1,85 @@
+package acclient
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	pb "github.com/subiz/header/account"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	metrics := NewPrometheusMetrics()
+	metrics.Add("requests_total", 1, "resource", "account", "result", "hit")
+	metrics.Add("requests_total", 2, "resource", "account", "result", "hit")
+	metrics.Set("topics", 3)
+	metrics.Observe("load_seconds", 0.02, "resource", `a"b`)
+
+	sb := &strings.Builder{}
+	if _, err := metrics.WriteTo(sb); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"# TYPE requests_total counter",
+		`requests_total{resource="account",result="hit"} 3`,
+		"# TYPE topics gauge",
+		"topics 3",
+		"# TYPE load_seconds histogram",
+		`load_seconds_bucket{resource="a\"b",le="0.01"} 0`,
+		`load_seconds_bucket{resource="a\"b",le="0.025"} 1`,
+		`load_seconds_bucket{resource="a\"b",le="+Inf"} 1`,
+		`load_seconds_count{resource="a\"b"} 1`,
+	} {
+		if !strings.Contains(sb.String(), line+"\n") {
+			t.Errorf("missing %q in\n%s", line, sb.String())
+		}
+	}
+}
+
+func TestCacheMetrics(t *testing.T) {
+	ctx := context.Background()
+	metrics := NewPrometheusMetrics()
+	c := New(WithMetrics(metrics))
+	fn := func(ctx context.Context, accid string) (*pb.Account, error) {
+		c.cacheSet("account", accid, &pb.Account{})
+		return &pb.Account{}, nil
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := load(ctx, c, "account", "acc1", fn); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sb := &strings.Builder{}
+	metrics.WriteTo(sb)
+	for _, line := range []string{
+		`acclient_cache_requests_total{resource="account",result="miss"} 1`,
+		`acclient_cache_requests_total{resource="account",result="hit"} 2`,
+		`acclient_load_duration_seconds_count{resource="account",result="ok"} 1`,
+	} {
+		if !strings.Contains(sb.String(), line+"\n") {
+			t.Errorf("missing %q in\n%s", line, sb.String())
+		}
+	}
+}
+
+func TestHTTPMetrics(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) }))
+	defer server.Close()
+	metrics := NewPrometheusMetrics()
+	c := New(WithMetrics(metrics))
+
+	ctx, span := c.startSpan(context.Background(), "Download", "")
+	defer span.End()
+	if _, err := (&apiFileStore{}).Download(ctx, server.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	sb := &strings.Builder{}
+	metrics.WriteTo(sb)
+	if !strings.Contains(sb.String(), `acclient_http_duration_seconds_count{host="`+strings.TrimPrefix(server.URL, "http://")+`",code="200"} 1`) {
+		t.Errorf("http call not reported to the client metrics\n%s", sb.String())
+	}
+}
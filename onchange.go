@@ -0,0 +1,79 @@
+package acclient
+
+import (
+	"context"
+	"strings"
+
+	"github.com/subiz/log"
+)
+
+// changeHook is a callback registered by OnChange
+type changeHook struct {
+	cb func(accid string)
+}
+
+// OnChange calls cb, in its own goroutine, each time a cached resource of an
+// account changes: agent, agent_group, presence, bot, ai_agent,
+// attribute_definition, shop_setting, lang, pipeline, blacklist_ip,
+// banned_user, ... The resource is already reloaded when cb runs, so
+// reading it returns the new value. cb is not called when the reload fails.
+//
+// Only the accounts whose resource was read by the client are watched.
+// Call the returned cancel to drop cb.
+func (me *Client) OnChange(resource string, cb func(accid string)) (cancel func()) {
+	h := &changeHook{cb: cb}
+	me.changeHookLock.Lock()
+	if me.changeHooks[resource] == nil {
+		me.changeHooks[resource] = map[*changeHook]bool{}
+	}
+	me.changeHooks[resource][h] = true
+	me.changeHookLock.Unlock()
+
+	return func() {
+		me.changeHookLock.Lock()
+		defer me.changeHookLock.Unlock()
+		delete(me.changeHooks[resource], h)
+		if len(me.changeHooks[resource]) == 0 {
+			delete(me.changeHooks, resource)
+		}
+	}
+}
+
+// fireChange reloads the resource then calls the hooks registered on it. The
+// reload keeps the hooks from reading a stale value (see WithMaxStale), the
+// hooks are skipped when it fails. id is the id of the topic, see
+// topicAccountId.
+func (me *Client) fireChange(resource, id string) {
+	me.changeHookLock.Lock()
+	hooks := make([]*changeHook, 0, len(me.changeHooks[resource]))
+	for h := range me.changeHooks[resource] {
+		hooks = append(hooks, h)
+	}
+	me.changeHookLock.Unlock()
+	if len(hooks) == 0 {
+		return
+	}
+
+	go func() {
+		err := me.retry.Do(me.ctx, func(ctx context.Context) error { return me.loads.reload(ctx, resource, id) })
+		if err != nil {
+			// the hooks would read the stale value
+			log.WarnContext(me.ctx, "acclient: cannot reload changed resource", "resource", resource, "id", id, "err", err.Error())
+			return
+		}
+		accid := topicAccountId(resource, id)
+		for _, h := range hooks {
+			go h.cb(accid)
+		}
+	}()
+}
+
+// topicAccountId returns the account of a topic id, which is the account id
+// except for lang, whose topics are per account and locale
+func topicAccountId(resource, id string) string {
+	if resource == "lang" {
+		accid, _, _ := strings.Cut(id, "_")
+		return accid
+	}
+	return id
+}
@@ -0,0 +1,148 @@
+package acclient
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/subiz/header"
+	"github.com/subiz/idgen"
+	"github.com/subiz/log"
+	"github.com/thanhpk/randstr"
+)
+
+// pollTimeout bounds a long poll, the server answers as soon as there are
+// events
+const pollTimeout = 30 * time.Second
+
+// pollInterval is the least time between two polls which got no event, for
+// servers which answer right away
+const pollInterval = time.Second
+
+// topicColdAfter is the least time a topic stays watched after its last
+// subscribe
+const topicColdAfter = 10 * time.Minute
+
+// subscribe watches topic.accid for changes, it must be called each time
+// the resource is loaded so the topic does not go cold
+func (me *Client) subscribe(accid, topic string) {
+	me.subscribeTopicLock.Lock()
+	me.subscribeTopics[topic+"."+accid] = time.Now()
+	me.subscribeTopicLock.Unlock()
+}
+
+// watchedTopics drops the cold topics and returns the others. A topic is
+// cold once the resource it invalidates cannot be in the cache anymore and
+// no job waiter needs it.
+func (me *Client) watchedTopics() []string {
+	now := time.Now()
+	me.subscribeTopicLock.Lock()
+	defer me.subscribeTopicLock.Unlock()
+	topics := make([]string, 0, len(me.subscribeTopics))
+	for topic, last := range me.subscribeTopics {
+		typ, accid, _ := strings.Cut(topic, ".")
+		if now.Sub(last) > max(me.cacheTTL(typ)+me.maxStale(typ), topicColdAfter) && !me.hasJobWaiters(typ, accid) {
+			delete(me.subscribeTopics, topic)
+			continue
+		}
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+func (me *Client) hasJobWaiters(typ, accid string) bool {
+	return typ == jobEndedTopic && len(me.jobWaitersOf(accid)) > 0
+}
+
+// jobWaitersOf returns the ids of the jobs of the account which are waited
+// for
+func (me *Client) jobWaitersOf(accid string) []string {
+	me.jobWaiterLock.Lock()
+	defer me.jobWaiterLock.Unlock()
+	var jobids []string
+	for key := range me.jobWaiters {
+		if jobid, found := strings.CutPrefix(key, accid+"/"); found {
+			jobids = append(jobids, jobid)
+		}
+	}
+	return jobids
+}
+
+// pollLoop long polls the pubsub for the watched topics, resuming from the
+// last cursor, which may come from a cache snapshot. Events fired while the
+// pubsub is unreachable may be lost, so every watched resource is
+// invalidated once it is back.
+func (me *Client) pollLoop() {
+	me.subscribeTopicLock.Lock()
+	if me.pollConnId == "" {
+		me.pollConnId = idgen.NewPollingConnId("0", "", randstr.Hex(8))
+	}
+	connId, cursor := me.pollConnId, me.pollCursor
+	me.subscribeTopicLock.Unlock()
+	failures := 0
+	for me.ctx.Err() == nil {
+		start := time.Now()
+		topics := me.watchedTopics()
+		me.metrics.Set("acclient_pubsub_topics", float64(len(topics)))
+		pollctx, cancel := context.WithTimeout(me.ctx, pollTimeout)
+		out, err := me.numpubsub.Poll(pollctx, &header.RealtimeSubscription{Events: topics, ConnectionId: connId, InitialToken: cursor})
+		cancel()
+		me.metrics.Add("acclient_pubsub_polls_total", 1, "result", resultLabel(err))
+		if err != nil {
+			if me.ctx.Err() != nil {
+				return
+			}
+			failures++
+			log.WarnContext(me.ctx, "acclient: pubsub poll failed", "connection_id", connId, "failures", failures, "err", err.Error())
+			sleepCtx(me.ctx, me.retry.Backoff(failures))
+			continue
+		}
+		if failures > 0 {
+			failures = 0
+			me.flushWatched()
+		}
+		for _, event := range out.GetEvents() {
+			if event.GetCreated() > 0 {
+				me.metrics.Observe("acclient_pubsub_lag_seconds", time.Since(time.UnixMilli(event.GetCreated())).Seconds())
+			}
+			if event.GetAccountId() != "" {
+				me.handleEvent(event.GetType(), event.GetAccountId(), event.GetId())
+			}
+		}
+		if token := out.GetSequentialToken(); token != "" {
+			cursor = token
+			me.subscribeTopicLock.Lock()
+			me.pollCursor = cursor
+			me.subscribeTopicLock.Unlock()
+		}
+		if len(out.GetEvents()) == 0 {
+			sleepCtx(me.ctx, pollInterval-time.Since(start))
+		}
+	}
+}
+
+// flushWatched handles a change of every watched topic
+func (me *Client) flushWatched() {
+	for _, topic := range me.watchedTopics() {
+		typ, accid, _ := strings.Cut(topic, ".")
+		if typ != jobEndedTopic {
+			me.handleEvent(typ, accid, "")
+			continue
+		}
+		for _, jobid := range me.jobWaitersOf(accid) {
+			me.handleEvent(typ, accid, jobid)
+		}
+	}
+}
+
+func (me *Client) handleEvent(typ, accid, id string) {
+	if typ == jobEndedTopic {
+		go me.recheckJobEnded(accid, id)
+		return
+	}
+	if typ == "account" {
+		me.missingAccs.Remove(accid)
+	}
+	me.cacheInvalidate(typ, accid)
+	me.fireChange(typ, accid)
+}
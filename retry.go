@@ -0,0 +1,115 @@
+package acclient
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"time"
+
+	"github.com/subiz/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// RetryPolicy controls how a Client retries failed calls to its backends
+// (job writes, ID generation, initialization, ...)
+type RetryPolicy struct {
+	// MaxAttempts counts the first call, 0 means no limit other than Deadline
+	MaxAttempts int
+
+	// the wait after the n-th failed attempt is
+	// min(InitialBackoff * Multiplier^(n-1), MaxBackoff), reduced by a random
+	// fraction of at most Jitter (0..1)
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	Jitter         float64
+
+	// Deadline bounds all attempts together, 0 means no limit other than the
+	// caller's ctx
+	Deadline time.Duration
+
+	// Retryable reports whether a failed attempt should be retried, nil means
+	// IsRetryable
+	Retryable func(error) bool
+
+	onRetry func(err error) // set by the client to count retries
+}
+
+// DefaultRetryPolicy makes 5 attempts within 30s, backing off from 200ms
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    5,
+		InitialBackoff: 200 * time.Millisecond,
+		MaxBackoff:     5 * time.Second,
+		Multiplier:     2,
+		Jitter:         0.2,
+		Deadline:       30 * time.Second,
+	}
+}
+
+// Backoff returns how long to wait after the attempt-th failed attempt
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	d := float64(p.InitialBackoff)
+	for i := 1; i < attempt && d < float64(p.MaxBackoff); i++ {
+		d *= max(p.Multiplier, 1)
+	}
+	if p.MaxBackoff > 0 {
+		d = min(d, float64(p.MaxBackoff))
+	}
+	d -= d * min(max(p.Jitter, 0), 1) * rand.Float64()
+	return time.Duration(d)
+}
+
+// Do calls fn until it succeeds, fails with a non retryable error, or the
+// policy is exhausted. It returns the last error.
+func (p RetryPolicy) Do(ctx context.Context, fn func(ctx context.Context) error) error {
+	if p.Deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.Deadline)
+		defer cancel()
+	}
+	retryable := p.Retryable
+	if retryable == nil {
+		retryable = IsRetryable
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil || !retryable(err) || (p.MaxAttempts > 0 && attempt >= p.MaxAttempts) {
+			return err
+		}
+		if !sleepCtx(ctx, p.Backoff(attempt)) {
+			return err
+		}
+		if p.onRetry != nil {
+			p.onRetry(err)
+		}
+	}
+}
+
+// IsRetryable is the default error classifier of RetryPolicy. Context errors
+// are final. Our errors are retryable when marked so, or when the backend is
+// unreachable. Unknown errors, usually from the network or the database
+// driver, are assumed to be transient.
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var aerr *log.AError
+	if errors.As(err, &aerr) {
+		return log.IsErr(aerr, log.E_retryable.String()) ||
+			log.IsErr(aerr, log.E_internal_connection.String()) ||
+			log.IsErr(aerr, log.E_service_unavailable.String())
+	}
+
+	if s, ok := status.FromError(err); ok {
+		switch s.Code() {
+		case codes.Unavailable, codes.ResourceExhausted, codes.Aborted:
+			return true
+		}
+		return false
+	}
+	return true
+}
@@ -0,0 +1,61 @@
+package acclient
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/subiz/log"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 4 * time.Millisecond, Multiplier: 2}
+	calls := 0
+	err := policy.Do(context.Background(), func(context.Context) error {
+		calls++
+		return errors.New("connection reset")
+	})
+	if err == nil || calls != 3 {
+		t.Errorf("want 3 failed calls, got %d, err %v", calls, err)
+	}
+
+	calls = 0
+	err = policy.Do(context.Background(), func(context.Context) error {
+		calls++
+		return log.NewError(nil, log.M{}, log.E_access_deny)
+	})
+	if err == nil || calls != 1 {
+		t.Errorf("non retryable errors must not be retried, got %d calls", calls)
+	}
+
+	calls = 0
+	err = policy.Do(context.Background(), func(context.Context) error {
+		if calls++; calls < 2 {
+			return log.NewError(nil, log.M{}, log.E_retryable)
+		}
+		return nil
+	})
+	if err != nil || calls != 2 {
+		t.Errorf("want success on the 2nd call, got %d calls, err %v", calls, err)
+	}
+
+	if d := policy.Backoff(10); d != 4*time.Millisecond {
+		t.Errorf("backoff must be capped, got %v", d)
+	}
+	policy.Jitter = 0.5
+	for range 100 {
+		if d := policy.Backoff(1); d < 500*time.Microsecond || d > time.Millisecond {
+			t.Fatalf("jittered backoff out of range: %v", d)
+		}
+	}
+}
+
+func TestRetryPolicyDeadline(t *testing.T) {
+	policy := RetryPolicy{InitialBackoff: 10 * time.Millisecond, Deadline: 50 * time.Millisecond}
+	start := time.Now()
+	policy.Do(context.Background(), func(context.Context) error { return errors.New("timeout") })
+	if time.Since(start) > time.Second {
+		t.Errorf("deadline not honoured, took %v", time.Since(start))
+	}
+}
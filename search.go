@@ -4,12 +4,11 @@ import (
 	"strconv"
 
 	"github.com/subiz/header"
-	"github.com/subiz/kafka"
 )
 
 // activeSec should be time.Now().Unix()
-func Index(col, accid, doc, part, content string, activeSec int64) {
-	publishIndex(&header.DocIndexRequest{
+func (me *Client) Index(col, accid, doc, part, content string, activeSec int64) {
+	me.publishIndex(&header.DocIndexRequest{
 		Collection: col,
 		AccountId:  accid,
 		DocumentId: doc,
@@ -20,8 +19,8 @@ func Index(col, accid, doc, part, content string, activeSec int64) {
 	})
 }
 
-func IndexByLocale(col, accid, doc, part, content string, locale string, owners ...string) {
-	publishIndex(&header.DocIndexRequest{
+func (me *Client) IndexByLocale(col, accid, doc, part, content string, locale string, owners ...string) {
+	me.publishIndex(&header.DocIndexRequest{
 		Collection: col,
 		AccountId:  accid,
 		DocumentId: doc,
@@ -33,7 +32,7 @@ func IndexByLocale(col, accid, doc, part, content string, locale string, owners
 	})
 }
 
-func publishIndex(req *header.DocIndexRequest) {
+func (me *Client) publishIndex(req *header.DocIndexRequest) {
 	topic := "search-index-" + strconv.Itoa(header.GetAccShard(req.GetAccountId(), 4))
-	kafka.Publish("kafkaatm:9094", topic, req)
+	me.publisher.Publish(topic, req)
 }
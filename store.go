@@ -0,0 +1,866 @@
+package acclient
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/subiz/header"
+	"github.com/subiz/kafka"
+	"github.com/subiz/log"
+	"github.com/thanhpk/randstr"
+	"google.golang.org/protobuf/proto"
+)
+
+// Store is the Cassandra side of a Client. Every database read and write the
+// client makes goes through it, so tests can swap in an in-memory store (see
+// package acclienttest).
+//
+// Lookups return a nil value and a nil error when the row does not exist.
+type Store interface {
+	GetShopSetting(ctx context.Context, accid string) (*header.ShopSetting, error)
+	ListLangMessages(ctx context.Context, accid, locale string) ([]*header.LangMessage, error)
+	ListAttrDefs(ctx context.Context, accid string) ([]*header.AttributeDefinition, error)
+	GetNotiSetting(ctx context.Context, accid, agid string) (*header.NotiSetting, error)
+	ListBots(ctx context.Context, accid string) ([]*header.Bot, error)
+	ListAIAgents(ctx context.Context, accid string) ([]*header.AIAgent, error)
+	ListAgentGroups(ctx context.Context, accid string) ([]*header.AgentGroup, error)
+	ListPipelines(ctx context.Context, accid string) ([]*header.Pipeline, error)
+	ListBlacklistIPs(ctx context.Context, accid string) ([]*header.BlacklistIP, error)
+	DeleteBlacklistIP(ctx context.Context, accid, ip string) error
+	ListBannedUsers(ctx context.Context, accid string) ([]*header.BannedUser, error)
+	GetIntegration(ctx context.Context, accid, inteid string) (*header.Integration, error)
+
+	InsertSignedKey(ctx context.Context, accid, issuer, typ, keytype, key string, objects []string, created int64) error
+	LookupSignedKey(ctx context.Context, key string) (accid, issuer, typ, keytype string, objects []string, err error)
+
+	// LookupCompactString returns the number of a compacted string, 0 if the
+	// string has not been compacted
+	LookupCompactString(ctx context.Context, str string) (int, error)
+	// LookupCompactNumber reverses LookupCompactString, "" if unknown
+	LookupCompactNumber(ctx context.Context, num int) (string, error)
+
+	GetJob(ctx context.Context, accid, jobid string) (*JobInfo, error)
+	InsertJob(ctx context.Context, job *header.Job) error
+	UpdateJobStatus(ctx context.Context, accid, jobid, status string, updated int64) error
+	ForceEndJob(ctx context.Context, accid, jobid string, ended int64) error
+	// EndJob stores either output or outputurl, the url of an uploaded output
+	EndJob(ctx context.Context, accid, jobid, status string, ended int64, output []byte, outputurl string) error
+	PingJob(ctx context.Context, accid, jobid string, ping int64) error
+	UpdateJobProgress(ctx context.Context, accid, jobid string, done, total, updated int64) error
+	AppendJobLog(ctx context.Context, accid, jobid string, entry *JobLog) error
+	// ListJobLogs returns the first limit log entries of a job, oldest first
+	ListJobLogs(ctx context.Context, accid, jobid string, limit int) ([]*JobLog, error)
+
+	// EnqueueJob inserts a job and adds it to the queue of its category
+	EnqueueJob(ctx context.Context, job *JobInfo) error
+	// ListQueuedJobs returns the oldest queue entries of a category enqueued
+	// on day (created / 86400000) which come after the entry after, nil
+	// meaning from the first one. Only AccountId, Id, Category, Created and
+	// the lease hint (Worker, LastPingMs, LeaseSec) are set.
+	ListQueuedJobs(ctx context.Context, category string, day int64, after *header.Job, limit int) ([]*JobInfo, error)
+	// SetQueuedJobLease copies the lease of a job to its queue entry, so
+	// ClaimJob skips leased jobs without reading them. It is only a hint, the
+	// lease in the job row is authoritative.
+	SetQueuedJobLease(ctx context.Context, entry *header.Job, worker string, ping, leasesec int64) error
+	DequeueJob(ctx context.Context, entry *header.Job) error
+	// SetJobWorker leases a queued job to worker, it is a compare and set
+	// which fails (false, nil) if the job is no longer leased to oldworker
+	// with the last ping oldping
+	SetJobWorker(ctx context.Context, accid, jobid, oldworker string, oldping int64, worker string, ping, leasesec int64, attempts int) (bool, error)
+	// The writes of queued jobs below are lightweight transactions like
+	// SetJobWorker, Cassandra does not order them with plain writes. They
+	// fail (false, nil) if the job is no longer leased to worker, "" when
+	// the job is not leased.
+	RenewJobLease(ctx context.Context, accid, jobid, worker string, ping int64) (bool, error)
+	ReleaseJobLease(ctx context.Context, accid, jobid, worker string, attempts int) (bool, error)
+	EndLeasedJob(ctx context.Context, accid, jobid, worker, status string, ended int64, output []byte, outputurl string) (bool, error)
+	ForceEndQueuedJob(ctx context.Context, accid, jobid, worker string, ended int64) (bool, error)
+	UpdateQueuedJobStatus(ctx context.Context, accid, jobid, worker, status string, updated int64) (bool, error)
+	UpdateQueuedJobProgress(ctx context.Context, accid, jobid, worker string, done, total, updated int64) (bool, error)
+	// ListJobs returns at most limit jobs of the account created in
+	// [from, to], ordered by created then id, newest first. When beforeid is
+	// not empty, jobs created at to must also have an id less than beforeid.
+	// It reads limit index entries, expired jobs are skipped so fewer jobs
+	// may be returned. last is the position (Created and Id) of the last
+	// entry read, nil when fewer than limit entries were left.
+	ListJobs(ctx context.Context, accid string, from, to int64, beforeid string, limit int) (jobs []*header.Job, last *header.Job, err error)
+
+	// GetKV returns the value of key k, found is false when the key does not exist
+	GetKV(ctx context.Context, k string) (v string, found bool, err error)
+	SetKV(ctx context.Context, k, v string, ttlsec int) error
+	DelKV(ctx context.Context, k string) error
+	// GetKVVersion is GetKV which also returns the version of the value, the
+	// write time in microseconds. Only conditional writes of a key are sure
+	// to get increasing versions.
+	GetKVVersion(ctx context.Context, k string) (v string, version int64, found bool, err error)
+	// InsertKVIfNotExists sets k, it fails (false, nil) when k exists
+	InsertKVIfNotExists(ctx context.Context, k, v string, ttlsec int) (bool, error)
+	// CompareAndSwapKV sets k to newv, it fails (false, nil) when the value
+	// of k is not oldv or k does not exist
+	CompareAndSwapKV(ctx context.Context, k, oldv, newv string, ttlsec int) (bool, error)
+	// GetKVTTL returns the remaining ttl of k in seconds, 0 if k never
+	// expires
+	GetKVTTL(ctx context.Context, k string) (ttlsec int, found bool, err error)
+	// TouchKV rewrites v, the value of k at version, with a new ttl. Writes
+	// of k after version win over it.
+	TouchKV(ctx context.Context, k, v string, version int64, ttlsec int) error
+	// DeleteKVIf removes k, it fails (false, nil) when the value of k is not v
+	DeleteKVIf(ctx context.Context, k, v string) (bool, error)
+}
+
+// Publisher sends messages to kafka
+type Publisher interface {
+	Publish(topic string, msg proto.Message, keys ...string)
+}
+
+// FileStore keeps job outputs too large to be stored inline
+type FileStore interface {
+	Upload(ctx context.Context, accid, name string, data []byte, ttlsec int64) (*header.File, error)
+	Download(ctx context.Context, url string) ([]byte, error)
+}
+
+// apiFileStore is the FileStore backed by the file API, see UploadFile
+type apiFileStore struct{}
+
+func (me *apiFileStore) Upload(ctx context.Context, accid, name string, data []byte, ttlsec int64) (*header.File, error) {
+	return UploadFileCtx(ctx, accid, name, "other", data, "", ttlsec, false)
+}
+
+func (me *apiFileStore) Download(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, log.EData(err, nil, log.M{"url": url})
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, log.ERetry(err, log.M{"url": url})
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, log.ERetry(err, log.M{"url": url})
+	}
+	if resp.StatusCode != 200 {
+		return nil, log.ERetry(nil, log.M{"url": url, "status_code": resp.StatusCode})
+	}
+	return data, nil
+}
+
+type kafkaPublisher struct {
+	brokers string
+}
+
+func (me *kafkaPublisher) Publish(topic string, msg proto.Message, keys ...string) {
+	kafka.Publish(me.brokers, topic, msg, keys...)
+}
+
+// cqlStore is the Store backed by a Cassandra session
+type cqlStore struct {
+	session *gocql.Session
+}
+
+// connectDB is header.ConnectDB without the retries and the panic, a single
+// attempt bounded by timeout and ctx
+func connectDB(ctx context.Context, seeds []string, keyspace string, timeout time.Duration) (*gocql.Session, error) {
+	cluster := gocql.NewCluster(seeds...)
+	cluster.Timeout = 30 * time.Second
+	cluster.ConnectTimeout = timeout
+	cluster.Keyspace = keyspace
+	cluster.QueryObserver = cqlTracer{}
+
+	type result struct {
+		session *gocql.Session
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		session, err := cluster.CreateSession()
+		done <- result{session, err}
+	}()
+
+	select {
+	case res := <-done:
+		if res.err != nil {
+			return nil, log.EInternalConnect(res.err, log.M{"seeds": seeds})
+		}
+		return res.session, nil
+	case <-ctx.Done():
+		go func() {
+			if res := <-done; res.session != nil {
+				res.session.Close()
+			}
+		}()
+		return nil, log.EInternalConnect(ctx.Err(), log.M{"seeds": seeds})
+	}
+}
+
+func (me *cqlStore) GetShopSetting(ctx context.Context, id string) (*header.ShopSetting, error) {
+	var data = []byte{}
+	err := me.session.Query("SELECT data FROM account.shop_setting WHERE account_id=?", id).WithContext(ctx).Scan(&data)
+	setting := &header.ShopSetting{}
+
+	if err != nil && err.Error() != gocql.ErrNotFound.Error() {
+		return nil, log.ERetry(err, log.M{"id": id})
+	}
+	if len(data) > 0 {
+		proto.Unmarshal(data, setting)
+	}
+
+	shopAddresses := []*header.Address{}
+	// read pos
+	data = []byte{}
+	iter := me.session.Query(`SELECT data FROM account.shop_address WHERE account_id=?`, id).WithContext(ctx).Iter()
+	for iter.Scan(&data) {
+		shopAddress := header.Address{}
+		proto.Unmarshal(data, &shopAddress)
+		shopAddresses = append(shopAddresses, &shopAddress)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, log.ERetry(err, log.M{"id": id})
+	}
+
+	taxes := []*header.Tax{}
+	// read pos
+	data = []byte{}
+	iter = me.session.Query(`SELECT data FROM account.tax WHERE account_id=?`, id).WithContext(ctx).Iter()
+	for iter.Scan(&data) {
+		tax := header.Tax{}
+		proto.Unmarshal(data, &tax)
+		taxes = append(taxes, &tax)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, log.ERetry(err, log.M{"id": id})
+	}
+
+	paymentmethods := []*header.PaymentMethod{}
+	// read pos
+	data = []byte{}
+	iter = me.session.Query(`SELECT data FROM account.payment_method WHERE account_id=?`, id).WithContext(ctx).Iter()
+	for iter.Scan(&data) {
+		pm := header.PaymentMethod{}
+		proto.Unmarshal(data, &pm)
+		paymentmethods = append(paymentmethods, &pm)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, log.ERetry(err, log.M{"id": id})
+	}
+
+	shops := make([]*header.ShopeeShop, 0)
+	iter = me.session.Query(`SELECT data from proder.shopee_shop WHERE account_id=? LIMIT 1000`, id).WithContext(ctx).Iter()
+	b := make([]byte, 0)
+	for iter.Scan(&b) {
+		shop := &header.ShopeeShop{}
+		if err := proto.Unmarshal(b, shop); err != nil {
+			return nil, log.EData(err, b, log.M{"account_id": id})
+		}
+		shops = append(shops, shop)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, log.ERetry(err, log.M{"id": id})
+	}
+
+	ccs := []*header.CancellationCode{}
+	iter = me.session.Query(`SELECT data FROM account.cancellation_code WHERE account_id=?`, id).WithContext(ctx).Iter()
+	for iter.Scan(&data) {
+		cc := header.CancellationCode{}
+		proto.Unmarshal(data, &cc)
+		ccs = append(ccs, &cc)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, log.ERetry(err, log.M{"account_id": id})
+	}
+
+	setting.CancellationCodes = ccs
+	setting.Taxes = taxes
+	setting.PaymentMethods = paymentmethods
+	setting.Addresses = shopAddresses
+	// setting.Shippings = ishippings
+	// setting.ShippingPolicies = sps
+	setting.ShopeeShops = shops
+	setting.AccountId = id
+	return setting, nil
+}
+
+func (me *cqlStore) ListLangMessages(ctx context.Context, accid, locale string) ([]*header.LangMessage, error) {
+	var message, lastmsg, updatedby, public, category string
+	var updated int64
+	var k string
+
+	messages := []*header.LangMessage{}
+	iter := me.session.Query(`SELECT k, message, public_state, last_message, updated, author, category FROM account.lang WHERE account_id=? AND locale=?`, accid, locale).WithContext(ctx).Iter()
+	for iter.Scan(&k, &message, &public, &lastmsg, &updated, &updatedby, &category) {
+		messages = append(messages, &header.LangMessage{Key: k, Message: message, PublicState: public, LastMessage: lastmsg, Updated: updated, Author: updatedby, Locale: locale, Category: category})
+	}
+	if err := iter.Close(); err != nil {
+		return nil, log.ERetry(err, log.M{"account_id": accid})
+	}
+	return messages, nil
+}
+
+func (me *cqlStore) ListAttrDefs(ctx context.Context, accid string) ([]*header.AttributeDefinition, error) {
+	defs := []*header.AttributeDefinition{}
+	iter := me.session.Query("SELECT data FROM user.attr_defs WHERE account_id=? LIMIT 1000", accid).WithContext(ctx).Iter()
+	var data []byte
+	for iter.Scan(&data) {
+		def := &header.AttributeDefinition{}
+		if err := proto.Unmarshal(data, def); err != nil {
+			return nil, log.ERetry(err, log.M{"account_id": accid})
+		}
+		defs = append(defs, def)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, log.ERetry(err, log.M{"account_id": accid})
+	}
+	return defs, nil
+}
+
+func (me *cqlStore) GetNotiSetting(ctx context.Context, accid, agid string) (*header.NotiSetting, error) {
+	data := []byte{}
+	err := me.session.Query("SELECT data FROM notibox.setting WHERE accid=? AND agid=?", accid, agid).WithContext(ctx).Scan(&data)
+	if err != nil && err.Error() == gocql.ErrNotFound.Error() {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, log.ERetry(err, log.M{"account_id": accid, "agent_id": agid})
+	}
+
+	setting := &header.NotiSetting{}
+	proto.Unmarshal(data, setting)
+	return setting, nil
+}
+
+func (me *cqlStore) ListBots(ctx context.Context, accid string) ([]*header.Bot, error) {
+	iter := me.session.Query(`SELECT bot FROM bizbot.bots WHERE account_id=?`, accid).WithContext(ctx).Iter()
+	var botb []byte
+	list := make([]*header.Bot, 0)
+	for iter.Scan(&botb) {
+		bot := &header.Bot{}
+		proto.Unmarshal(botb, bot)
+		list = append(list, bot)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, log.ERetry(err, log.M{"account_id": accid})
+	}
+	return list, nil
+}
+
+func (me *cqlStore) ListAIAgents(ctx context.Context, accid string) ([]*header.AIAgent, error) {
+	iter := me.session.Query(`SELECT id, data FROM workflow.ai_agents WHERE accid=?`, accid).WithContext(ctx).Iter()
+	agents := []*header.AIAgent{}
+	var data []byte
+	var id string
+	for iter.Scan(&id, &data) {
+		agent := &header.AIAgent{}
+		proto.Unmarshal(data, agent)
+		agent.Id = id
+		agents = append(agents, agent)
+		data = []byte{}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, log.ERetry(err, log.M{"account_id": accid})
+	}
+	return agents, nil
+}
+
+func (me *cqlStore) ListAgentGroups(ctx context.Context, accid string) ([]*header.AgentGroup, error) {
+	var arr = make([]*header.AgentGroup, 0)
+	iter := me.session.Query("SELECT id, data FROM account.agent_groups WHERE account_id=? LIMIT 500", accid).WithContext(ctx).Iter()
+	var id string
+	data := make([]byte, 0)
+	for iter.Scan(&id, &data) {
+		group := &header.AgentGroup{}
+		if err := proto.Unmarshal(data, group); err != nil {
+			return nil, log.EData(err, data, log.M{"account_id": accid, "group_id": id})
+		}
+		group.AccountId = accid
+		group.Id = id
+		data = make([]byte, 0)
+		arr = append(arr, group)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, log.ERetry(err, log.M{"account_id": accid})
+	}
+	return arr, nil
+}
+
+func (me *cqlStore) ListPipelines(ctx context.Context, accid string) ([]*header.Pipeline, error) {
+	iter := me.session.Query(`SELECT id, pipeline FROM apiece.pipelines WHERE account_id=? LIMIT 100`, accid).WithContext(ctx).Iter()
+	pipelines := make([]*header.Pipeline, 0)
+	var dbid string
+	var pipelineb []byte
+	for iter.Scan(&dbid, &pipelineb) {
+		pipeline := &header.Pipeline{}
+		proto.Unmarshal(pipelineb, pipeline)
+		pipeline.AccountId = accid
+		pipeline.Id = dbid
+		pipelines = append(pipelines, pipeline)
+	}
+	err := iter.Close()
+	if err != nil {
+		return nil, log.ERetry(err, log.M{"account_id": accid})
+	}
+	return pipelines, nil
+}
+
+func (me *cqlStore) ListBlacklistIPs(ctx context.Context, accid string) ([]*header.BlacklistIP, error) {
+	ips := []*header.BlacklistIP{}
+	iter := me.session.Query(`SELECT ip, "by", created, num_blocked, last_blocked, expired_at FROM api.wlips WHERE account_id=? LIMIT 1000`, accid).WithContext(ctx).Iter()
+	var ip, by string
+	var created, num_blocked, expired, last_blocked int64
+	for iter.Scan(&ip, &by, &created, &num_blocked, &last_blocked, &expired) {
+		ips = append(ips, &header.BlacklistIP{AccountId: accid, Ip: ip, By: by, Created: created, NumBlocked: num_blocked, ExpiredAt: expired, LastBlocked: last_blocked})
+	}
+	if err := iter.Close(); err != nil {
+		return nil, log.ERetry(err, log.M{"account_id": accid})
+	}
+	return ips, nil
+}
+
+func (me *cqlStore) DeleteBlacklistIP(ctx context.Context, accid, ip string) error {
+	if err := me.session.Query(`DELETE FROM api.wlips WHERE account_id=? AND ip=?`, accid, ip).WithContext(ctx).Exec(); err != nil {
+		return log.ERetry(err, log.M{"account_id": accid, "ip": ip})
+	}
+	return nil
+}
+
+func (me *cqlStore) ListBannedUsers(ctx context.Context, accid string) ([]*header.BannedUser, error) {
+	users := []*header.BannedUser{}
+	iter := me.session.Query(`SELECT user_id, "by", created FROM api.wlusers WHERE account_id=? LIMIT 10000`, accid).WithContext(ctx).Iter()
+	var userid, by string
+	var created int64
+	for iter.Scan(&userid, &by, &created) {
+		users = append(users, &header.BannedUser{AccountId: accid, UserId: userid, By: by, Created: created})
+	}
+	if err := iter.Close(); err != nil {
+		return nil, log.ERetry(err, log.M{"account_id": accid})
+	}
+	return users, nil
+}
+
+func (me *cqlStore) GetIntegration(ctx context.Context, accid, inteid string) (*header.Integration, error) {
+	data := make([]byte, 0)
+	err := me.session.Query("SELECT data FROM convo.channels WHERE account_id=? AND id=?", accid, inteid).WithContext(ctx).Scan(&data)
+	if err != nil && err.Error() == gocql.ErrNotFound.Error() {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, log.ERetry(err, log.M{"account_id": accid, "integration_id": inteid})
+	}
+
+	inte := &header.Integration{}
+	proto.Unmarshal(data, inte)
+	return inte, nil
+}
+
+func (me *cqlStore) InsertSignedKey(ctx context.Context, accid, issuer, typ, keytype, key string, objects []string, created int64) error {
+	err := me.session.Query(`INSERT INTO account.signed_key(account_id, issuer, type, objects, key_type, key, created) VALUES(?,?,?,?,?,?,?)`, accid, issuer, typ, objects, keytype, key, created).WithContext(ctx).Exec()
+	if err != nil {
+		return log.ERetry(err, log.M{"account_id": accid, "issuer": issuer, "type": typ, "keytype": keytype})
+	}
+	return nil
+}
+
+func (me *cqlStore) LookupSignedKey(ctx context.Context, key string) (string, string, string, string, []string, error) {
+	var accid, issuer, typ, keytype string
+	objects := make([]string, 0)
+	err := me.session.Query(`SELECT account_id, issuer, type, key_type, objects FROM account.signed_key WHERE key=?`, key).WithContext(ctx).Scan(&accid, &issuer, &typ, &keytype, &objects)
+	if err != nil {
+		return "", "", "", "", nil, log.ERetry(err, log.M{"key": key})
+	}
+	return accid, issuer, typ, keytype, objects, nil
+}
+
+func (me *cqlStore) LookupCompactString(ctx context.Context, str string) (int, error) {
+	var number int
+	err := me.session.Query(`SELECT num FROM account.compact_str2 WHERE str=?`, str).WithContext(ctx).Scan(&number)
+	if err != nil && err.Error() == gocql.ErrNotFound.Error() {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, log.ERetry(err, log.M{"str": str})
+	}
+	return number, nil
+}
+
+func (me *cqlStore) LookupCompactNumber(ctx context.Context, num int) (string, error) {
+	var str string
+	err := me.session.Query(`SELECT str FROM account.uncompact_num2 WHERE num=?`, num).WithContext(ctx).Scan(&str)
+	if err != nil && err.Error() == gocql.ErrNotFound.Error() {
+		return "", nil
+	}
+	if err != nil {
+		return "", log.ERetry(err, log.M{"num": num})
+	}
+	return str, nil
+}
+
+// account.job_created indexes the jobs of an account by creation time, it is
+// written once by InsertJob and expires with the job
+// CREATE TABLE account.job_created (accid ascii, created bigint, id ascii, PRIMARY KEY (accid, created, id)) WITH CLUSTERING ORDER BY (created DESC, id DESC);
+// CREATE TABLE account.job (accid ascii, id ascii, name text, desscription text, category text, timeout_sec bigint, created bigint, force_ended bigint, ended bigint, status text, status_updated bigint, output blob, PRIMARY KEY ((accid, id)));
+// ALTER TABLE account.job ADD (progress_done bigint, progress_total bigint, output_url text);
+// ALTER TABLE account.job ADD (payload blob, worker text, lease_sec bigint, attempts int);
+// ALTER TABLE account.job ADD queued boolean;
+// account.job_queue2 holds the enqueued jobs which are not ended yet, oldest
+// first, partitioned by day of creation so ended entries do not pile up as
+// tombstones in front of the queue
+// CREATE TABLE account.job_queue2 (category ascii, day bigint, created bigint, accid ascii, id ascii, PRIMARY KEY ((category, day), created, accid, id));
+// ALTER TABLE account.job_queue2 ADD (worker text, last_ping_ms bigint, lease_sec bigint);
+// CREATE TABLE account.job_log (accid ascii, jobid ascii, created bigint, id ascii, level ascii, message text, PRIMARY KEY ((accid, jobid), created, id));
+
+const jobColumns = `id, name, description, category, timeout_sec, created, force_ended, ended, status, status_updated, output, last_ping_ms, progress_done, progress_total, output_url, payload, queued, worker, lease_sec, attempts`
+
+// jobFields returns the scan destinations of jobColumns
+func jobFields(job *JobInfo) []interface{} {
+	return []interface{}{&job.Id, &job.Name, &job.Description, &job.Category, &job.TimeoutSec, &job.Created, &job.ForceEnded, &job.Ended, &job.Status, &job.StatusUpdated, &job.Output, &job.LastPingMs, &job.ProgressDone, &job.ProgressTotal, &job.OutputUrl, &job.Payload, &job.Queued, &job.Worker, &job.LeaseSec, &job.Attempts}
+}
+
+func (me *cqlStore) GetJob(ctx context.Context, accid, jobid string) (*JobInfo, error) {
+	job := &JobInfo{Job: &header.Job{AccountId: accid}}
+	err := me.session.Query(`SELECT `+jobColumns+` FROM account.job WHERE accid=? AND id=?`, accid, jobid).WithContext(ctx).Scan(jobFields(job)...)
+	if err != nil && err.Error() == gocql.ErrNotFound.Error() {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, log.ERetry(err, log.M{"account_id": accid, "jobid": jobid})
+	}
+	return job, nil
+}
+
+func (me *cqlStore) InsertJob(ctx context.Context, job *header.Job) error {
+	err := me.session.Query(`INSERT INTO account.job(accid, id, name, description, category, timeout_sec, created) VALUES(?,?,?,?,?,?,?) USING TTL 864000`, job.AccountId, job.Id, job.Name, job.Description, job.Category, job.TimeoutSec, job.Created).WithContext(ctx).Exec()
+	if err != nil {
+		return log.ERetry(err, log.M{"account_id": job.AccountId, "name": job.Name, "description": job.Description, "category": job.Category})
+	}
+	err = me.session.Query(`INSERT INTO account.job_created(accid, created, id) VALUES(?,?,?) USING TTL 864000`, job.AccountId, job.Created, job.Id).WithContext(ctx).Exec()
+	if err != nil {
+		return log.ERetry(err, log.M{"account_id": job.AccountId, "job_id": job.Id})
+	}
+	return nil
+}
+
+func (me *cqlStore) UpdateJobStatus(ctx context.Context, accid, jobid, status string, updated int64) error {
+	err := me.session.Query(`INSERT INTO account.job(accid, id, status, status_updated) VALUES(?,?,?,?) USING TTL 864000`, accid, jobid, status, updated).WithContext(ctx).Exec()
+	if err != nil {
+		return log.ERetry(err, log.M{"account_id": accid, "jobid": jobid, "status": status})
+	}
+	return nil
+}
+
+func (me *cqlStore) ForceEndJob(ctx context.Context, accid, jobid string, ended int64) error {
+	err := me.session.Query(`INSERT INTO account.job(accid, id, force_ended, ended) VALUES(?,?,?,?) USING TTL 864000`, accid, jobid, ended, ended).WithContext(ctx).Exec()
+	if err != nil {
+		return log.ERetry(err, log.M{"account_id": accid, "job_id": jobid})
+	}
+	return nil
+}
+
+func (me *cqlStore) EndJob(ctx context.Context, accid, jobid, status string, ended int64, output []byte, outputurl string) error {
+	err := me.session.Query(`INSERT INTO account.job(accid, id, status, ended, output, output_url, last_ping_ms) VALUES(?,?,?,?,?,?,?) USING TTL 864000`, accid, jobid, status, ended, output, outputurl, ended).WithContext(ctx).Exec()
+	if err != nil {
+		return log.ERetry(err, log.M{"account_id": accid, "jobid": jobid, "status": status})
+	}
+	return nil
+}
+
+func (me *cqlStore) PingJob(ctx context.Context, accid, jobid string, ping int64) error {
+	err := me.session.Query(`INSERT INTO account.job(accid, id, last_ping_ms) VALUES(?,?,?) USING TTL 864000`, accid, jobid, ping).WithContext(ctx).Exec()
+	if err != nil {
+		return log.ERetry(err, log.M{"account_id": accid, "jobid": jobid})
+	}
+	return nil
+}
+
+func (me *cqlStore) UpdateJobProgress(ctx context.Context, accid, jobid string, done, total, updated int64) error {
+	err := me.session.Query(`INSERT INTO account.job(accid, id, progress_done, progress_total, status_updated) VALUES(?,?,?,?,?) USING TTL 864000`, accid, jobid, done, total, updated).WithContext(ctx).Exec()
+	if err != nil {
+		return log.ERetry(err, log.M{"account_id": accid, "jobid": jobid})
+	}
+	return nil
+}
+
+func (me *cqlStore) AppendJobLog(ctx context.Context, accid, jobid string, entry *JobLog) error {
+	err := me.session.Query(`INSERT INTO account.job_log(accid, jobid, created, id, level, message) VALUES(?,?,?,?,?,?) USING TTL 864000`, accid, jobid, entry.Created, randstr.Hex(4), entry.Level, entry.Message).WithContext(ctx).Exec()
+	if err != nil {
+		return log.ERetry(err, log.M{"account_id": accid, "jobid": jobid})
+	}
+	return nil
+}
+
+func (me *cqlStore) ListJobLogs(ctx context.Context, accid, jobid string, limit int) ([]*JobLog, error) {
+	entries := []*JobLog{}
+	iter := me.session.Query(`SELECT created, level, message FROM account.job_log WHERE accid=? AND jobid=? LIMIT ?`, accid, jobid, limit).WithContext(ctx).Iter()
+	var created int64
+	var level, message string
+	for iter.Scan(&created, &level, &message) {
+		entries = append(entries, &JobLog{Created: created, Level: level, Message: message})
+	}
+	if err := iter.Close(); err != nil {
+		return nil, log.ERetry(err, log.M{"account_id": accid, "jobid": jobid})
+	}
+	return entries, nil
+}
+
+func (me *cqlStore) EnqueueJob(ctx context.Context, job *JobInfo) error {
+	// conditional like every later write of the job, a retried insert does
+	// not reset a lease
+	_, err := me.session.Query(`INSERT INTO account.job(accid, id, name, description, category, timeout_sec, created, payload, queued, worker, last_ping_ms, attempts) VALUES(?,?,?,?,?,?,?,?,true,'',0,0) IF NOT EXISTS USING TTL 864000`, job.AccountId, job.Id, job.Name, job.Description, job.Category, job.TimeoutSec, job.Created, job.Payload).WithContext(ctx).MapScanCAS(map[string]interface{}{})
+	if err != nil {
+		return log.ERetry(err, log.M{"account_id": job.AccountId, "category": job.Category})
+	}
+	err = me.session.Query(`INSERT INTO account.job_created(accid, created, id) VALUES(?,?,?) USING TTL 864000`, job.AccountId, job.Created, job.Id).WithContext(ctx).Exec()
+	if err != nil {
+		return log.ERetry(err, log.M{"account_id": job.AccountId, "job_id": job.Id})
+	}
+	err = me.session.Query(`INSERT INTO account.job_queue2(category, day, created, accid, id) VALUES(?,?,?,?,?) USING TTL 864000`, job.Category, job.Created/queueDayMs, job.Created, job.AccountId, job.Id).WithContext(ctx).Exec()
+	if err != nil {
+		return log.ERetry(err, log.M{"account_id": job.AccountId, "job_id": job.Id})
+	}
+	return nil
+}
+
+func (me *cqlStore) ListQueuedJobs(ctx context.Context, category string, day int64, after *header.Job, limit int) ([]*JobInfo, error) {
+	entries := []*JobInfo{}
+	query := me.session.Query(`SELECT created, accid, id, worker, last_ping_ms, lease_sec FROM account.job_queue2 WHERE category=? AND day=? LIMIT ?`, category, day, limit)
+	if after != nil {
+		query = me.session.Query(`SELECT created, accid, id, worker, last_ping_ms, lease_sec FROM account.job_queue2 WHERE category=? AND day=? AND (created, accid, id) > (?, ?, ?) LIMIT ?`, category, day, after.Created, after.AccountId, after.Id, limit)
+	}
+	iter := query.WithContext(ctx).Iter()
+	for {
+		entry := &JobInfo{Job: &header.Job{Category: category}}
+		if !iter.Scan(&entry.Created, &entry.AccountId, &entry.Id, &entry.Worker, &entry.LastPingMs, &entry.LeaseSec) {
+			break
+		}
+		entries = append(entries, entry)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, log.ERetry(err, log.M{"category": category})
+	}
+	return entries, nil
+}
+
+func (me *cqlStore) SetQueuedJobLease(ctx context.Context, entry *header.Job, worker string, ping, leasesec int64) error {
+	// the entry expires with the job
+	ttl := max(entry.Created/1000+queuedJobTimeoutSec-time.Now().Unix(), 1)
+	err := me.session.Query(`UPDATE account.job_queue2 USING TTL ? SET worker=?, last_ping_ms=?, lease_sec=? WHERE category=? AND day=? AND created=? AND accid=? AND id=?`, ttl, worker, ping, leasesec, entry.Category, entry.Created/queueDayMs, entry.Created, entry.AccountId, entry.Id).WithContext(ctx).Exec()
+	if err != nil {
+		return log.ERetry(err, log.M{"account_id": entry.AccountId, "job_id": entry.Id, "worker": worker})
+	}
+	return nil
+}
+
+func (me *cqlStore) DequeueJob(ctx context.Context, entry *header.Job) error {
+	err := me.session.Query(`DELETE FROM account.job_queue2 WHERE category=? AND day=? AND created=? AND accid=? AND id=?`, entry.Category, entry.Created/queueDayMs, entry.Created, entry.AccountId, entry.Id).WithContext(ctx).Exec()
+	if err != nil {
+		return log.ERetry(err, log.M{"account_id": entry.AccountId, "job_id": entry.Id})
+	}
+	return nil
+}
+
+func (me *cqlStore) SetJobWorker(ctx context.Context, accid, jobid, oldworker string, oldping int64, worker string, ping, leasesec int64, attempts int) (bool, error) {
+	applied, err := me.session.Query(`UPDATE account.job USING TTL 864000 SET worker=?, last_ping_ms=?, lease_sec=?, attempts=? WHERE accid=? AND id=? IF worker=? AND last_ping_ms=?`, worker, ping, leasesec, attempts, accid, jobid, oldworker, oldping).WithContext(ctx).MapScanCAS(map[string]interface{}{})
+	if err != nil {
+		return false, log.ERetry(err, log.M{"account_id": accid, "job_id": jobid, "worker": worker})
+	}
+	return applied, nil
+}
+
+func (me *cqlStore) RenewJobLease(ctx context.Context, accid, jobid, worker string, ping int64) (bool, error) {
+	applied, err := me.session.Query(`UPDATE account.job USING TTL 864000 SET last_ping_ms=? WHERE accid=? AND id=? IF worker=?`, ping, accid, jobid, worker).WithContext(ctx).MapScanCAS(map[string]interface{}{})
+	if err != nil {
+		return false, log.ERetry(err, log.M{"account_id": accid, "job_id": jobid, "worker": worker})
+	}
+	return applied, nil
+}
+
+func (me *cqlStore) ReleaseJobLease(ctx context.Context, accid, jobid, worker string, attempts int) (bool, error) {
+	applied, err := me.session.Query(`UPDATE account.job USING TTL 864000 SET worker='', last_ping_ms=0, lease_sec=0, attempts=? WHERE accid=? AND id=? IF worker=?`, attempts, accid, jobid, worker).WithContext(ctx).MapScanCAS(map[string]interface{}{})
+	if err != nil {
+		return false, log.ERetry(err, log.M{"account_id": accid, "job_id": jobid, "worker": worker})
+	}
+	return applied, nil
+}
+
+func (me *cqlStore) EndLeasedJob(ctx context.Context, accid, jobid, worker, status string, ended int64, output []byte, outputurl string) (bool, error) {
+	applied, err := me.session.Query(`UPDATE account.job USING TTL 864000 SET status=?, ended=?, output=?, output_url=?, last_ping_ms=?, worker='' WHERE accid=? AND id=? IF worker=?`, status, ended, output, outputurl, ended, accid, jobid, worker).WithContext(ctx).MapScanCAS(map[string]interface{}{})
+	if err != nil {
+		return false, log.ERetry(err, log.M{"account_id": accid, "job_id": jobid, "worker": worker, "status": status})
+	}
+	return applied, nil
+}
+
+func (me *cqlStore) ForceEndQueuedJob(ctx context.Context, accid, jobid, worker string, ended int64) (bool, error) {
+	applied, err := me.session.Query(`UPDATE account.job USING TTL 864000 SET force_ended=?, ended=?, worker='' WHERE accid=? AND id=? IF worker=?`, ended, ended, accid, jobid, worker).WithContext(ctx).MapScanCAS(map[string]interface{}{})
+	if err != nil {
+		return false, log.ERetry(err, log.M{"account_id": accid, "job_id": jobid, "worker": worker})
+	}
+	return applied, nil
+}
+
+func (me *cqlStore) UpdateQueuedJobStatus(ctx context.Context, accid, jobid, worker, status string, updated int64) (bool, error) {
+	applied, err := me.session.Query(`UPDATE account.job USING TTL 864000 SET status=?, status_updated=? WHERE accid=? AND id=? IF worker=?`, status, updated, accid, jobid, worker).WithContext(ctx).MapScanCAS(map[string]interface{}{})
+	if err != nil {
+		return false, log.ERetry(err, log.M{"account_id": accid, "job_id": jobid, "worker": worker, "status": status})
+	}
+	return applied, nil
+}
+
+func (me *cqlStore) UpdateQueuedJobProgress(ctx context.Context, accid, jobid, worker string, done, total, updated int64) (bool, error) {
+	applied, err := me.session.Query(`UPDATE account.job USING TTL 864000 SET progress_done=?, progress_total=?, status_updated=? WHERE accid=? AND id=? IF worker=?`, done, total, updated, accid, jobid, worker).WithContext(ctx).MapScanCAS(map[string]interface{}{})
+	if err != nil {
+		return false, log.ERetry(err, log.M{"account_id": accid, "job_id": jobid, "worker": worker})
+	}
+	return applied, nil
+}
+
+func (me *cqlStore) ListJobs(ctx context.Context, accid string, from, to int64, beforeid string, limit int) ([]*header.Job, *header.Job, error) {
+	entries := []*header.Job{}
+	var created int64
+	var id string
+	if beforeid != "" {
+		iter := me.session.Query(`SELECT created, id FROM account.job_created WHERE accid=? AND created=? AND id<? LIMIT ?`, accid, to, beforeid, limit).WithContext(ctx).Iter()
+		for iter.Scan(&created, &id) {
+			entries = append(entries, &header.Job{AccountId: accid, Id: id, Created: created})
+		}
+		if err := iter.Close(); err != nil {
+			return nil, nil, log.ERetry(err, log.M{"account_id": accid})
+		}
+		to--
+	}
+	if len(entries) < limit && from <= to {
+		iter := me.session.Query(`SELECT created, id FROM account.job_created WHERE accid=? AND created>=? AND created<=? LIMIT ?`, accid, from, to, limit-len(entries)).WithContext(ctx).Iter()
+		for iter.Scan(&created, &id) {
+			entries = append(entries, &header.Job{AccountId: accid, Id: id, Created: created})
+		}
+		if err := iter.Close(); err != nil {
+			return nil, nil, log.ERetry(err, log.M{"account_id": accid})
+		}
+	}
+	var last *header.Job
+	if len(entries) == limit {
+		last = entries[len(entries)-1]
+	}
+	if len(entries) == 0 {
+		return []*header.Job{}, nil, nil
+	}
+
+	ids := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		ids = append(ids, entry.Id)
+	}
+	jobm := map[string]*header.Job{}
+	iter := me.session.Query(`SELECT `+jobColumns+` FROM account.job WHERE accid=? AND id IN ?`, accid, ids).WithContext(ctx).Iter()
+	for {
+		job := &JobInfo{Job: &header.Job{AccountId: accid}}
+		if !iter.Scan(jobFields(job)...) {
+			break
+		}
+		jobm[job.Id] = job.Job
+	}
+	if err := iter.Close(); err != nil {
+		return nil, nil, log.ERetry(err, log.M{"account_id": accid})
+	}
+
+	// keep the index order, skip expired jobs
+	jobs := make([]*header.Job, 0, len(ids))
+	for _, id := range ids {
+		if job := jobm[id]; job != nil {
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs, last, nil
+}
+
+func (me *cqlStore) GetKV(ctx context.Context, k string) (string, bool, error) {
+	var val string
+	err := me.session.Query(`SELECT v FROM kv.kv WHERE k=?`, k).WithContext(ctx).Scan(&val)
+	if err != nil && err.Error() == gocql.ErrNotFound.Error() {
+		return "", false, nil
+	}
+
+	if err != nil {
+		return "", false, log.ERetry(err, log.M{"key": k})
+	}
+	return val, true, nil
+}
+
+func (me *cqlStore) SetKV(ctx context.Context, k, v string, ttlsec int) error {
+	err := me.session.Query(`INSERT INTO kv.kv(k,v) VALUES(?,?) USING TTL ?`, k, v, ttlsec).WithContext(ctx).Exec()
+	if err != nil {
+		return log.ERetry(err, log.M{"key": k, "value": v, "ttl_sec": ttlsec})
+	}
+	return nil
+}
+
+func (me *cqlStore) DelKV(ctx context.Context, k string) error {
+	err := me.session.Query(`DELETE FROM kv.kv WHERE k=?`, k).WithContext(ctx).Exec()
+	if err != nil {
+		return log.ERetry(err, log.M{"key": k})
+	}
+	return nil
+}
+
+func (me *cqlStore) GetKVVersion(ctx context.Context, k string) (string, int64, bool, error) {
+	var val string
+	var version int64
+	err := me.session.Query(`SELECT v, writetime(v) FROM kv.kv WHERE k=?`, k).WithContext(ctx).Scan(&val, &version)
+	if err != nil && err.Error() == gocql.ErrNotFound.Error() {
+		return "", 0, false, nil
+	}
+
+	if err != nil {
+		return "", 0, false, log.ERetry(err, log.M{"key": k})
+	}
+	return val, version, true, nil
+}
+
+func (me *cqlStore) InsertKVIfNotExists(ctx context.Context, k, v string, ttlsec int) (bool, error) {
+	applied, err := me.session.Query(`INSERT INTO kv.kv(k,v) VALUES(?,?) IF NOT EXISTS USING TTL ?`, k, v, ttlsec).WithContext(ctx).MapScanCAS(map[string]interface{}{})
+	if err != nil {
+		return false, log.ERetry(err, log.M{"key": k, "value": v, "ttl_sec": ttlsec})
+	}
+	return applied, nil
+}
+
+func (me *cqlStore) CompareAndSwapKV(ctx context.Context, k, oldv, newv string, ttlsec int) (bool, error) {
+	applied, err := me.session.Query(`UPDATE kv.kv USING TTL ? SET v=? WHERE k=? IF v=?`, ttlsec, newv, k, oldv).WithContext(ctx).MapScanCAS(map[string]interface{}{})
+	if err != nil {
+		return false, log.ERetry(err, log.M{"key": k, "old_value": oldv, "value": newv, "ttl_sec": ttlsec})
+	}
+	return applied, nil
+}
+
+func (me *cqlStore) GetKVTTL(ctx context.Context, k string) (int, bool, error) {
+	var ttl int
+	err := me.session.Query(`SELECT TTL(v) FROM kv.kv WHERE k=?`, k).WithContext(ctx).Scan(&ttl)
+	if err != nil && err.Error() == gocql.ErrNotFound.Error() {
+		return 0, false, nil
+	}
+
+	if err != nil {
+		return 0, false, log.ERetry(err, log.M{"key": k})
+	}
+	return ttl, true, nil
+}
+
+func (me *cqlStore) TouchKV(ctx context.Context, k, v string, version int64, ttlsec int) error {
+	// the timestamp right after the value's lets any later write win
+	err := me.session.Query(`UPDATE kv.kv USING TTL ? AND TIMESTAMP ? SET v=? WHERE k=?`, ttlsec, version+1, v, k).WithContext(ctx).Exec()
+	if err != nil {
+		return log.ERetry(err, log.M{"key": k, "ttl_sec": ttlsec})
+	}
+	return nil
+}
+
+func (me *cqlStore) DeleteKVIf(ctx context.Context, k, v string) (bool, error) {
+	applied, err := me.session.Query(`DELETE FROM kv.kv WHERE k=? IF v=?`, k, v).WithContext(ctx).MapScanCAS(map[string]interface{}{})
+	if err != nil {
+		return false, log.ERetry(err, log.M{"key": k, "value": v})
+	}
+	return applied, nil
+}
@@ -0,0 +1,115 @@
+package acclient
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thanhpk/randstr"
+)
+
+// testCQLStore connects to the Cassandra of ACCLIENT_TEST_CASSANDRA, a comma
+// separated list of seeds with the kv keyspace created, or skips the test
+func testCQLStore(t *testing.T) *cqlStore {
+	seeds := os.Getenv("ACCLIENT_TEST_CASSANDRA")
+	if seeds == "" {
+		t.Skip("ACCLIENT_TEST_CASSANDRA is not set")
+	}
+	session, err := connectDB(context.Background(), strings.Split(seeds, ","), "kv", 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(session.Close)
+	return &cqlStore{session: session}
+}
+
+func TestCQLStoreKV(t *testing.T) {
+	ctx := context.Background()
+	store := testCQLStore(t)
+	k := "test@" + randstr.Hex(8)
+
+	if _, found, err := store.GetKV(ctx, k); err != nil || found {
+		t.Fatalf("want no key, got %v %v", found, err)
+	}
+	if err := store.SetKV(ctx, k, "v1", 60); err != nil {
+		t.Fatal(err)
+	}
+	if v, found, err := store.GetKV(ctx, k); err != nil || !found || v != "v1" {
+		t.Errorf("want v1, got %q %v %v", v, found, err)
+	}
+	if err := store.DelKV(ctx, k); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, _ := store.GetKV(ctx, k); found {
+		t.Error("key should be deleted")
+	}
+}
+
+func TestCQLStoreKVConditional(t *testing.T) {
+	ctx := context.Background()
+	store := testCQLStore(t)
+	k := "test@" + randstr.Hex(8)
+
+	if ok, err := store.InsertKVIfNotExists(ctx, k, "0", 60); err != nil || !ok {
+		t.Fatalf("want key inserted, got %v %v", ok, err)
+	}
+	if ok, err := store.InsertKVIfNotExists(ctx, k, "9", 60); err != nil || ok {
+		t.Errorf("key exists, want not inserted, got %v %v", ok, err)
+	}
+	_, ver0, _, err := store.GetKVVersion(ctx, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := store.CompareAndSwapKV(ctx, k, "1", "2", 60); err != nil || ok {
+		t.Errorf("value is 0, want not swapped, got %v %v", ok, err)
+	}
+	if ok, err := store.CompareAndSwapKV(ctx, k, "0", "1", 60); err != nil || !ok {
+		t.Fatalf("want swapped, got %v %v", ok, err)
+	}
+	if v, ver1, found, err := store.GetKVVersion(ctx, k); err != nil || !found || v != "1" || ver1 <= ver0 {
+		t.Errorf("want 1 with a new version, got %q %d <= %d %v", v, ver1, ver0, err)
+	}
+	if ok, err := store.CompareAndSwapKV(ctx, "test@"+randstr.Hex(8), "", "1", 60); err != nil || ok {
+		t.Errorf("missing key, want not swapped, got %v %v", ok, err)
+	}
+	store.DelKV(ctx, k)
+}
+
+func TestCQLStoreKVTTL(t *testing.T) {
+	ctx := context.Background()
+	store := testCQLStore(t)
+	k := "test@" + randstr.Hex(8)
+
+	if _, found, err := store.GetKVTTL(ctx, k); err != nil || found {
+		t.Fatalf("want no key, got %v %v", found, err)
+	}
+	if err := store.SetKV(ctx, k, "v1", 60); err != nil {
+		t.Fatal(err)
+	}
+	if ttl, found, err := store.GetKVTTL(ctx, k); err != nil || !found || ttl <= 0 || ttl > 60 {
+		t.Errorf("want ttl within 60s, got %d %v %v", ttl, found, err)
+	}
+	_, version, _, err := store.GetKVVersion(ctx, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.TouchKV(ctx, k, "v1", version, KVNoExpiry); err != nil {
+		t.Fatal(err)
+	}
+	if ttl, found, err := store.GetKVTTL(ctx, k); err != nil || !found || ttl != KVNoExpiry {
+		t.Errorf("want no expiry, got %d %v %v", ttl, found, err)
+	}
+	// a write after the read wins over a late touch
+	if err := store.SetKV(ctx, k, "v2", 60); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.TouchKV(ctx, k, "v1", version, KVNoExpiry); err != nil {
+		t.Fatal(err)
+	}
+	if v, _, _ := store.GetKV(ctx, k); v != "v2" {
+		t.Errorf("want v2, got %q", v)
+	}
+	store.DelKV(ctx, k)
+}
@@ -1,6 +1,7 @@
 package acclient
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	nethtml "golang.org/x/net/html"
@@ -642,10 +643,13 @@ func PredictTrainingPrice(size int) int64 {
 	return int64((y1 + (float64(size)-x1)*(y2-y1)/(x2-x1)) * 1000000)
 }
 
-func DownloadAsText(accid, url string) (string, error) {
+// DownloadAsText crawls url and returns its content as markdown
+func (me *Client) DownloadAsText(ctx context.Context, accid, url string) (string, error) {
+	ctx, span := me.startSpan(ctx, "DownloadAsText", accid)
+	defer span.End()
 	defer header.KLock("download_as_text." + accid + "." + url)()
 
-	req, err := http.NewRequest("GET", getApiHost(accid)+"/4.1/crawls", nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", getApiHost(accid)+"/4.1/crawls", nil)
 	if err != nil {
 		return "", log.EData(err, nil, log.M{"account_id": accid, "url": url})
 	}
@@ -655,7 +659,7 @@ func DownloadAsText(accid, url string) (string, error) {
 	q.Add("url", url)
 	req.URL.RawQuery = q.Encode()
 	req.Header.Set("X-By", "acclient")
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return "", log.ERetry(err, log.M{"account_id": accid, "url": url})
 	}
@@ -0,0 +1,93 @@
+package acclient
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gocql/gocql"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const tracerName = "github.com/subiz/acclient"
+
+// WithTracerProvider enables tracing: a span for each call of the client API,
+// with child spans for the Cassandra queries, the HTTP calls and the gRPC
+// calls made on the way. Trace context is propagated in gRPC metadata and
+// HTTP headers with the global propagator (see otel.SetTextMapPropagator).
+// Tracing is off by default, pass otel.GetTracerProvider() to use the global
+// provider.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(me *Client) { me.tracer, me.tracerProvider = tp.Tracer(tracerName), tp }
+}
+
+var noopTracer = noop.NewTracerProvider().Tracer(tracerName)
+
+// startSpan starts the span of a client API call, accid may be empty. The
+// HTTP calls made with the returned ctx report to the client metrics.
+func (me *Client) startSpan(ctx context.Context, name, accid string) (context.Context, trace.Span) {
+	ctx = withMetrics(ctx, me.metrics)
+	if accid == "" {
+		return me.tracer.Start(ctx, "acclient."+name)
+	}
+	return me.tracer.Start(ctx, "acclient."+name, trace.WithAttributes(attribute.String("account_id", accid)))
+}
+
+// startChildSpan starts a span for a backend operation, only when ctx
+// already carries a span, with the provider of that span
+func startChildSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	parent := trace.SpanFromContext(ctx)
+	if !parent.IsRecording() {
+		return ctx, parent
+	}
+	return parent.TracerProvider().Tracer(tracerName).Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+// endSpan ends span, recording err if any
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(otelcodes.Error, err.Error())
+	}
+	span.End()
+}
+
+// cqlTracer turns the Cassandra queries into spans
+type cqlTracer struct{}
+
+func (cqlTracer) ObserveQuery(ctx context.Context, q gocql.ObservedQuery) {
+	parent := trace.SpanFromContext(ctx)
+	if !parent.IsRecording() {
+		return
+	}
+	_, span := parent.TracerProvider().Tracer(tracerName).Start(ctx, "cassandra.query",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithTimestamp(q.Start),
+		trace.WithAttributes(
+			attribute.String("db.system", "cassandra"),
+			attribute.String("db.statement", q.Statement),
+			attribute.Int("db.cassandra.attempt", q.Attempt),
+			attribute.Int("db.cassandra.rows", q.Rows),
+		))
+	if q.Err != nil {
+		span.RecordError(q.Err)
+		span.SetStatus(otelcodes.Error, q.Err.Error())
+	}
+	span.End(trace.WithTimestamp(q.End))
+}
+
+// traceRequest starts the span of an HTTP call and injects its context in
+// the headers of a copy of req
+func traceRequest(req *http.Request) (*http.Request, trace.Span) {
+	ctx, span := startChildSpan(req.Context(), "HTTP "+req.Method,
+		attribute.String("http.request.method", req.Method),
+		attribute.String("server.address", req.URL.Host),
+		attribute.String("url.path", req.URL.Path))
+	req = req.Clone(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	return req, span
+}
@@ -0,0 +1,295 @@
+package acclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/subiz/header"
+	pb "github.com/subiz/header/account"
+	pm "github.com/subiz/header/payment"
+	"github.com/subiz/log"
+	"google.golang.org/protobuf/proto"
+)
+
+// warmupConcurrency is how many accounts Warmup loads at the same time
+const warmupConcurrency = 8
+
+// snapshotInterval is how often the cache snapshot is saved
+const snapshotInterval = 5 * time.Minute
+
+// Warmup loads the resources most calls need (account, subscription,
+// agents, groups, attribute definitions and shop setting) of the accounts
+// into the cache. Every active account is warmed up when accids is empty.
+// All accounts are tried, the first error is returned.
+func (me *Client) Warmup(ctx context.Context, accids []string) error {
+	ctx, span := me.startSpan(ctx, "Warmup", "")
+	defer span.End()
+	if len(accids) == 0 {
+		var err error
+		if accids, err = me.ListActiveAccountIds(ctx); err != nil {
+			return err
+		}
+	}
+
+	ctx = NoCopy(ctx)
+	loads := []func(accid string) error{
+		func(accid string) error { _, err := me.GetAccount(ctx, accid); return err },
+		func(accid string) error { _, err := me.GetSubscription(ctx, accid); return err },
+		func(accid string) error { _, err := me.ListAgentM(ctx, accid); return err },
+		func(accid string) error { _, err := me.ListGroups(ctx, accid); return err },
+		func(accid string) error { _, err := me.ListDefs(ctx, accid); return err },
+		func(accid string) error { _, err := me.GetShopSetting(ctx, accid); return err },
+	}
+
+	lock := &sync.Mutex{}
+	var firsterr error
+	wg := &sync.WaitGroup{}
+	sem := make(chan struct{}, warmupConcurrency)
+	for _, accid := range accids {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return ctx.Err()
+		}
+		wg.Add(1)
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			for _, load := range loads {
+				if err := load(accid); err != nil {
+					lock.Lock()
+					if firsterr == nil {
+						firsterr = err
+					}
+					lock.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return firsterr
+}
+
+// snapshotCodec converts a cached value to and from protobuf encoded
+// items
+type snapshotCodec struct {
+	encode func(value any) (map[string][]byte, error)
+	decode func(items map[string][]byte) (any, error)
+}
+
+// snapshotCodecs are the resources kept in cache snapshots, the warmed up
+// ones
+var snapshotCodecs = map[string]snapshotCodec{
+	"account":              protoCodec[pb.Account](),
+	"subscription":         protoCodec[pm.Subscription](),
+	"agent":                protoMapCodec[pb.Agent](),
+	"agent_group":          protoSliceCodec[header.AgentGroup](),
+	"attribute_definition": protoMapCodec[header.AttributeDefinition](),
+	"shop_setting":         protoCodec[header.ShopSetting](),
+}
+
+func protoCodec[T any, PT interface {
+	*T
+	proto.Message
+}]() snapshotCodec {
+	return snapshotCodec{
+		encode: func(value any) (map[string][]byte, error) {
+			msg, ok := value.(PT)
+			if !ok {
+				return nil, log.EData(nil, nil, log.M{"type": fmt.Sprintf("%T", value)})
+			}
+			data, err := proto.Marshal(msg)
+			return map[string][]byte{"": data}, err
+		},
+		decode: func(items map[string][]byte) (any, error) {
+			msg := PT(new(T))
+			return msg, proto.Unmarshal(items[""], msg)
+		},
+	}
+}
+
+func protoMapCodec[T any, PT interface {
+	*T
+	proto.Message
+}]() snapshotCodec {
+	return snapshotCodec{
+		encode: func(value any) (map[string][]byte, error) {
+			m, ok := value.(map[string]PT)
+			if !ok {
+				return nil, log.EData(nil, nil, log.M{"type": fmt.Sprintf("%T", value)})
+			}
+			items := make(map[string][]byte, len(m))
+			for k, msg := range m {
+				data, err := proto.Marshal(msg)
+				if err != nil {
+					return nil, err
+				}
+				items[k] = data
+			}
+			return items, nil
+		},
+		decode: func(items map[string][]byte) (any, error) {
+			m := make(map[string]PT, len(items))
+			for k, data := range items {
+				msg := PT(new(T))
+				if err := proto.Unmarshal(data, msg); err != nil {
+					return nil, err
+				}
+				m[k] = msg
+			}
+			return m, nil
+		},
+	}
+}
+
+func protoSliceCodec[T any, PT interface {
+	*T
+	proto.Message
+}]() snapshotCodec {
+	return snapshotCodec{
+		encode: func(value any) (map[string][]byte, error) {
+			list, ok := value.([]PT)
+			if !ok {
+				return nil, log.EData(nil, nil, log.M{"type": fmt.Sprintf("%T", value)})
+			}
+			items := make(map[string][]byte, len(list))
+			for i, msg := range list {
+				data, err := proto.Marshal(msg)
+				if err != nil {
+					return nil, err
+				}
+				items[strconv.Itoa(i)] = data
+			}
+			return items, nil
+		},
+		decode: func(items map[string][]byte) (any, error) {
+			list := make([]PT, len(items))
+			for k, data := range items {
+				i, err := strconv.Atoi(k)
+				if err != nil || i < 0 || i >= len(list) {
+					return nil, log.EData(err, nil, log.M{"index": k})
+				}
+				list[i] = PT(new(T))
+				if err := proto.Unmarshal(data, list[i]); err != nil {
+					return nil, err
+				}
+			}
+			return list, nil
+		},
+	}
+}
+
+type cacheSnapshot struct {
+	Created int64            `json:"created"`
+	ConnId  string           `json:"conn_id"`
+	Cursor  string           `json:"cursor"`
+	Entries []*snapshotEntry `json:"entries"`
+}
+
+type snapshotEntry struct {
+	Resource string            `json:"resource"`
+	Id       string            `json:"id"`
+	Fresh    int64             `json:"fresh"` // unix ms
+	Items    map[string][]byte `json:"items"`
+}
+
+func (me *Client) snapshotLoop() {
+	for sleepCtx(me.ctx, snapshotInterval) {
+		if err := me.saveSnapshot(); err != nil {
+			log.WarnContext(me.ctx, "acclient: cannot save cache snapshot", "path", me.snapshotPath, "err", err.Error())
+		}
+	}
+	// closing
+	if err := me.saveSnapshot(); err != nil {
+		log.WarnContext(me.ctx, "acclient: cannot save cache snapshot", "path", me.snapshotPath, "err", err.Error())
+	}
+}
+
+// saveSnapshot writes the snapshot resources of the watched accounts, found
+// missing resources are left out
+func (me *Client) saveSnapshot() error {
+	snapshot := &cacheSnapshot{Created: time.Now().UnixMilli()}
+	me.subscribeTopicLock.Lock()
+	snapshot.ConnId, snapshot.Cursor = me.pollConnId, me.pollCursor
+	me.subscribeTopicLock.Unlock()
+
+	for _, topic := range me.watchedTopics() {
+		resource, accid, _ := strings.Cut(topic, ".")
+		codec, has := snapshotCodecs[resource]
+		if !has {
+			continue
+		}
+		value, found := me.cache.Get(topic)
+		entry, ok := value.(cacheEntry)
+		if !found || !ok || entry.value == nil {
+			continue
+		}
+		items, err := codec.encode(entry.value)
+		if err != nil {
+			log.WarnContext(me.ctx, "acclient: cannot save cache snapshot entry", "topic", topic, "err", err.Error())
+			continue
+		}
+		snapshot.Entries = append(snapshot.Entries, &snapshotEntry{Resource: resource, Id: accid, Fresh: entry.fresh.UnixMilli(), Items: items})
+	}
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(me.snapshotPath), os.ModePerm); err != nil {
+		return err
+	}
+	tmp := me.snapshotPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, me.snapshotPath)
+}
+
+// restoreSnapshot fills the cache with the stale entries of the snapshot
+// file if any. Entries past their max staleness are dropped, the others are
+// watched again.
+func (me *Client) restoreSnapshot() {
+	data, err := os.ReadFile(me.snapshotPath)
+	if err != nil {
+		return
+	}
+	snapshot := &cacheSnapshot{}
+	if err := json.Unmarshal(data, snapshot); err != nil {
+		log.WarnContext(me.ctx, "acclient: invalid cache snapshot", "path", me.snapshotPath, "err", err.Error())
+		return
+	}
+
+	now := time.Now()
+	for _, entry := range snapshot.Entries {
+		codec, has := snapshotCodecs[entry.Resource]
+		if !has || me.cacheTTL(entry.Resource) <= 0 || me.maxStale(entry.Resource) <= 0 {
+			continue
+		}
+		fresh := time.UnixMilli(entry.Fresh)
+		ttl := fresh.Sub(now) + me.maxStale(entry.Resource)
+		if ttl <= 0 {
+			continue
+		}
+		value, err := codec.decode(entry.Items)
+		if err != nil {
+			log.WarnContext(me.ctx, "acclient: cannot restore cache snapshot entry", "resource", entry.Resource, "account_id", entry.Id, "err", err.Error())
+			continue
+		}
+		// stale, events missed while the process was down may not be caught
+		// up, so the first read reloads the entry
+		me.cache.Set(entry.Resource+"."+entry.Id, cacheEntry{value: value}, ttl)
+		me.subscribe(entry.Id, entry.Resource)
+	}
+
+	me.subscribeTopicLock.Lock()
+	me.pollConnId, me.pollCursor = snapshot.ConnId, snapshot.Cursor
+	me.subscribeTopicLock.Unlock()
+}
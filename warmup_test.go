@@ -0,0 +1,62 @@
+package acclient
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/subiz/goutils/conv"
+	"github.com/subiz/header"
+	pb "github.com/subiz/header/account"
+)
+
+func TestCacheSnapshot(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "acclient.snapshot")
+	opts := []Option{WithCacheSnapshot(path), WithMaxStale("account", time.Hour), WithMaxStale("agent", time.Hour)}
+	c := New(opts...)
+	c.subscribe("acc1", "account")
+	c.cacheSet("account", "acc1", &pb.Account{Id: conv.S("acc1")})
+	c.subscribe("acc1", "agent")
+	c.cacheSet("agent", "acc1", map[string]*pb.Agent{"ag1": {Id: conv.S("ag1")}})
+	c.subscribe("acc1", "agent_group")
+	c.cacheSet("agent_group", "acc1", []*header.AgentGroup{{Id: "gr1"}, {Id: "gr2"}})
+	c.subscribe("acc2", "account")
+	c.cacheSet("account", "acc2", nil)
+	c.subscribe("acc3", "account")
+	c.cacheSet("account", "acc3", &pb.Agent{Id: conv.S("ag1")})
+	c.pollConnId, c.pollCursor = "conn1", "42"
+	if err := c.saveSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+
+	c = New(opts...)
+	// restored values are stale, the first read reloads them
+	if acc, state := cacheLookup[*pb.Account](ctx, c, "account", "acc1"); state != cacheStale || acc.GetId() != "acc1" {
+		t.Errorf("want stale acc1, got %v %v", acc, state)
+	}
+	if agents, state := cacheLookup[map[string]*pb.Agent](ctx, c, "agent", "acc1"); state != cacheStale || agents["ag1"].GetId() != "ag1" {
+		t.Errorf("want stale ag1, got %v %v", agents, state)
+	}
+	if groups, state := cacheLookup[[]*header.AgentGroup](ctx, c, "agent_group", "acc1"); state != cacheStale || len(groups) != 2 || groups[1].GetId() != "gr2" {
+		t.Errorf("want stale gr1, gr2, got %v %v", groups, state)
+	}
+	if _, state := cacheLookup[*pb.Account](ctx, c, "account", "acc2"); state != cacheMiss {
+		t.Error("missing accounts are not kept in snapshots")
+	}
+	if _, state := cacheLookup[*pb.Account](ctx, c, "account", "acc3"); state != cacheMiss {
+		t.Error("values of the wrong type are not kept in snapshots")
+	}
+	if c.pollConnId != "conn1" || c.pollCursor != "42" {
+		t.Errorf("want the pubsub cursor restored, got %s %s", c.pollConnId, c.pollCursor)
+	}
+	if topics := c.watchedTopics(); len(topics) != 3 {
+		t.Errorf("want the restored resources watched, got %v", topics)
+	}
+
+	c = New(WithCacheSnapshot(path))
+	if _, state := cacheLookup[*pb.Account](ctx, c, "account", "acc1"); state != cacheMiss {
+		t.Error("accounts are never stale by default, they should not be restored")
+	}
+}